@@ -0,0 +1,112 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+var AdminCommand = cli.Command{
+	Name:  "admin",
+	Usage: "maintain the file store of a server",
+	Subcommands: []*cli.Command{
+		{
+			Name: "rekey",
+			Usage: "wrap the data keys of encrypted files with a new master key, and encrypt plaintext files. " +
+				"Stop the server first, and restart it with the new key",
+			Action: adminRekeyAction,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "root",
+					Value:   "fileserver",
+					Usage:   "root directory of the file store",
+					EnvVars: envVars("root"),
+				},
+				&cli.StringFlag{
+					Name:    "master-key-file",
+					Usage:   "new master key, 32 bytes raw or base64; or set GUPLOAD_MASTER_KEY",
+					EnvVars: envVars("master-key-file"),
+				},
+				&cli.StringFlag{
+					Name:  "old-master-key-file",
+					Usage: "current master key; not needed to encrypt a plaintext store",
+				},
+			},
+		},
+	},
+}
+
+func adminRekeyAction(c *cli.Context) (err error) {
+	root := c.String("root")
+
+	newKey, err := loadMasterKey(c.String("master-key-file"), os.Getenv(masterKeyEnv))
+	must(err)
+	if newKey == nil {
+		must(errors.New("master-key-file must be set"))
+	}
+	oldKey, err := loadMasterKey(c.String("old-master-key-file"), "")
+	must(err)
+
+	counts := map[string]int{}
+	failed := 0
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// staged files are transient, and left to the scanner
+			if path == filepath.Join(root, internalDir, "staging") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !rekeyable(root, path, info) {
+			return nil
+		}
+
+		result, err := rekeyFile(path, oldKey, newKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			failed++
+			return nil
+		}
+		counts[result]++
+		return nil
+	})
+	must(err)
+
+	fmt.Printf("master key %s: %d encrypted, %d rewrapped, %d already current\n",
+		newKey.ID, counts[rekeyEncrypted], counts[rekeyRewrapped], counts[rekeySkipped])
+	if failed > 0 {
+		must(fmt.Errorf("%d files failed", failed))
+	}
+	return
+}
+
+// rekeyable reports whether path holds file content: a stored file, or a pending or quarantined upload. The rest of
+// the internal folder, e.g. the metadata, event log, webhook and replication state, and the listings are plaintext.
+func rekeyable(root string, path string, info os.FileInfo) bool {
+	if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".upload-") {
+		return false
+	}
+	if path == filepath.Join(root, "public", "index.txt") {
+		return false
+	}
+	internal := filepath.Join(root, internalDir)
+	if !strings.HasPrefix(path, internal+string(filepath.Separator)) {
+		return true
+	}
+	switch filepath.Dir(path) {
+	case filepath.Join(internal, "pending"):
+		return filepath.Ext(path) == pendingDataExt
+	case filepath.Join(internal, "quarantine"):
+		// a quarantined file has its record next to it, as <file>.json
+		_, err := os.Stat(path + ".json")
+		return err == nil
+	}
+	return false
+}
@@ -0,0 +1,448 @@
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ArchiveFile is a file of a folder tree, named by its slash separated path relative to the tree root
+type ArchiveFile struct {
+	Name string
+	Mode os.FileMode
+	Data []byte
+}
+
+// cleanArchivePath returns the clean form of an archive entry name. Absolute paths, backslashes and names
+// escaping the tree are refused.
+func cleanArchivePath(name string) (string, error) {
+	clean := path.Clean(name)
+	if name == "" || path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") ||
+		strings.Contains(name, "\\") {
+		return "", errors.Errorf("unsafe path %s", name)
+	}
+	return clean, nil
+}
+
+// readTree reads the regular files of dir, except the files and folders excluded by skip
+func readTree(dir string, skip func(name string) bool) (files []ArchiveFile, err error) {
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if skip != nil && skip(name) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return errors.Errorf("%s is not a regular file", name)
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		files = append(files, ArchiveFile{Name: name, Mode: info.Mode().Perm(), Data: data})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", dir)
+	}
+	return
+}
+
+// expandFiles returns the regular files matching patterns. They are named by their base name, which must be unique.
+func expandFiles(patterns []string) (paths []string, err error) {
+	seen := map[string]string{}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern %s", pattern)
+		}
+		if len(matches) == 0 {
+			return nil, errors.Errorf("no file matches %s", pattern)
+		}
+		for _, match := range matches {
+			name := filepath.Base(match)
+			if other, ok := seen[name]; ok {
+				if other == match {
+					continue
+				}
+				return nil, errors.Errorf("%s and %s have the same name", other, match)
+			}
+			seen[name] = match
+
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !info.Mode().IsRegular() {
+				return nil, errors.Errorf("%s is not a regular file", match)
+			}
+			paths = append(paths, match)
+		}
+	}
+	return
+}
+
+// readFiles reads the files matching patterns, named by their base name
+func readFiles(patterns []string) (files []ArchiveFile, err error) {
+	paths, err := expandFiles(patterns)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", p)
+		}
+		files = append(files, ArchiveFile{Name: filepath.Base(p), Mode: info.Mode().Perm(), Data: data})
+	}
+	return
+}
+
+// writeTar writes files as a tar archive, with their folders and file modes
+func writeTar(w io.Writer, files []ArchiveFile) error {
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	tw := tar.NewWriter(w)
+	dirs := map[string]bool{}
+	for _, f := range files {
+		var parents []string
+		for dir := path.Dir(f.Name); dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+			parents = append([]string{dir}, parents...)
+		}
+		for _, dir := range parents {
+			if err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir, Name: dir + "/", Mode: 0755, ModTime: time.Now(),
+			}); err != nil {
+				return err
+			}
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg, Name: f.Name, Mode: int64(f.Mode), Size: int64(len(f.Data)), ModTime: time.Now(),
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.Data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// readTar reads a tar archive. Only folders and regular files with safe relative paths are accepted, up to
+// maxSize bytes of content in total; symlinks, devices and duplicates are refused.
+func readTar(r io.Reader, maxSize int64) (files []ArchiveFile, err error) {
+	tr := tar.NewReader(r)
+	seen := map[string]bool{}
+	var total int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid archive")
+		}
+
+		name, err := cleanArchivePath(hdr.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid archive")
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+		default:
+			return nil, errors.Errorf("invalid archive: %s is not a regular file", hdr.Name)
+		}
+		if seen[name] {
+			return nil, errors.Errorf("invalid archive: duplicate %s", name)
+		}
+		seen[name] = true
+
+		if total += hdr.Size; total > maxSize {
+			return nil, errors.Errorf("invalid archive: content exceeds %d bytes", maxSize)
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(tr, hdr.Size))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid archive")
+		}
+		files = append(files, ArchiveFile{Name: name, Mode: os.FileMode(hdr.Mode).Perm(), Data: b})
+	}
+}
+
+// writeTree writes files as the folder outDir. The tree is written aside and renamed; an existing outDir is
+// replaced only with force.
+func writeTree(files []ArchiveFile, outDir string, force bool) (err error) {
+	if _, err = os.Stat(outDir); err == nil && !force {
+		return errors.Errorf("%s already exists: use --force to replace it", outDir)
+	}
+	parent := filepath.Dir(filepath.Clean(outDir))
+	if err = os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(parent, ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, f := range files {
+		p := filepath.Join(tmp, filepath.FromSlash(f.Name))
+		if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		// group and others never get write access
+		if err = ioutil.WriteFile(p, f.Data, f.Mode&0755|0400); err != nil {
+			return err
+		}
+		if err = os.Chmod(p, f.Mode&0755|0400); err != nil {
+			return err
+		}
+	}
+	if err = os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+
+	if err = os.RemoveAll(outDir); err != nil {
+		return err
+	}
+	return os.Rename(tmp, outDir)
+}
+
+// validateArchive unpacks a folder upload, and validates each of its files as an upload to the folder
+func (s *ServerGRPC) validateArchive(f UploadedFile) ([]ArchiveFile, error) {
+	prefix, err := cleanArchivePath(filepath.ToSlash(f.Filename))
+	if err != nil {
+		return nil, rejectedError(f.Filename, []Violation{{"archive", err.Error()}})
+	}
+	files, err := readTar(bytes.NewReader(f.Data), s.maxFileSize)
+	if err != nil {
+		return nil, rejectedError(f.Filename, []Violation{{"archive", err.Error()}})
+	}
+	if len(files) == 0 {
+		return nil, rejectedError(f.Filename, []Violation{{"archive", "archive holds no file"}})
+	}
+	for _, file := range files {
+		if err = s.validateFile(UploadedFile{
+			Filename: path.Join(prefix, file.Name), FileType: f.FileType, Data: file.Data,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// downloadPrefix streams the files stored under prefix as a tar archive
+func (s *ServerGRPC) downloadPrefix(prefix string, token string, stream GuploadService_DownloadServer) (err error) {
+	var (
+		fileType      = "public"
+		totalStreamed int64
+		hash          = sha256.New()
+	)
+	defer func() {
+		s.audit(stream.Context(), AuditRecord{
+			Operation: auditOpDownload,
+			Filename:  strings.TrimSuffix(prefix, "/") + "/",
+			FileType:  fileType,
+			Size:      totalStreamed,
+			Checksum:  hex.EncodeToString(hash.Sum(nil)),
+		}, err)
+	}()
+
+	if token != "" {
+		return logError(status.Errorf(codes.InvalidArgument, "share tokens are valid for a single file"))
+	}
+	if err = s.authorize(stream.Context(), authOpDownload); err != nil {
+		return
+	}
+	files, err := s.fileStore.List(prefix, fileType)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) && errors.Cause(err) != ErrInvalidFileId {
+		return logError(status.Errorf(codes.Internal, "cannot list files: %v", err))
+	}
+	if len(files) == 0 {
+		return logError(status.Errorf(codes.NotFound, "no file found under %s", prefix))
+	}
+
+	var streamLimiter *rate.Limiter
+	if s.limiter.cfg.DownloadStreamBytesPerSecond > 0 {
+		rateLimit := s.limiter.cfg.DownloadStreamBytesPerSecond
+		streamLimiter = rate.NewLimiter(rate.Limit(rateLimit), int(rateLimit))
+	}
+
+	// the archive is written as it is sent, file by file
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.writePrefixTar(pw, prefix, fileType, files))
+	}()
+	defer pr.Close()
+
+	shard := make([]byte, 1024)
+	for {
+		n, readErr := pr.Read(shard)
+		if n > 0 {
+			if streamLimiter != nil {
+				if err = waitBytes(stream.Context(), streamLimiter, n); err != nil {
+					return
+				}
+			}
+			if err = stream.Send(&FileResponse{Shard: shard[:n]}); err != nil {
+				return
+			}
+			hash.Write(shard[:n])
+			totalStreamed += int64(n)
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return logError(status.Errorf(codes.Aborted, "cannot read files: %v", readErr))
+		}
+	}
+	log.Printf("download complete: %s/ (%d files)", prefix, len(files))
+	s.webhook(stream.Context(), webhookDownloaded, fileType, strings.TrimSuffix(prefix, "/")+"/", totalStreamed,
+		hex.EncodeToString(hash.Sum(nil)))
+	return nil
+}
+
+// writePrefixTar writes the stored files as a tar, named relative to prefix
+func (s *ServerGRPC) writePrefixTar(w io.Writer, prefix string, fileType string, files []StoredFile) error {
+	tw := tar.NewWriter(w)
+	base := strings.TrimSuffix(path.Clean(filepath.ToSlash(prefix)), "/") + "/"
+	for _, stored := range files {
+		f, size, err := s.fileStore.Open(stored.FileId, fileType)
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     strings.TrimPrefix(stored.FileId, base),
+			Mode:     int64(stored.Mode.Perm()),
+			Size:     size,
+			ModTime:  stored.ModTime,
+		})
+		if err == nil {
+			_, err = io.Copy(tw, f)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// UploadArchive uploads files as the folder prefix, replacing the files stored under it
+func (c *ClientGRPC) UploadArchive(ctx context.Context, files []ArchiveFile, prefix string) (stats Stats, err error) {
+	if len(c.recipients) > 0 || c.signerCert != nil {
+		err = errors.New("folders cannot be encrypted or signed: upload their files one by one")
+		return
+	}
+	if prefix, err = cleanArchivePath(prefix); err != nil {
+		return
+	}
+	fileType := "private"
+	if c.usePublicFolder {
+		fileType = "public"
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeTar(pw, files))
+	}()
+	defer pr.Close()
+	return c.send(ctx, prefix, &UploadFileInfo{Filename: prefix, FileType: fileType, Archive: true}, pr)
+}
+
+// DownloadPrefix downloads the files stored under prefix, and writes them as the folder outDir
+func (c *ClientGRPC) DownloadPrefix(prefix string, outDir string, force bool) (err error) {
+	if _, err = os.Stat(outDir); err == nil && !force {
+		return errors.Errorf("%s already exists: use --force to replace it", outDir)
+	}
+	var files []ArchiveFile
+	err = c.retry(context.Background(), "download of "+prefix+"/", func(ctx context.Context) (err error) {
+		files, err = c.downloadPrefixOnce(ctx, prefix)
+		return
+	})
+	if err != nil {
+		return
+	}
+	return writeTree(files, outDir, force)
+}
+
+func (c *ClientGRPC) downloadPrefixOnce(ctx context.Context, prefix string) (files []ArchiveFile, err error) {
+	stream, err := c.client.Download(ctx, &FileRequest{Prefix: prefix})
+	if err != nil {
+		return
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		var downloaded int64
+		for {
+			res, err := stream.Recv()
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				pw.CloseWithError(err)
+				return
+			}
+			shard := res.GetShard()
+			if c.rateLimiter != nil {
+				if err = waitBytes(stream.Context(), c.rateLimiter, len(shard)); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+			}
+			if _, err = pw.Write(shard); err != nil {
+				return
+			}
+			downloaded += int64(len(shard))
+			fmt.Printf("\r%s", strings.Repeat(" ", 25))
+			fmt.Printf("\r%s downloaded", humanize.Bytes(uint64(downloaded)))
+		}
+	}()
+	defer pr.Close()
+
+	files, err = readTar(pr, math.MaxInt64)
+	if _, ok := status.FromError(errors.Cause(err)); ok && err != nil {
+		return nil, errors.Cause(err)
+	}
+	return
+}
@@ -0,0 +1,95 @@
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tarOf writes headers as a tar archive, each followed by its content
+func tarOf(t *testing.T, entries ...*tar.Header) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, hdr := range entries {
+		content := strings.Repeat("x", int(hdr.Size))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func regular(name string, size int64) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: size}
+}
+
+func TestReadTarRoundTrip(t *testing.T) {
+	files := []ArchiveFile{
+		{Name: "cacerts/ca.pem", Mode: 0644, Data: []byte("ca")},
+		{Name: "config.yaml", Mode: 0600, Data: []byte("NodeOUs:\n  Enable: true\n")},
+		{Name: "bin/run.sh", Mode: 0755, Data: []byte("#!/bin/sh\n")},
+	}
+	buf := &bytes.Buffer{}
+	if err := writeTar(buf, files); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readTar(buf, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, files) {
+		t.Errorf("readTar = %+v, want %+v", got, files)
+	}
+}
+
+func TestReadTarCleansNames(t *testing.T) {
+	buf := tarOf(t,
+		&tar.Header{Name: "certs/", Typeflag: tar.TypeDir, Mode: 0755},
+		regular("./certs//a.pem", 1),
+		regular("certs/sub/../b.pem", 1),
+	)
+	got, err := readTar(buf, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range got {
+		names = append(names, f.Name)
+	}
+	if want := []string{"certs/a.pem", "certs/b.pem"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("names = %v, want %v", names, want)
+	}
+}
+
+func TestReadTarRefuses(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []*tar.Header
+		want    string
+	}{
+		{"parent traversal", []*tar.Header{regular("../etc/passwd", 1)}, "invalid"},
+		{"nested traversal", []*tar.Header{regular("certs/../../x", 1)}, "invalid"},
+		{"absolute path", []*tar.Header{regular("/etc/passwd", 1)}, "invalid"},
+		{"backslash", []*tar.Header{regular(`certs\..\..\x`, 1)}, "invalid"},
+		{"symlink", []*tar.Header{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}},
+			"not a regular file"},
+		{"hard link", []*tar.Header{{Name: "link", Typeflag: tar.TypeLink, Linkname: "a"}}, "not a regular file"},
+		{"device", []*tar.Header{{Name: "null", Typeflag: tar.TypeChar}}, "not a regular file"},
+		{"duplicate", []*tar.Header{regular("a.pem", 1), regular("./a.pem", 1)}, "duplicate a.pem"},
+		{"oversize", []*tar.Header{regular("a", 600), regular("b", 600)}, "exceeds 1024 bytes"},
+	}
+	for _, tt := range tests {
+		files, err := readTar(tarOf(t, tt.entries...), 1024)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: readTar = %d files, %v; want an error containing %q", tt.name, len(files), err, tt.want)
+		}
+	}
+}
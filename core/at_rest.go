@@ -0,0 +1,398 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Files encrypted at rest start with a fixed size header:
+//
+//	magic (8) | master key id (8) | wrap nonce (12) | data key wrapped by the master key (32+16) | nonce prefix (7)
+//
+// followed by AES-GCM chunks of atRestChunkSize plaintext bytes, each sealed by the data key with the nonce
+// prefix | chunk counter (4, big endian) | last chunk flag (1). The flag makes truncated files fail to decrypt.
+const (
+	atRestMagic       = "GUPLENC\x01"
+	atRestKeyIDSize   = 8
+	atRestPrefixSize  = 7
+	atRestWrappedSize = 32 + 16
+	atRestHeaderSize  = len(atRestMagic) + atRestKeyIDSize + 12 + atRestWrappedSize + atRestPrefixSize
+	atRestChunkSize   = 64 << 10
+	atRestSealedChunk = atRestChunkSize + 16
+
+	// masterKeyEnv holds the master key itself, as an alternative to --master-key-file
+	masterKeyEnv = "GUPLOAD_MASTER_KEY"
+)
+
+// MasterKey wraps the per-file data keys of the store; it never encrypts content itself
+type MasterKey struct {
+	aead cipher.AEAD
+	// ID is the hex of the first 8 bytes of the sha256 of the key, recorded in the header of every file it wraps
+	ID string
+}
+
+// loadMasterKey reads a 32 bytes key, raw or base64, from file or else from value; no key disables encryption at rest
+func loadMasterKey(file string, value string) (*MasterKey, error) {
+	if file != "" && value != "" {
+		return nil, errors.Errorf("set either master-key-file or %s", masterKeyEnv)
+	}
+	b := []byte(value)
+	if file != "" {
+		var err error
+		if b, err = ioutil.ReadFile(file); err != nil {
+			return nil, errors.Wrapf(err, "failed to read master key %s", file)
+		}
+	}
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	key := b
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b))); err == nil {
+		key = decoded
+	}
+	if len(key) != 32 {
+		return nil, errors.New("master key must be 32 bytes, raw or base64, e.g. head -c 32 /dev/urandom | base64")
+	}
+	return newMasterKey(key)
+}
+
+func newMasterKey(key []byte) (*MasterKey, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &MasterKey{aead: aead, ID: hex.EncodeToString(sum[:atRestKeyIDSize])}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// header wraps dataKey, and returns the file header
+func (k *MasterKey) header(dataKey []byte, prefix []byte) ([]byte, error) {
+	id, _ := hex.DecodeString(k.ID)
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(atRestMagic), id...)
+	header = append(header, nonce...)
+	header = k.aead.Seal(header, nonce, dataKey, []byte(atRestMagic))
+	return append(header, prefix...), nil
+}
+
+// unwrap returns the data key and the nonce prefix of a file header
+func (k *MasterKey) unwrap(header []byte) (dataKey []byte, prefix []byte, err error) {
+	if id := headerKeyID(header); id != k.ID {
+		return nil, nil, errors.Errorf("file is wrapped by master key %s, not %s", id, k.ID)
+	}
+	offset := len(atRestMagic) + atRestKeyIDSize
+	nonce := header[offset : offset+12]
+	wrapped := header[offset+12 : offset+12+atRestWrappedSize]
+	if dataKey, err = k.aead.Open(nil, nonce, wrapped, []byte(atRestMagic)); err != nil {
+		return nil, nil, errors.New("failed to unwrap the data key: corrupted header")
+	}
+	return dataKey, header[atRestHeaderSize-atRestPrefixSize:], nil
+}
+
+func headerKeyID(header []byte) string {
+	return hex.EncodeToString(header[len(atRestMagic) : len(atRestMagic)+atRestKeyIDSize])
+}
+
+// readHeader returns the header of an encrypted file, or nil for a plaintext file; r is left after the header
+func readHeader(r io.ReadSeeker) ([]byte, error) {
+	header := make([]byte, atRestHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if n < atRestHeaderSize || !bytes.HasPrefix(header, []byte(atRestMagic)) {
+		_, err = r.Seek(0, io.SeekStart)
+		return nil, err
+	}
+	return header, nil
+}
+
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[atRestPrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encrypt writes r to w, encrypted with a new data key
+func (k *MasterKey) encrypt(w io.Writer, r io.Reader) error {
+	dataKey := make([]byte, 32)
+	prefix := make([]byte, atRestPrefixSize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	header, err := k.header(dataKey, prefix)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(header); err != nil {
+		return err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(r)
+	buf := make([]byte, atRestChunkSize)
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := err != nil
+		if !last {
+			if _, err = br.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if _, err = w.Write(aead.Seal(nil, chunkNonce(prefix, counter, last), buf[:n], nil)); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// atRestPlainSize is the plaintext size of an encrypted file of size bytes
+func atRestPlainSize(size int64) int64 {
+	body := size - int64(atRestHeaderSize)
+	chunks := (body + atRestSealedChunk - 1) / atRestSealedChunk
+	if chunks == 0 {
+		chunks = 1
+	}
+	return body - chunks*16
+}
+
+// atRestReader decrypts the chunks following the header of an encrypted file
+type atRestReader struct {
+	f       io.ReadCloser
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	sealed  []byte
+	plain   []byte
+	done    bool
+}
+
+// decrypter returns the plaintext of f, positioned after header, and its size
+func (k *MasterKey) decrypter(f io.ReadCloser, header []byte, size int64) (io.ReadCloser, int64, error) {
+	dataKey, prefix, err := k.unwrap(header)
+	if err != nil {
+		return nil, 0, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &atRestReader{
+		f:      f,
+		aead:   aead,
+		prefix: prefix,
+		sealed: make([]byte, atRestSealedChunk),
+	}, atRestPlainSize(size), nil
+}
+
+func (r *atRestReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *atRestReader) next() (err error) {
+	n, err := io.ReadFull(r.f, r.sealed)
+	if err == io.EOF {
+		return errors.New("encrypted file is truncated")
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	// a full chunk is the last one, when the file ends there
+	short := err == io.ErrUnexpectedEOF
+	if !short {
+		r.plain, err = r.aead.Open(r.plain[:0], chunkNonce(r.prefix, r.counter, false), r.sealed[:n], nil)
+	}
+	if short || err != nil {
+		r.plain, err = r.aead.Open(r.plain[:0], chunkNonce(r.prefix, r.counter, true), r.sealed[:n], nil)
+		r.done = true
+	}
+	if err != nil {
+		return errors.Errorf("failed to decrypt chunk %d: wrong key or corrupted file", r.counter)
+	}
+	r.counter++
+	return nil
+}
+
+func (r *atRestReader) Close() error {
+	return r.f.Close()
+}
+
+// openAtRest opens a file of the store, decrypting it when it is encrypted
+func openAtRest(path string, key *MasterKey) (io.ReadCloser, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	header, err := readHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	// plaintext files are still served, until gupload admin rekey encrypts them
+	if header == nil {
+		return f, fi.Size(), nil
+	}
+	if key == nil {
+		f.Close()
+		return nil, 0, errors.Errorf("%s is encrypted at rest: master key required", filepath.Base(path))
+	}
+	r, size, err := key.decrypter(f, header, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return r, size, nil
+}
+
+// writeAtRest writes data to path, encrypted when key is set
+func writeAtRest(path string, data []byte, perm os.FileMode, key *MasterKey) error {
+	if key == nil {
+		return ioutil.WriteFile(path, data, perm)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	err = key.encrypt(f, bytes.NewReader(data))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readAtRest reads a file written by writeAtRest
+func readAtRest(path string, key *MasterKey) ([]byte, error) {
+	r, _, err := openAtRest(path, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+const (
+	rekeySkipped   = "skipped"
+	rekeyEncrypted = "encrypted"
+	rekeyRewrapped = "rewrapped"
+)
+
+// rekeyFile wraps the data key of path with newKey, when oldKey wrapped it; plaintext files are encrypted.
+// Only the header changes for encrypted files. The result is written aside and renamed, as DiskStore.Save.
+func rekeyFile(path string, oldKey *MasterKey, newKey *MasterKey) (result string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	header, err := readHeader(f)
+	if err != nil {
+		return
+	}
+
+	var newHeader []byte
+	switch {
+	case header == nil:
+		result = rekeyEncrypted
+	case headerKeyID(header) == newKey.ID:
+		return rekeySkipped, nil
+	case oldKey != nil && headerKeyID(header) == oldKey.ID:
+		dataKey, prefix, err := oldKey.unwrap(header)
+		if err != nil {
+			return "", err
+		}
+		if newHeader, err = newKey.header(dataKey, prefix); err != nil {
+			return "", err
+		}
+		result = rekeyRewrapped
+	default:
+		return "", errors.Errorf("wrapped by unknown master key %s: set old-master-key-file", headerKeyID(header))
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return
+	}
+	if newHeader == nil {
+		err = newKey.encrypt(tmp, f)
+	} else if _, err = tmp.Write(newHeader); err == nil {
+		_, err = io.Copy(tmp, f)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), fi.Mode().Perm())
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+	return
+}
@@ -0,0 +1,197 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testMasterKey(t *testing.T, b byte) *MasterKey {
+	key, err := newMasterKey(bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testContent is n bytes, differing from chunk to chunk
+func testContent(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i / 7)
+	}
+	return data
+}
+
+func TestAtRestRoundTrip(t *testing.T) {
+	key := testMasterKey(t, 1)
+	dir := t.TempDir()
+	for _, n := range []int{0, 1, atRestChunkSize - 1, atRestChunkSize, atRestChunkSize + 1, 3 * atRestChunkSize} {
+		data := testContent(n)
+		path := filepath.Join(dir, "file")
+		if err := writeAtRest(path, data, 0600, key); err != nil {
+			t.Fatal(err)
+		}
+
+		r, size, err := openAtRest(path, key)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(got, data) || size != int64(n) {
+			t.Errorf("%d bytes: read %d bytes of size %d, %v", n, len(got), size, err)
+		}
+
+		stored, _ := ioutil.ReadFile(path)
+		if !bytes.HasPrefix(stored, []byte(atRestMagic)) || (n > 16 && bytes.Contains(stored, data[:16])) {
+			t.Errorf("%d bytes: stored in plaintext", n)
+		}
+	}
+}
+
+func TestAtRestReadsPlaintextFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := writeAtRest(path, []byte("saved before the key"), 0600, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []*MasterKey{nil, testMasterKey(t, 1)} {
+		if got, err := readAtRest(path, key); err != nil || string(got) != "saved before the key" {
+			t.Errorf("readAtRest = %q, %v", got, err)
+		}
+	}
+}
+
+func TestAtRestRefusesTruncatedOrCorruptedFiles(t *testing.T) {
+	key := testMasterKey(t, 1)
+	dir := t.TempDir()
+	header := atRestHeaderSize
+	tests := []struct {
+		name   string
+		size   int
+		mangle func(b []byte) []byte
+		want   string
+	}{
+		{"header only", 100, func(b []byte) []byte { return b[:header] }, "truncated"},
+		{"last chunk dropped", 2*atRestChunkSize + 100,
+			func(b []byte) []byte { return b[:header+2*atRestSealedChunk] }, "truncated"},
+		{"last full chunk dropped", 2 * atRestChunkSize,
+			func(b []byte) []byte { return b[:header+atRestSealedChunk] }, "truncated"},
+		{"last chunk cut", 2*atRestChunkSize + 100, func(b []byte) []byte { return b[:len(b)-10] }, "chunk 2"},
+		{"flipped byte", 2 * atRestChunkSize, func(b []byte) []byte {
+			b[header+atRestSealedChunk+5] ^= 1
+			return b
+		}, "chunk 1"},
+		{"corrupted header", 100, func(b []byte) []byte {
+			b[len(atRestMagic)+atRestKeyIDSize+12] ^= 1
+			return b
+		}, "corrupted header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "file")
+			if err := writeAtRest(path, testContent(tt.size), 0600, key); err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = ioutil.WriteFile(path, tt.mangle(b), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readAtRest(path, key)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("readAtRest = %d bytes, %v; want an error containing %q", len(got), err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAtRestRefusesOtherKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := writeAtRest(path, []byte("secret"), 0600, testMasterKey(t, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAtRest(path, testMasterKey(t, 2)); err == nil || !strings.Contains(err.Error(), "wrapped by") {
+		t.Errorf("readAtRest with another key = %v", err)
+	}
+	if _, err := readAtRest(path, nil); err == nil || !strings.Contains(err.Error(), "master key required") {
+		t.Errorf("readAtRest without key = %v", err)
+	}
+}
+
+func TestRekeyFile(t *testing.T) {
+	oldKey, newKey := testMasterKey(t, 1), testMasterKey(t, 2)
+	path := filepath.Join(t.TempDir(), "file")
+	data := testContent(atRestChunkSize + 10)
+	if err := writeAtRest(path, data, 0640, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		oldKey, newKey *MasterKey
+		want           string
+	}{
+		{nil, oldKey, rekeyEncrypted},
+		{oldKey, newKey, rekeyRewrapped},
+		{oldKey, newKey, rekeySkipped},
+	}
+	for _, step := range steps {
+		if result, err := rekeyFile(path, step.oldKey, step.newKey); err != nil || result != step.want {
+			t.Fatalf("rekeyFile = %s, %v; want %s", result, err, step.want)
+		}
+		if got, err := readAtRest(path, step.newKey); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("after %s: read %d bytes, %v", step.want, len(got), err)
+		}
+	}
+	if _, err := readAtRest(path, oldKey); err == nil {
+		t.Error("the old key still reads a rewrapped file")
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("mode after rekey = %v, %v; want 0640", fi.Mode().Perm(), err)
+	}
+
+	if _, err := rekeyFile(path, nil, testMasterKey(t, 3)); err == nil {
+		t.Error("rekeyFile without the old key: want an error")
+	}
+}
+
+func TestLoadMasterKey(t *testing.T) {
+	dir := t.TempDir()
+	raw := bytes.Repeat([]byte{1}, 32)
+	files := map[string][]byte{
+		"raw":    raw,
+		"base64": []byte(base64.StdEncoding.EncodeToString(raw) + "\n"),
+		"short":  raw[:16],
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := testMasterKey(t, 1).ID
+
+	for _, name := range []string{"raw", "base64"} {
+		if key, err := loadMasterKey(filepath.Join(dir, name), ""); err != nil || key.ID != want {
+			t.Errorf("loadMasterKey(%s) = %v, %v", name, key, err)
+		}
+	}
+	if key, err := loadMasterKey("", base64.StdEncoding.EncodeToString(raw)); err != nil || key.ID != want {
+		t.Errorf("loadMasterKey from the value = %v, %v", key, err)
+	}
+	if key, err := loadMasterKey("", ""); err != nil || key != nil {
+		t.Errorf("loadMasterKey without key = %v, %v; want none", key, err)
+	}
+	if _, err := loadMasterKey(filepath.Join(dir, "short"), ""); err == nil {
+		t.Error("loadMasterKey of a 16 bytes key: want an error")
+	}
+	if _, err := loadMasterKey(filepath.Join(dir, "raw"), "value"); err == nil {
+		t.Error("loadMasterKey of a file and a value: want an error")
+	}
+}
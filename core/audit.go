@@ -0,0 +1,307 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	auditOutcomeOk = "ok"
+
+	auditOpUpload   = "upload"
+	auditOpDownload = "download"
+	auditOpShare    = "share"
+	auditOpRevoke   = "revoke-share"
+	auditOpApprove  = "approve"
+	auditOpReject   = "reject"
+	auditOpDelete   = "delete"
+)
+
+// AuditRecord is one line of the append-only audit log. Every record carries the hash of
+// its predecessor, so that removing or editing a line breaks the chain.
+type AuditRecord struct {
+	Seq       uint64 `json:"seq"`
+	Time      string `json:"time"`
+	Peer      string `json:"peer"`
+	Identity  string `json:"identity"`
+	Operation string `json:"operation"`
+	Filename  string `json:"filename"`
+	FileType  string `json:"fileType"`
+	Size      int64  `json:"size"`
+	Checksum  string `json:"checksum"`
+	Outcome   string `json:"outcome"`
+	PrevHash  string `json:"prevHash"`
+	Hash      string `json:"hash"`
+}
+
+// computeHash returns the hex sha256 of the record, with the Hash field left empty
+func (r AuditRecord) computeHash() (string, error) {
+	r.Hash = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (r AuditRecord) toEvent() *AuditEvent {
+	return &AuditEvent{
+		Seq:       r.Seq,
+		Time:      r.Time,
+		Peer:      r.Peer,
+		Identity:  r.Identity,
+		Operation: r.Operation,
+		Filename:  r.Filename,
+		FileType:  r.FileType,
+		Size:      r.Size,
+		Checksum:  r.Checksum,
+		Outcome:   r.Outcome,
+		PrevHash:  r.PrevHash,
+		Hash:      r.Hash,
+	}
+}
+
+type AuditLog struct {
+	mu          sync.Mutex
+	path        string
+	file        *os.File
+	seq         uint64
+	lastHash    string
+	subscribers map[chan AuditRecord]struct{}
+}
+
+// NewAuditLog opens (or creates) the audit log at path, and resumes the hash chain from its last record
+func NewAuditLog(path string) (*AuditLog, error) {
+	a := &AuditLog{
+		path:        path,
+		subscribers: make(map[chan AuditRecord]struct{}),
+	}
+
+	if err := truncatePartialLine(path, auditCorruptPath(path)); err != nil {
+		return nil, errors.Wrapf(err, "failed to repair audit log %s", path)
+	}
+	err := readAuditLog(path, 0, func(rec AuditRecord) error {
+		a.seq = rec.Seq
+		a.lastHash = rec.Hash
+		return nil
+	})
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Wrapf(err, "failed to read audit log %s", path)
+	}
+
+	a.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open audit log %s", path)
+	}
+	return a, nil
+}
+
+// Append chains rec to the log, writes it durably and notifies the tail subscribers
+func (a *AuditLog) Append(rec AuditRecord) (AuditRecord, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rec.Seq = a.seq + 1
+	rec.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	rec.PrevHash = a.lastHash
+
+	hash, err := rec.computeHash()
+	if err != nil {
+		return rec, errors.Wrapf(err, "failed to hash audit record")
+	}
+	rec.Hash = hash
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return rec, errors.Wrapf(err, "failed to encode audit record")
+	}
+	if _, err = a.file.Write(append(line, '\n')); err != nil {
+		return rec, errors.Wrapf(err, "failed to write audit record")
+	}
+	if err = a.file.Sync(); err != nil {
+		return rec, errors.Wrapf(err, "failed to sync audit log")
+	}
+
+	a.seq = rec.Seq
+	a.lastHash = rec.Hash
+
+	for ch := range a.subscribers {
+		select {
+		case ch <- rec:
+		default:
+			// slow subscriber; it reads the records it missed from the log, on the gap in seq
+		}
+	}
+	return rec, nil
+}
+
+// Subscribe returns a channel receiving every record appended from now on, and the last seq already written
+func (a *AuditLog) Subscribe() (ch chan AuditRecord, lastSeq uint64, cancel func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ch = make(chan AuditRecord, 64)
+	a.subscribers[ch] = struct{}{}
+	cancel = func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		delete(a.subscribers, ch)
+	}
+	return ch, a.seq, cancel
+}
+
+func (a *AuditLog) Path() string {
+	return a.path
+}
+
+func (a *AuditLog) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file != nil {
+		_ = a.file.Close()
+	}
+}
+
+// auditCorruptPath is the file keeping the incomplete records cut from the audit log at path
+func auditCorruptPath(path string) string {
+	return path + ".corrupt"
+}
+
+// truncatePartialLine drops the last line of a log, when a crash left it incomplete, so that the log can be read and
+// appended to again. The bytes dropped are appended to corruptPath, unless empty.
+func truncatePartialLine(path string, corruptPath string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := fi.Size()
+	end := size
+	buf := make([]byte, 4096)
+	for end > 0 {
+		n := int64(len(buf))
+		if n > end {
+			n = end
+		}
+		if _, err = f.ReadAt(buf[:n], end-n); err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = end - n + int64(i) + 1
+			break
+		}
+		end -= n
+	}
+	if end == size {
+		return nil
+	}
+	log.Printf("%s: dropping an incomplete last line of %d bytes", path, size-end)
+	if corruptPath != "" {
+		if err = keepPartialLine(f, end, size-end, corruptPath); err != nil {
+			return errors.Wrapf(err, "failed to keep the incomplete line in %s", corruptPath)
+		}
+	}
+	return f.Truncate(end)
+}
+
+// keepPartialLine appends the n bytes of f at offset to corruptPath, on a line of their own
+func keepPartialLine(f *os.File, offset int64, n int64, corruptPath string) error {
+	corrupt, err := os.OpenFile(corruptPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(corrupt, io.NewSectionReader(f, offset, n))
+	if err == nil {
+		_, err = corrupt.Write([]byte{'\n'})
+	}
+	if err == nil {
+		err = corrupt.Sync()
+	}
+	if closeErr := corrupt.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readAuditLog calls fn for each record with seq >= fromSeq, in order. It stops at a last line without a newline: a
+// record being appended.
+func readAuditLog(path string, fromSeq uint64, fn func(rec AuditRecord) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		b, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to read line %d", line)
+		}
+
+		var rec AuditRecord
+		if err := json.Unmarshal(b, &rec); err != nil {
+			return errors.Wrapf(err, "malformed audit record at line %d", line)
+		}
+		if rec.Seq < fromSeq {
+			continue
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// VerifyAuditLog walks the whole chain, and returns the number of valid records. A last line being appended is not
+// counted, nor verified.
+func VerifyAuditLog(path string) (count int, err error) {
+	var (
+		prevSeq  uint64
+		prevHash string
+	)
+
+	err = readAuditLog(path, 0, func(rec AuditRecord) error {
+		if rec.Seq != prevSeq+1 {
+			return errors.Errorf("record seq %d: expected seq %d", rec.Seq, prevSeq+1)
+		}
+		if rec.PrevHash != prevHash {
+			return errors.Errorf("record seq %d: broken chain, prevHash does not match previous record", rec.Seq)
+		}
+		hash, err := rec.computeHash()
+		if err != nil {
+			return err
+		}
+		if hash != rec.Hash {
+			return errors.Errorf("record seq %d: content does not match its hash", rec.Seq)
+		}
+
+		prevSeq = rec.Seq
+		prevHash = rec.Hash
+		count++
+		return nil
+	})
+	return
+}
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/net/context"
+	"os"
+)
+
+var AuditCommand = cli.Command{
+	Name:  "audit",
+	Usage: "verify or tail the audit log of file operations",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "verify",
+			Usage:  "check the hash chain of a local audit log",
+			Action: auditVerifyAction,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "file",
+					Usage: "path to the audit log",
+				},
+			},
+		},
+		{
+			Name:   "tail",
+			Usage:  "stream audit records from the server",
+			Action: auditTailAction,
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{
+					Name:  "address",
+					Value: "localhost:1313",
+					Usage: "address of the server to connect to",
+				},
+				&cli.StringFlag{
+					Name:  "cacert",
+					Usage: "path of a certifcate to add to the root CAs",
+				},
+				&cli.StringFlag{
+					Name:  "servername-override",
+					Usage: "use serverNameOverride for tls ca cert",
+				},
+				&cli.StringFlag{
+					Name:  "cert",
+					Usage: "path to client TLS certificate",
+				},
+				&cli.StringFlag{
+					Name:  "key",
+					Usage: "path to client TLS key",
+				},
+				&cli.Uint64Flag{
+					Name:  "from",
+					Usage: "replay records starting at this seq; 0 streams only new records",
+				},
+				&cli.BoolFlag{
+					Name:  "follow",
+					Usage: "keep streaming newly appended records",
+					Value: true,
+				},
+			}, append(clientSecurityFlags, clientRetryFlags...)...),
+		},
+	},
+}
+
+func auditVerifyAction(c *cli.Context) (err error) {
+	file := c.String("file")
+
+	if file == "" {
+		must(errors.New("file must be set"))
+	}
+
+	count, err := VerifyAuditLog(file)
+	if err != nil {
+		fmt.Printf("❌ audit log is tampered or corrupted after %d valid records\n", count)
+		must(err)
+	}
+
+	fmt.Printf("✅ audit log verified: %d records\n", count)
+	if fi, err := os.Stat(auditCorruptPath(file)); err == nil && fi.Size() > 0 {
+		fmt.Printf("⚠️  %d bytes of incomplete records, cut from the log after a crash, are kept in %s\n", fi.Size(),
+			auditCorruptPath(file))
+	}
+	return
+}
+
+func auditTailAction(c *cli.Context) (err error) {
+	var (
+		address            = c.String("address")
+		rootCertificate    = c.String("cacert")
+		serverNameOverride = c.String("servername-override")
+		certificate        = c.String("cert")
+		key                = c.String("key")
+		client             Client
+	)
+
+	if address == "" {
+		must(errors.New("address"))
+	}
+
+	if rootCertificate == "" {
+		must(errors.New("cacert must be set"))
+	}
+
+	tlsPolicy, err := newClientTLSPolicy(c)
+	must(err)
+	token, err := newClientToken(c)
+	must(err)
+	retry, err := newClientRetry(c)
+	must(err)
+
+	grpcClient, err := NewClientGRPC(ClientGRPCConfig{
+		Address:            address,
+		RootCertificate:    rootCertificate,
+		ServerNameOverride: serverNameOverride,
+		TLSPolicy:          tlsPolicy,
+		Token:              token,
+		Retry:              retry,
+		Timeout:            c.Duration("timeout"),
+		Certificate:        certificate,
+		Key:                key,
+	})
+	must(err)
+	client = &grpcClient
+	defer client.Close()
+
+	encoder := json.NewEncoder(os.Stdout)
+	err = client.AuditTail(context.Background(), c.Uint64("from"), c.Bool("follow"), func(event *AuditEvent) error {
+		return encoder.Encode(event)
+	})
+	must(err)
+	return
+}
@@ -0,0 +1,155 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestAuditLog writes an audit log of n uploads, and returns its lines
+func newTestAuditLog(t *testing.T, n int) (string, [][]byte) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := NewAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err = a.Append(AuditRecord{Operation: auditOpUpload, Filename: "a.txt", Size: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, bytes.SplitAfter(b, []byte("\n"))[:n]
+}
+
+func writeLines(t *testing.T, path string, lines [][]byte) {
+	if err := ioutil.WriteFile(path, bytes.Join(lines, nil), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rewrite applies edit to the record of line, keeping its hash unless rehash
+func rewrite(t *testing.T, line []byte, edit func(rec *AuditRecord), rehash bool) []byte {
+	var rec AuditRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		t.Fatal(err)
+	}
+	edit(&rec)
+	if rehash {
+		rec.Hash, _ = rec.computeHash()
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(b, '\n')
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	path, _ := newTestAuditLog(t, 3)
+	if count, err := VerifyAuditLog(path); err != nil || count != 3 {
+		t.Fatalf("VerifyAuditLog = %d, %v; want 3 records", count, err)
+	}
+
+	// reopened, the log resumes the chain
+	a, err := NewAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := a.Append(AuditRecord{Operation: auditOpDelete, Filename: "a.txt"})
+	a.Close()
+	if err != nil || rec.Seq != 4 {
+		t.Fatalf("Append after reopening = seq %d, %v; want seq 4", rec.Seq, err)
+	}
+	if count, err := VerifyAuditLog(path); err != nil || count != 4 {
+		t.Errorf("VerifyAuditLog = %d, %v; want 4 records", count, err)
+	}
+}
+
+func TestVerifyAuditLogDetectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(lines [][]byte) [][]byte
+		valid  int
+		want   string
+	}{
+		{"edited record", func(lines [][]byte) [][]byte {
+			lines[1] = rewrite(t, lines[1], func(rec *AuditRecord) { rec.Filename = "b.txt" }, false)
+			return lines
+		}, 1, "content does not match its hash"},
+		{"edited and rehashed record", func(lines [][]byte) [][]byte {
+			lines[1] = rewrite(t, lines[1], func(rec *AuditRecord) { rec.Outcome = "denied" }, true)
+			return lines
+		}, 2, "broken chain"},
+		{"removed record", func(lines [][]byte) [][]byte {
+			return append(lines[:1], lines[2:]...)
+		}, 1, "expected seq 2"},
+		{"swapped records", func(lines [][]byte) [][]byte {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, 1, "expected seq 2"},
+		{"malformed record", func(lines [][]byte) [][]byte {
+			lines[1] = []byte("{not json\n")
+			return lines
+		}, 1, "malformed audit record at line 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, lines := newTestAuditLog(t, 3)
+			writeLines(t, path, tt.tamper(lines))
+
+			count, err := VerifyAuditLog(path)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("VerifyAuditLog = %v, want an error containing %q", err, tt.want)
+			}
+			if count != tt.valid {
+				t.Errorf("VerifyAuditLog = %d valid records, want %d", count, tt.valid)
+			}
+		})
+	}
+}
+
+func TestAuditLogIncompleteLastLine(t *testing.T) {
+	path, lines := newTestAuditLog(t, 2)
+	partial := []byte(`{"seq":3,"time":"2020-`)
+	writeLines(t, path, append(lines, partial))
+
+	// a record being appended is not read yet
+	var seqs []uint64
+	err := readAuditLog(path, 0, func(rec AuditRecord) error {
+		seqs = append(seqs, rec.Seq)
+		return nil
+	})
+	if err != nil || len(seqs) != 2 {
+		t.Fatalf("readAuditLog = %v, %v; want seqs 1 and 2", seqs, err)
+	}
+	if count, err := VerifyAuditLog(path); err != nil || count != 2 {
+		t.Fatalf("VerifyAuditLog = %d, %v; want 2 records", count, err)
+	}
+
+	// left by a crash, it is cut at startup and kept aside
+	a, err := NewAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := a.Append(AuditRecord{Operation: auditOpDownload, Filename: "a.txt"})
+	a.Close()
+	if err != nil || rec.Seq != 3 {
+		t.Fatalf("Append = seq %d, %v; want seq 3", rec.Seq, err)
+	}
+	if count, err := VerifyAuditLog(path); err != nil || count != 3 {
+		t.Errorf("VerifyAuditLog = %d, %v; want 3 records", count, err)
+	}
+	corrupt, err := ioutil.ReadFile(auditCorruptPath(path))
+	if err != nil || string(corrupt) != string(partial)+"\n" {
+		t.Errorf("%s = %q, %v; want %q", auditCorruptPath(path), corrupt, err, partial)
+	}
+}
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	authOpUpload   = "upload"
+	authOpDownload = "download"
+	authOpAdmin    = "admin"
+	authOpShare    = "share"
+
+	// anyIdentity in a policy list grants the operation to every caller, including anonymous ones
+	anyIdentity = "*"
+)
+
+// AuthPolicy lists the identities allowed per operation. An empty list leaves uploads and downloads open to every
+// caller, and denies admin and share operations; otherwise the caller must present an identity listed (or the list
+// must contain "*").
+type AuthPolicy struct {
+	Uploaders   []string
+	Downloaders []string
+	Admins      []string
+	Sharers     []string
+}
+
+func (p AuthPolicy) identities(op string) []string {
+	switch op {
+	case authOpUpload:
+		return p.Uploaders
+	case authOpDownload:
+		return p.Downloaders
+	case authOpAdmin:
+		return p.Admins
+	case authOpShare:
+		return p.Sharers
+	}
+	return nil
+}
+
+// Allows reports whether identity may perform op
+func (p AuthPolicy) Allows(op string, identity string) bool {
+	if len(p.identities(op)) == 0 {
+		return op == authOpUpload || op == authOpDownload
+	}
+	return p.listed(op, identity)
+}
+
+// listed reports whether the list of op names identity, or contains "*"; an empty list names no one
+func (p AuthPolicy) listed(op string, identity string) bool {
+	for _, allowed := range p.identities(op) {
+		if allowed == anyIdentity || (identity != "" && allowed == identity) {
+			return true
+		}
+	}
+	return false
+}
+
+// identity authenticates the caller of ctx: a bearer token takes precedence over the client certificate.
+// A caller without either is anonymous, i.e. has an empty name.
+func (s *ServerGRPC) identity(ctx context.Context) (id Identity, err error) {
+	token, ok := bearerToken(ctx)
+	if !ok {
+		_, name := peerInfo(ctx)
+		return Identity{Name: name, Method: authMethodCert, Orgs: certOrgs(peerCertificate(ctx))}, nil
+	}
+
+	if s.tokenAuth == nil {
+		return id, errors.New("bearer tokens are not accepted")
+	}
+	return s.tokenAuth.Authenticate(token)
+}
+
+// authorize returns codes.Unauthenticated for invalid bearer tokens, or codes.PermissionDenied,
+// unless the caller of ctx may perform one of ops
+func (s *ServerGRPC) authorize(ctx context.Context, ops ...string) error {
+	addr, _ := peerInfo(ctx)
+	id, err := s.identity(ctx)
+	if err != nil {
+		return logError(status.Errorf(codes.Unauthenticated, "peer %s: %v", addr, err))
+	}
+
+	scoped := false
+	for _, op := range ops {
+		if id.HasScope(op) {
+			scoped = true
+			if s.authPolicy.Allows(op, id.Name) {
+				return nil
+			}
+		}
+	}
+
+	op := strings.Join(ops, " or ")
+	if !scoped {
+		return logError(status.Errorf(codes.PermissionDenied, "token of '%s' has no %s scope", id.Name, op))
+	}
+	if id.Name == "" {
+		return logError(status.Errorf(codes.PermissionDenied, "%s requires an authenticated identity (peer %s)", op, addr))
+	}
+	return logError(status.Errorf(codes.PermissionDenied, "identity '%s' is not allowed to %s", id.Name, op))
+}
+
+// authorizePrivate restricts the private files to the identities listed as uploaders or admins: unlike uploads, they
+// are not open to every caller when the lists are empty
+func (s *ServerGRPC) authorizePrivate(ctx context.Context) error {
+	addr, _ := peerInfo(ctx)
+	id, err := s.identity(ctx)
+	if err != nil {
+		return logError(status.Errorf(codes.Unauthenticated, "peer %s: %v", addr, err))
+	}
+	for _, op := range []string{authOpUpload, authOpAdmin} {
+		if id.HasScope(op) && s.authPolicy.listed(op, id.Name) {
+			return nil
+		}
+	}
+	return logError(status.Errorf(codes.PermissionDenied,
+		"private files are restricted to the identities listed as uploaders or admins (identity '%s', peer %s)",
+		id.Name, addr))
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthPolicyAllows(t *testing.T) {
+	open := AuthPolicy{}
+	listed := AuthPolicy{
+		Uploaders:   []string{"org1-ops"},
+		Downloaders: []string{anyIdentity},
+		Admins:      []string{"org1-admin"},
+		Sharers:     []string{"org1-ops"},
+	}
+
+	tests := []struct {
+		name     string
+		policy   AuthPolicy
+		op       string
+		identity string
+		want     bool
+	}{
+		{"empty list opens uploads", open, authOpUpload, "", true},
+		{"empty list opens downloads", open, authOpDownload, "", true},
+		{"empty list denies admin", open, authOpAdmin, "org1-admin", false},
+		{"empty list denies share", open, authOpShare, "org1-ops", false},
+		{"listed uploader", listed, authOpUpload, "org1-ops", true},
+		{"unlisted uploader", listed, authOpUpload, "stranger", false},
+		{"anonymous uploader", listed, authOpUpload, "", false},
+		{"any downloader", listed, authOpDownload, "", true},
+		{"listed admin", listed, authOpAdmin, "org1-admin", true},
+		{"uploader is no admin", listed, authOpAdmin, "org1-ops", false},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.Allows(tt.op, tt.identity); got != tt.want {
+			t.Errorf("%s: Allows(%s, %q) = %v, want %v", tt.name, tt.op, tt.identity, got, tt.want)
+		}
+	}
+}
+
+// certContext is the context of a call with a verified client certificate
+func certContext(commonName string, orgs ...string) context.Context {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName, Organization: orgs}}
+	return peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}},
+	})
+}
+
+// tokenContext is the context of a call with a bearer token
+func tokenContext(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+}
+
+func TestAuthorize(t *testing.T) {
+	sum := sha256.Sum256([]byte("ci-token"))
+	tokenFile := filepath.Join(t.TempDir(), "tokens.yaml")
+	err := ioutil.WriteFile(tokenFile, []byte("tokens:\n"+
+		"  - subject: org1-ci\n"+
+		"    sha256: "+hex.EncodeToString(sum[:])+"\n"+
+		"    scopes: [download]\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenAuth, err := newTokenAuthenticator(TokenAuthConfig{TokenFile: tokenFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &ServerGRPC{
+		authPolicy: AuthPolicy{Uploaders: []string{"org1-ops", "org1-ci"}, Admins: []string{"org1-admin"}},
+		tokenAuth:  tokenAuth,
+	}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		ops  []string
+		want codes.Code
+	}{
+		{"anonymous download", context.Background(), []string{authOpDownload}, codes.OK},
+		{"anonymous upload", context.Background(), []string{authOpUpload}, codes.PermissionDenied},
+		{"listed uploader", certContext("org1-ops"), []string{authOpUpload}, codes.OK},
+		{"unlisted uploader", certContext("stranger"), []string{authOpUpload}, codes.PermissionDenied},
+		{"admin", certContext("org1-admin"), []string{authOpAdmin}, codes.OK},
+		{"uploader as admin", certContext("org1-ops"), []string{authOpAdmin}, codes.PermissionDenied},
+		{"any of the ops", certContext("org1-admin"), []string{authOpShare, authOpAdmin}, codes.OK},
+		{"token within its scopes", tokenContext("ci-token"), []string{authOpDownload}, codes.OK},
+		{"token outside its scopes", tokenContext("ci-token"), []string{authOpUpload}, codes.PermissionDenied},
+		{"unknown token", tokenContext("guess"), []string{authOpDownload}, codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		if got := status.Code(s.authorize(tt.ctx, tt.ops...)); got != tt.want {
+			t.Errorf("%s: authorize(%v) = %s, want %s", tt.name, tt.ops, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorizeWithoutTokens(t *testing.T) {
+	s := &ServerGRPC{}
+	if got := status.Code(s.authorize(tokenContext("ci-token"), authOpDownload)); got != codes.Unauthenticated {
+		t.Errorf("authorize with a token, no token auth = %s, want %s", got, codes.Unauthenticated)
+	}
+}
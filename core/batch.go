@@ -0,0 +1,175 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// BatchOptions tune the transfers of UploadFiles and DownloadFiles
+type BatchOptions struct {
+	// Parallel is the number of concurrent streams; each file is retried as the client is configured to
+	Parallel int
+}
+
+// BatchResult is the outcome of one file of a batch
+type BatchResult struct {
+	Name      string
+	Bytes     int64
+	PendingID string
+	// Skipped is set for a download kept from overwriting an existing file
+	Skipped bool
+	Err     error
+}
+
+// BatchSummary aggregates the results of a batch, in the order of its files
+type BatchSummary struct {
+	Results    []BatchResult
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// Failed returns the number of files not transferred
+func (s BatchSummary) Failed() (failed int) {
+	for _, r := range s.Results {
+		if r.Err != nil {
+			failed++
+		}
+	}
+	return
+}
+
+// Print writes the pending and failed files, then the totals and throughput of the batch
+func (s BatchSummary) Print(w io.Writer) {
+	var bytes int64
+	for _, r := range s.Results {
+		switch {
+		case r.Err != nil:
+			fmt.Fprintf(w, "❌ %s: %v\n", r.Name, r.Err)
+		case r.PendingID != "":
+			bytes += r.Bytes
+			fmt.Fprintf(w, "⏳ %s pending approval, id: %s\n", r.Name, r.PendingID)
+		case r.Skipped:
+			fmt.Fprintf(w, "⏭  %s skipped: the file exists\n", r.Name)
+		default:
+			bytes += r.Bytes
+		}
+	}
+
+	duration := s.FinishedAt.Sub(s.StartedAt)
+	throughput := ""
+	if seconds := duration.Seconds(); seconds > 0 {
+		throughput = fmt.Sprintf(", %s/s", humanize.Bytes(uint64(float64(bytes)/seconds)))
+	}
+	fmt.Fprintf(w, "📦 %d files, %d failed, %s in %s%s\n", len(s.Results), s.Failed(), humanize.Bytes(uint64(bytes)),
+		duration.Round(time.Millisecond), throughput)
+}
+
+// runBatch transfers names with opts.Parallel workers. transfer returns the bytes moved, and the pending id of uploads;
+// ErrFileExists skips the file.
+func runBatch(ctx context.Context, names []string, opts BatchOptions,
+	transfer func(name string) (int64, string, error)) (summary BatchSummary) {
+	parallel := opts.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	summary.StartedAt = time.Now()
+	summary.Results = make([]BatchResult, len(names))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				r := &summary.Results[i]
+				r.Name = names[i]
+				if err := ctx.Err(); err != nil {
+					r.Err = err
+					continue
+				}
+				r.Bytes, r.PendingID, r.Err = transfer(names[i])
+				if r.Err == ErrFileExists {
+					r.Skipped, r.Err = true, nil
+				}
+			}
+		}()
+	}
+	for i := range names {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	summary.FinishedAt = time.Now()
+	return
+}
+
+// UploadFiles uploads each file of paths on its own stream, as <folder>/<base name>, or its base name without folder.
+// Nothing is uploaded when two paths share a base name, e.g. peers/*/tls/ca.crt: one would overwrite the other.
+func (c *ClientGRPC) UploadFiles(ctx context.Context, paths []string, folder string, opts BatchOptions) BatchSummary {
+	if summary, ok := checkBatchDestinations(paths, folder); !ok {
+		return summary
+	}
+	return runBatch(ctx, paths, opts, func(p string) (int64, string, error) {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return 0, "", err
+		}
+		stats, err := c.uploadPath(ctx, p, path.Join(folder, filepath.Base(p)))
+		return fi.Size(), stats.PendingID, err
+	})
+}
+
+// checkBatchDestinations fails every file of the batch, unless the destinations of paths are distinct
+func checkBatchDestinations(paths []string, folder string) (summary BatchSummary, ok bool) {
+	summary.StartedAt = time.Now()
+	summary.Results = make([]BatchResult, len(paths))
+	ok = true
+	first := map[string]string{}
+	for i, p := range paths {
+		dest := path.Join(folder, filepath.Base(p))
+		summary.Results[i].Name = p
+		if other, found := first[dest]; found {
+			summary.Results[i].Err = errors.Errorf("%s and %s have the same name, both uploading as %s", other, p, dest)
+			ok = false
+			continue
+		}
+		first[dest] = p
+	}
+	if ok {
+		return
+	}
+	for i := range summary.Results {
+		if summary.Results[i].Err == nil {
+			summary.Results[i].Err = errors.New("not uploaded: the batch has duplicate destinations")
+		}
+	}
+	summary.FinishedAt = summary.StartedAt
+	return
+}
+
+// DownloadFiles downloads each file of fileNames on its own stream, and writes it as DownloadFile does
+func (c *ClientGRPC) DownloadFiles(ctx context.Context, fileNames []string, dl DownloadOptions,
+	opts BatchOptions) BatchSummary {
+	return runBatch(ctx, fileNames, opts, func(fileName string) (int64, string, error) {
+		dest, err := c.DownloadFile(fileName, dl)
+		if err != nil {
+			return 0, "", err
+		}
+		fi, err := os.Stat(dest)
+		if err != nil {
+			return 0, "", err
+		}
+		return fi.Size(), "", nil
+	})
+}
@@ -0,0 +1,181 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// certReloader serves the TLS certificates (and client CA bundle) from files, which may be rotated at runtime,
+// e.g. by cert-manager updating a mounted kubernetes secret. Files are polled, and new pairs are swapped in
+// only after all of them load successfully; a half-written rotation keeps the previous pairs in service.
+// With several pairs, the one presented is chosen by the SNI of the client hello.
+type certReloader struct {
+	pairs        []TLSPair
+	clientCAFile string
+
+	mu        sync.RWMutex
+	certs     []*tls.Certificate
+	notAfter  time.Time
+	clientCAs *x509.CertPool
+	// digest of the files last loaded, to detect changes
+	digest []byte
+}
+
+func newCertReloader(pairs []TLSPair, clientCAFile string) (*certReloader, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("no tls certificate")
+	}
+	r := &certReloader{
+		pairs:        pairs,
+		clientCAFile: clientCAFile,
+	}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// filesDigest hashes the content of the watched files. Content, rather than mtime, is compared because
+// kubernetes swaps secret volumes through symlinks.
+func (r *certReloader) filesDigest() ([]byte, error) {
+	hash := sha256.New()
+	paths := []string{r.clientCAFile}
+	for _, pair := range r.pairs {
+		paths = append(paths, pair.Certificate, pair.Key)
+	}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", path)
+		}
+		hash.Write(b)
+	}
+	return hash.Sum(nil), nil
+}
+
+// reload loads the files when they changed since the last successful load, and reports whether it did
+func (r *certReloader) reload() (changed bool, err error) {
+	digest, err := r.filesDigest()
+	if err != nil {
+		return
+	}
+
+	r.mu.RLock()
+	unchanged := bytes.Equal(digest, r.digest)
+	r.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	var (
+		certs    []*tls.Certificate
+		notAfter time.Time
+	)
+	for _, pair := range r.pairs {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(pair.Certificate, pair.Key)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to load cert %s and key %s", pair.Certificate, pair.Key)
+			return
+		}
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			err = errors.Wrapf(err, "failed to parse cert %s", pair.Certificate)
+			return
+		}
+		certs = append(certs, &cert)
+		if notAfter.IsZero() || cert.Leaf.NotAfter.Before(notAfter) {
+			notAfter = cert.Leaf.NotAfter
+		}
+	}
+
+	var clientCAs *x509.CertPool
+	if r.clientCAFile != "" {
+		var pem []byte
+		pem, err = ioutil.ReadFile(r.clientCAFile)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to read client ca %s", r.clientCAFile)
+			return
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			err = errors.Errorf("no certificate found in client ca %s", r.clientCAFile)
+			return
+		}
+	}
+
+	r.mu.Lock()
+	r.certs = certs
+	r.notAfter = notAfter
+	r.clientCAs = clientCAs
+	r.digest = digest
+	r.mu.Unlock()
+
+	for _, cert := range certs {
+		log.Printf("tls certificate loaded: %s, expires at %s", cert.Leaf.Subject.CommonName, cert.Leaf.NotAfter.UTC())
+	}
+	return true, nil
+}
+
+// watch polls the files every interval, until stop is closed
+func (r *certReloader) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := r.reload(); err != nil {
+				log.Printf("tls certificate reload failed, keep serving the previous one: %v", err)
+			}
+		}
+	}
+}
+
+// GetCertificate returns the first certificate valid for the client hello (server name and signature schemes),
+// or the first certificate, when none matches
+func (r *certReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.certs) > 1 {
+		for _, cert := range r.certs {
+			if hello.SupportsCertificate(cert) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return r.certs[0], nil
+}
+
+// GetConfigForClient returns the base config with the current client CA bundle
+func (r *certReloader) GetConfigForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		config := base.Clone()
+		config.ClientCAs = r.clientCAs
+		return config, nil
+	}
+}
+
+// NotAfter returns the earliest expiry of the served certificates
+func (r *certReloader) NotAfter() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.notAfter
+}
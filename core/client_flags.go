@@ -0,0 +1,184 @@
+package core
+
+import (
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// clientSecurityFlags are shared by the client commands
+var clientSecurityFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "token",
+		Usage:   "bearer token, alternative to a client certificate",
+		EnvVars: []string{"GUPLOAD_TOKEN"},
+	},
+	&cli.StringFlag{
+		Name:  "token-file",
+		Usage: "path to a file holding the bearer token",
+	},
+	&cli.StringFlag{
+		Name:  "tls-min-version",
+		Usage: "minimum TLS version: 1.0, 1.1, 1.2 or 1.3",
+	},
+	&cli.StringSliceFlag{
+		Name:  "tls-cipher-suites",
+		Usage: "allowed TLS 1.2 cipher suites, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	},
+	&cli.StringSliceFlag{
+		Name:  "tls-curves",
+		Usage: "preferred curves: X25519, P256, P384, P521",
+	},
+}
+
+// clientRetryFlags set the retries and deadline of the operations of the client commands
+var clientRetryFlags = []cli.Flag{
+	&cli.IntFlag{
+		Name:  "retries",
+		Value: 2,
+		Usage: "further attempts of an operation failing with a retryable status; 0 disables retries",
+	},
+	&cli.DurationFlag{
+		Name:  "retry-backoff",
+		Value: 500 * time.Millisecond,
+		Usage: "wait before the first retry, doubled at each further retry, with ±20% jitter",
+	},
+	&cli.DurationFlag{
+		Name:  "retry-max-backoff",
+		Value: 10 * time.Second,
+		Usage: "longest wait between two attempts",
+	},
+	&cli.StringSliceFlag{
+		Name:  "retry-codes",
+		Value: cli.NewStringSlice(DefaultRetryCodes...),
+		Usage: "status codes worth a retry, e.g. unavailable,resource-exhausted,aborted,deadline-exceeded",
+	},
+	&cli.DurationFlag{
+		Name:    "timeout",
+		Usage:   "deadline of each operation, including its retries, e.g. 30s; none when 0",
+		EnvVars: []string{"GUPLOAD_TIMEOUT"},
+	},
+}
+
+// clientConnectionFlags connect the client commands that don't transfer files
+var clientConnectionFlags = append([]cli.Flag{
+	&cli.StringFlag{
+		Name:  "address",
+		Value: "localhost:1313",
+		Usage: "address of the server to connect to",
+	},
+	&cli.StringFlag{
+		Name:  "cacert",
+		Usage: "path of a certifcate to add to the root CAs",
+	},
+	&cli.StringFlag{
+		Name:  "servername-override",
+		Usage: "use serverNameOverride for tls ca cert",
+	},
+	&cli.StringFlag{
+		Name:  "cert",
+		Usage: "path to client TLS certificate",
+	},
+	&cli.StringFlag{
+		Name:  "key",
+		Usage: "path to client TLS key",
+	},
+}, append(clientSecurityFlags, clientRetryFlags...)...)
+
+// newClientFromFlags connects the client of clientConnectionFlags
+func newClientFromFlags(c *cli.Context, usePublicFolder bool) Client {
+	var (
+		address            = c.String("address")
+		rootCertificate    = c.String("cacert")
+		serverNameOverride = c.String("servername-override")
+	)
+
+	if address == "" {
+		must(errors.New("address"))
+	}
+
+	if rootCertificate == "" {
+		must(errors.New("cacert must be set"))
+	}
+
+	tlsPolicy, err := newClientTLSPolicy(c)
+	must(err)
+	token, err := newClientToken(c)
+	must(err)
+	retry, err := newClientRetry(c)
+	must(err)
+	// set by the commands bounding their downloads, e.g. download-msp
+	var maxDownloadSize uint64
+	if value := c.String("max-file-size"); value != "" {
+		maxDownloadSize, err = humanize.ParseBytes(value)
+		must(errors.Wrapf(err, "invalid max-file-size %s", value))
+	}
+
+	grpcClient, err := NewClientGRPC(ClientGRPCConfig{
+		Address:            address,
+		RootCertificate:    rootCertificate,
+		ServerNameOverride: serverNameOverride,
+		TLSPolicy:          tlsPolicy,
+		Token:              token,
+		Certificate:        c.String("cert"),
+		Key:                c.String("key"),
+		SignWith:           c.String("sign-with"),
+		SignerCert:         c.String("signer-cert"),
+		UsePublicFolder:    usePublicFolder,
+		Retry:              retry,
+		Timeout:            c.Duration("timeout"),
+		MaxDownloadSize:    int64(maxDownloadSize),
+	})
+	must(err)
+	return &grpcClient
+}
+
+// newClientTLSPolicy reads the tls flags of clientSecurityFlags
+func newClientTLSPolicy(c *cli.Context) (TLSPolicy, error) {
+	return parseTLSPolicy(c.String("tls-min-version"), splitValues(c.StringSlice("tls-cipher-suites")),
+		splitValues(c.StringSlice("tls-curves")), nil)
+}
+
+// newClientRetry reads the retry policy of clientRetryFlags
+func newClientRetry(c *cli.Context) (p RetryPolicy, err error) {
+	if c.Int("retries") < 0 {
+		return p, errors.New("retries cannot be negative")
+	}
+	if c.Duration("retry-backoff") <= 0 || c.Duration("retry-max-backoff") < c.Duration("retry-backoff") {
+		return p, errors.New("retry-backoff must be positive, and at most retry-max-backoff")
+	}
+	retryCodes, err := parseRetryCodes(splitValues(c.StringSlice("retry-codes")))
+	if err != nil {
+		return
+	}
+	return RetryPolicy{
+		MaxAttempts:    c.Int("retries") + 1,
+		InitialBackoff: c.Duration("retry-backoff"),
+		MaxBackoff:     c.Duration("retry-max-backoff"),
+		Multiplier:     2,
+		Jitter:         0.2,
+		Codes:          retryCodes,
+	}, nil
+}
+
+// newClientToken reads the token flags of clientSecurityFlags
+func newClientToken(c *cli.Context) (token string, err error) {
+	token = c.String("token")
+	path := c.String("token-file")
+	if path == "" {
+		return
+	}
+	if token != "" {
+		return "", errors.New("use either token or token-file")
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read token file %s", path)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
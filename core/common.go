@@ -3,6 +3,7 @@ package core
 import (
 	"fmt"
 	"os"
+	"strings"
 )
 
 func must(err error) {
@@ -13,3 +14,15 @@ func must(err error) {
 	fmt.Printf("ERROR: %+v\n", err)
 	os.Exit(1)
 }
+
+// splitValues flattens comma separated values of a slice flag, e.g. --scopes upload,download
+func splitValues(values []string) (result []string) {
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				result = append(result, v)
+			}
+		}
+	}
+	return
+}
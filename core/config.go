@@ -0,0 +1,326 @@
+package core
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+)
+
+const (
+	logLevelInfo  = "info"
+	logLevelDebug = "debug"
+)
+
+// ServeConfig is the validated configuration of the serve command. Values come from command line flags,
+// GUPLOAD_* environment variables and the --config file, in this order of precedence.
+type ServeConfig struct {
+	// Address is the listen address, e.g. ":1313" or "0.0.0.0:1313"
+	Address     string
+	Root        string
+	MaxFileSize int64
+	Certificate string
+	Key         string
+	TLSPairs    []TLSPair
+	TLSPolicy   TLSPolicy
+	ClientCA    string
+	ClientAuth  tls.ClientAuthType
+	// CertReloadInterval is how often rotated cert, key and client ca files are picked up
+	CertReloadInterval time.Duration
+	CertExpiryWarning  time.Duration
+	AuditLog           string
+	Auth               AuthPolicy
+	TokenAuth          TokenAuthConfig
+	ShareKey           string
+	ShareDenylist      string
+	MaxShareTTL        time.Duration
+	Limits             LimitConfig
+	Validation         ValidationConfig
+	Scan               ScanConfig
+	Webhooks           WebhookConfig
+	Replication        ReplicationConfig
+	// PendingDir holds public uploads until approved; empty publishes them directly
+	PendingDir string
+	// MasterKey enables encryption at rest of the stored, pending and quarantined files
+	MasterKey *MasterKey
+	// SignatureTrustStore are PEM files, or folders of them, trusted to issue signer certificates
+	SignatureTrustStore []string
+	RequireSignature    bool
+	// MSPIdentities are the identities allowed to replace the msp bundle of an org, by org, besides its members
+	MSPIdentities map[string][]string
+	LogFile       string
+	LogLevel      string
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":            tls.NoClientCert,
+	"verify-if-given": tls.VerifyClientCertIfGiven,
+	"require":         tls.RequireAndVerifyClientCert,
+}
+
+// envVars returns the GUPLOAD_* environment variable of a serve flag, e.g. max-file-size => GUPLOAD_MAX_FILE_SIZE
+func envVars(flag string) []string {
+	return []string{"GUPLOAD_" + strings.ToUpper(strings.Replace(flag, "-", "_", -1))}
+}
+
+// loadConfigFile applies the yaml or toml file named by --config to the flags not already set
+// from the command line or environment
+func loadConfigFile(c *cli.Context, flags []cli.Flag) (err error) {
+	var (
+		path   = c.String("config")
+		source altsrc.InputSourceContext
+	)
+	if path == "" {
+		return
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		source, err = altsrc.NewTomlSourceFromFile(path)
+	case ".yaml", ".yml":
+		source, err = altsrc.NewYamlSourceFromFile(path)
+	default:
+		return errors.Errorf("unsupported config file %s: use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to load config file %s", path)
+	}
+	return altsrc.ApplyInputSourceValues(c, source, flags)
+}
+
+// newServeConfig reads and validates the serve options
+func newServeConfig(c *cli.Context, flags []cli.Flag) (cfg ServeConfig, err error) {
+	if err = loadConfigFile(c, flags); err != nil {
+		return
+	}
+
+	cfg = ServeConfig{
+		Address:            c.String("address"),
+		Root:               c.String("root"),
+		Certificate:        c.String("certificate"),
+		Key:                c.String("key"),
+		ClientCA:           c.String("client-ca"),
+		AuditLog:           c.String("audit-log"),
+		CertReloadInterval: c.Duration("cert-reload-interval"),
+		CertExpiryWarning:  c.Duration("cert-expiry-warning"),
+		Auth: AuthPolicy{
+			Uploaders:   splitValues(c.StringSlice("upload-identities")),
+			Downloaders: splitValues(c.StringSlice("download-identities")),
+			Admins:      splitValues(c.StringSlice("admin-identities")),
+			Sharers:     splitValues(c.StringSlice("share-identities")),
+		},
+		TokenAuth: TokenAuthConfig{
+			TokenFile:    c.String("token-file"),
+			JWTPublicKey: c.String("jwt-public-key"),
+			JWTIssuer:    c.String("jwt-issuer"),
+			JWTAudience:  c.String("jwt-audience"),
+		},
+		ShareKey:      c.String("share-key"),
+		ShareDenylist: c.String("share-denylist"),
+		MaxShareTTL:   c.Duration("share-max-ttl"),
+		Validation: ValidationConfig{
+			Validators:        splitValues(c.StringSlice("validators")),
+			AllowedExtensions: splitValues(c.StringSlice("allowed-extensions")),
+			AllowedMimeTypes:  splitValues(c.StringSlice("allowed-mime-types")),
+		},
+		Scan: ScanConfig{
+			Command:       c.String("scan-cmd"),
+			Timeout:       c.Duration("scan-timeout"),
+			MaxConcurrent: c.Int("scan-concurrency"),
+			StagingDir:    filepath.Join(c.String("root"), internalDir, "staging"),
+			QuarantineDir: filepath.Join(c.String("root"), internalDir, "quarantine"),
+		},
+		Webhooks: WebhookConfig{
+			URLs:        splitValues(c.StringSlice("webhook")),
+			Secret:      c.String("webhook-secret"),
+			Dir:         filepath.Join(c.String("root"), internalDir, "webhooks"),
+			MaxAttempts: c.Int("webhook-max-attempts"),
+			Timeout:     c.Duration("webhook-timeout"),
+		},
+		Limits: LimitConfig{
+			RequestsPerSecond:      c.Float64("rate-limit"),
+			RequestBurst:           c.Int("rate-limit-burst"),
+			MaxConcurrentUploads:   c.Int("max-concurrent-uploads"),
+			MaxConcurrentDownloads: c.Int("max-concurrent-downloads"),
+		},
+		LogFile:  c.String("log-file"),
+		LogLevel: strings.ToLower(c.String("log-level")),
+	}
+
+	if cfg.Address == "" {
+		cfg.Address = ":" + strconv.Itoa(c.Int("port"))
+	}
+
+	cfg.SignatureTrustStore = splitValues(c.StringSlice("signature-trust-store"))
+	cfg.RequireSignature = c.Bool("require-signature")
+
+	if c.Bool("require-approval") {
+		cfg.PendingDir = filepath.Join(cfg.Root, internalDir, "pending")
+	}
+
+	cfg.MasterKey, err = loadMasterKey(c.String("master-key-file"), os.Getenv(masterKeyEnv))
+	if err != nil {
+		return
+	}
+
+	size, err := humanize.ParseBytes(c.String("max-file-size"))
+	if err != nil {
+		err = errors.Wrapf(err, "invalid max-file-size %s", c.String("max-file-size"))
+		return
+	}
+	cfg.MaxFileSize = int64(size)
+
+	minSize, err := humanize.ParseBytes(c.String("min-file-size"))
+	if err != nil {
+		err = errors.Wrapf(err, "invalid min-file-size %s", c.String("min-file-size"))
+		return
+	}
+	cfg.Validation.MinFileSize = int64(minSize)
+	cfg.Validation.MaxFileSize = cfg.MaxFileSize
+
+	cfg.Limits.BytesPerSecond, err = parseRate(c.String("bandwidth-limit"))
+	if err != nil {
+		err = errors.Wrapf(err, "invalid bandwidth-limit")
+		return
+	}
+	cfg.Limits.DownloadStreamBytesPerSecond, err = parseRate(c.String("download-stream-limit"))
+	if err != nil {
+		err = errors.Wrapf(err, "invalid download-stream-limit")
+		return
+	}
+
+	cfg.TLSPairs, err = parseTLSPairs(splitValues(c.StringSlice("tls-pair")))
+	if err != nil {
+		return
+	}
+	cfg.MSPIdentities, err = parseMSPIdentities(splitValues(c.StringSlice("msp-identities")))
+	if err != nil {
+		return
+	}
+	// peer urls are not split on commas
+	cfg.Replication.Peers, err = parsePeers(c.StringSlice("peer"))
+	if err != nil {
+		return
+	}
+	cfg.Replication.StateFile = filepath.Join(c.String("root"), internalDir, "replication.json")
+
+	cfg.TLSPolicy, err = parseTLSPolicy(c.String("tls-min-version"), splitValues(c.StringSlice("tls-cipher-suites")),
+		splitValues(c.StringSlice("tls-curves")), splitValues(c.StringSlice("alpn")))
+	if err != nil {
+		return
+	}
+
+	clientAuth := c.String("client-auth")
+	if clientAuth == "" {
+		clientAuth = "none"
+		if cfg.ClientCA != "" {
+			clientAuth = "verify-if-given"
+		}
+	}
+	authType, ok := clientAuthTypes[clientAuth]
+	if !ok {
+		err = errors.Errorf("invalid client-auth %s: use none, verify-if-given or require", clientAuth)
+		return
+	}
+	cfg.ClientAuth = authType
+
+	err = cfg.Validate()
+	return
+}
+
+func (cfg ServeConfig) Validate() error {
+	if cfg.Root == "" {
+		return errors.New("root must be set")
+	}
+	if cfg.MaxFileSize <= 0 {
+		return errors.New("max-file-size must be positive")
+	}
+	if (cfg.Certificate == "") != (cfg.Key == "") {
+		return errors.New("certificate and key must be set together")
+	}
+	if len(cfg.TLSPairs) > 0 && cfg.Certificate == "" {
+		return errors.New("tls-pair requires certificate and key")
+	}
+	if cfg.ClientCA != "" && cfg.Certificate == "" {
+		return errors.New("client-ca requires certificate and key")
+	}
+	if cfg.ClientAuth != tls.NoClientCert && cfg.ClientCA == "" {
+		return errors.New("verifying client certificates requires client-ca")
+	}
+	if cfg.CertReloadInterval <= 0 {
+		return errors.New("cert-reload-interval must be positive")
+	}
+	if _, err := newValidators(cfg.Validation); err != nil {
+		return err
+	}
+	if cfg.Scan.Command != "" && (cfg.Scan.Timeout <= 0 || cfg.Scan.MaxConcurrent <= 0) {
+		return errors.New("scan-timeout and scan-concurrency must be positive")
+	}
+	if cfg.Limits.RequestsPerSecond < 0 || cfg.Limits.RequestBurst < 0 {
+		return errors.New("rate-limit and rate-limit-burst must not be negative")
+	}
+	if cfg.Limits.MaxConcurrentUploads < 0 || cfg.Limits.MaxConcurrentDownloads < 0 {
+		return errors.New("max-concurrent-uploads and max-concurrent-downloads must not be negative")
+	}
+	if cfg.LogLevel != logLevelInfo && cfg.LogLevel != logLevelDebug {
+		return errors.Errorf("invalid log-level %s: use info or debug", cfg.LogLevel)
+	}
+	if (cfg.TokenAuth.TokenFile != "" || cfg.TokenAuth.JWTPublicKey != "") && cfg.Certificate == "" {
+		return errors.New("bearer tokens require certificate and key")
+	}
+	if cfg.PendingDir != "" && len(cfg.Auth.Admins) == 0 {
+		return errors.New("require-approval requires admin-identities, to review the pending files")
+	}
+	if cfg.RequireSignature && len(cfg.SignatureTrustStore) == 0 {
+		return errors.New("require-signature requires signature-trust-store")
+	}
+	if cfg.ShareKey == "" && cfg.ShareDenylist != "" {
+		return errors.New("share-denylist requires share-key")
+	}
+	if cfg.ShareKey != "" && cfg.MaxShareTTL <= 0 {
+		return errors.New("share-max-ttl must be positive")
+	}
+	// the files of the flags, checked up front for an error naming the flag
+	paths := [][2]string{
+		{"certificate", cfg.Certificate},
+		{"key", cfg.Key},
+		{"client-ca", cfg.ClientCA},
+		{"token-file", cfg.TokenAuth.TokenFile},
+		{"jwt-public-key", cfg.TokenAuth.JWTPublicKey},
+		{"share-key", cfg.ShareKey},
+	}
+	for _, pair := range cfg.TLSPairs {
+		paths = append(paths, [2]string{"tls-pair", pair.Certificate}, [2]string{"tls-pair", pair.Key})
+	}
+	for _, path := range paths {
+		if path[1] == "" {
+			continue
+		}
+		if _, err := os.Stat(path[1]); err != nil {
+			return errors.Wrapf(err, "invalid %s", path[0])
+		}
+	}
+	return nil
+}
+
+// setupLogging redirects the standard logger to LogFile, when set
+func (cfg ServeConfig) setupLogging() (err error) {
+	if cfg.LogFile == "" {
+		return
+	}
+
+	f, err := os.OpenFile(cfg.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open log file %s", cfg.LogFile)
+	}
+	log.SetOutput(f)
+	return
+}
@@ -3,22 +3,57 @@ package core
 import (
 	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
 	"github.com/urfave/cli/v2"
+	"golang.org/x/net/context"
 )
 
 var DownloadCommand = cli.Command{
 	Name:   "download",
 	Usage:  "download a file",
 	Action: downloadAction,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
 			Name:  "address",
 			Value: "localhost:1313",
 			Usage: "address of the server to connect to",
 		},
-		&cli.StringFlag{
+		&cli.StringSliceFlag{
 			Name:  "file",
-			Usage: "filename to download",
+			Usage: "filename to download; several files are downloaded in parallel",
+		},
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "path of the downloaded file, or folder of prefix; - writes the file to stdout, and the progress to stderr",
+		},
+		&cli.StringFlag{
+			Name:  "outdir",
+			Usage: "existing folder, where the remote path of the file is created; default: the current folder",
+		},
+		&cli.BoolFlag{
+			Name:  "overwrite",
+			Usage: "replace the local file, when it exists",
+		},
+		&cli.BoolFlag{
+			Name:  "no-clobber",
+			Usage: "keep the local file, when it exists, and skip its download",
+		},
+		&cli.StringFlag{
+			Name:  "prefix",
+			Usage: "folder to download with all its files, written as the local folder of the same name",
+		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "replace the local folder of prefix, when it exists",
+		},
+		&cli.IntFlag{
+			Name:  "parallel",
+			Value: 4,
+			Usage: "concurrent streams of a batch, over one connection",
 		},
 		&cli.StringFlag{
 			Name:  "cacert",
@@ -28,15 +63,50 @@ var DownloadCommand = cli.Command{
 			Name:  "servername-override",
 			Usage: "use serverNameOverride for tls ca cert",
 		},
-	},
+		&cli.StringFlag{
+			Name:  "cert",
+			Usage: "path to client TLS certificate (optional mTLS identity)",
+		},
+		&cli.StringFlag{
+			Name:  "key",
+			Usage: "path to client TLS key",
+		},
+		&cli.StringFlag{
+			Name:  "limit-rate",
+			Usage: "maximum transfer rate, e.g. 2MB/s; unlimited when empty",
+		},
+		&cli.StringFlag{
+			Name:  "decrypt-with",
+			Usage: "key file decrypting an encrypted file (age identities, or a PEM private key)",
+		},
+		&cli.BoolFlag{
+			Name:  "verify",
+			Usage: "check the detached signature of the file against --trust-store; unsigned or tampered files are not written",
+		},
+		&cli.StringSliceFlag{
+			Name:  "trust-store",
+			Usage: "PEM certificates, or folders of them, trusted to issue signer certificates; implies --verify",
+		},
+		&cli.StringFlag{
+			Name:    "share-token",
+			Usage:   "download with a share token, see gupload share; file defaults to the shared file",
+			EnvVars: []string{"GUPLOAD_SHARE_TOKEN"},
+		},
+	}, append(clientSecurityFlags, clientRetryFlags...)...),
 }
 
 func downloadAction(c *cli.Context) (err error) {
 	var (
 		address            = c.String("address")
-		file               = c.String("file")
+		files              = splitValues(c.StringSlice("file"))
+		prefix             = c.String("prefix")
+		output             = c.String("output")
+		outdir             = c.String("outdir")
 		rootCertificate    = c.String("cacert")
 		serverNameOverride = c.String("servername-override")
+		certificate        = c.String("cert")
+		key                = c.String("key")
+		shareToken         = c.String("share-token")
 		client             Client
 	)
 
@@ -44,28 +114,117 @@ func downloadAction(c *cli.Context) (err error) {
 		must(errors.New("address"))
 	}
 
-	if file == "" {
-		must(errors.New("file must be set"))
+	if len(files) == 0 && shareToken != "" {
+		files = []string{shareTokenFilename(shareToken)}
+	}
+
+	if len(files) == 0 && prefix == "" {
+		must(errors.New("file or prefix must be set"))
+	}
+
+	if len(files) > 0 && prefix != "" {
+		must(errors.New("file and prefix cannot be both set"))
+	}
+
+	if output != "" && len(files) > 1 {
+		must(errors.New("output writes a single file: use outdir"))
+	}
+
+	if output == "-" && prefix != "" {
+		must(errors.New("prefix is written as a folder: output cannot be -"))
+	}
+
+	if output != "" && outdir != "" {
+		must(errors.New("output and outdir cannot be both set"))
+	}
+
+	if c.Bool("overwrite") && c.Bool("no-clobber") {
+		must(errors.New("overwrite and no-clobber cannot be both set"))
 	}
 
 	if rootCertificate == "" {
 		must(errors.New("cacert must be set"))
 	}
 
+	// stdout only carries the file, when it is the output
+	var progress io.Writer = os.Stdout
+	if output == "-" {
+		progress = os.Stderr
+	}
+
+	tlsPolicy, err := newClientTLSPolicy(c)
+	must(err)
+	limitRate, err := parseRate(c.String("limit-rate"))
+	must(err)
+	token, err := newClientToken(c)
+	must(err)
+	retry, err := newClientRetry(c)
+	must(err)
+
 	grpcClient, err := NewClientGRPC(ClientGRPCConfig{
 		Address:            address,
 		RootCertificate:    rootCertificate,
 		ServerNameOverride: serverNameOverride,
-		Filename:           file,
+		TLSPolicy:          tlsPolicy,
+		Token:              token,
+		Retry:              retry,
+		Timeout:            c.Duration("timeout"),
+		Certificate:        certificate,
+		Key:                key,
+		LimitRate:          limitRate,
+		DecryptWith:        c.String("decrypt-with"),
+		Verify:             c.Bool("verify") || len(c.StringSlice("trust-store")) > 0,
+		TrustStore:         splitValues(c.StringSlice("trust-store")),
 		UsePublicFolder:    true,
+		ShareToken:         shareToken,
+		Quiet:              len(files) > 1,
+		Progress:           progress,
 	})
 	must(err)
 	client = &grpcClient
 
-	err = client.DownloadFile(file)
-	must(err)
 	defer client.Close()
 
-	fmt.Printf("\nsuccessfully downloaded: %s\n", file)
+	if prefix != "" {
+		prefix = strings.TrimSuffix(filepath.ToSlash(filepath.Clean(prefix)), "/")
+		if output == "" {
+			output = filepath.Join(outdir, filepath.FromSlash(prefix))
+		}
+		must(client.DownloadPrefix(prefix, output, c.Bool("force")))
+		fmt.Printf("\nsuccessfully downloaded: %s/\n", output)
+		return
+	}
+
+	opts := DownloadOptions{
+		Output:    output,
+		OutDir:    outdir,
+		Overwrite: c.Bool("overwrite"),
+		NoClobber: c.Bool("no-clobber"),
+	}
+	if len(files) > 1 {
+		summary := client.DownloadFiles(context.Background(), files, opts, BatchOptions{
+			Parallel: c.Int("parallel"),
+		})
+		summary.Print(os.Stdout)
+		if failed := summary.Failed(); failed > 0 {
+			must(fmt.Errorf("%d of %d files failed", failed, len(files)))
+		}
+		return
+	}
+
+	if output == "-" {
+		must(client.DownloadTo(files[0], os.Stdout))
+		fmt.Fprintf(progress, "\nsuccessfully downloaded: %s\n", files[0])
+		return
+	}
+
+	dest, err := client.DownloadFile(files[0], opts)
+	if err == ErrFileExists {
+		fmt.Printf("%s exists: skipped\n", dest)
+		return nil
+	}
+	must(err)
+
+	fmt.Printf("\nsuccessfully downloaded: %s\n", dest)
 	return
 }
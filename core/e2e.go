@@ -0,0 +1,345 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// encryptionFormatAge marks uploads encrypted client-side, in the age format (https://age-encryption.org/v1)
+	encryptionFormatAge = "age"
+	ageHeader           = "age-encryption.org/v1\n"
+
+	stanzaP256    = "gupload-p256"
+	stanzaRSAOAEP = "gupload-rsa-oaep"
+	p256Label     = "gupload-p256"
+	rsaOAEPLabel  = "gupload-rsa-oaep"
+)
+
+// namedRecipient is an age recipient, with the description recorded as upload metadata
+type namedRecipient struct {
+	age.Recipient
+	name string
+}
+
+// readRecipients reads the recipients of --encrypt-to files: age X25519 recipients ("age1..." lines),
+// or PEM certificates and public keys (ECDSA P-256 or RSA), e.g. the signing cert of the recipient org
+func readRecipients(paths []string) (recipients []namedRecipient, err error) {
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read recipient %s", path)
+		}
+
+		if block, _ := pem.Decode(b); block != nil {
+			r, err := newX509Recipient(block)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid recipient %s", path)
+			}
+			recipients = append(recipients, r)
+			continue
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(b))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			r, err := age.ParseX25519Recipient(line)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid recipient %s", path)
+			}
+			recipients = append(recipients, namedRecipient{Recipient: r, name: line})
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, errors.Wrapf(err, "failed to read recipient %s", path)
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipient found")
+	}
+	return
+}
+
+// readIdentities reads a --decrypt-with key file: age identities ("AGE-SECRET-KEY-1..." lines),
+// or a PEM private key (PKCS #8, SEC 1 or PKCS #1) matching an X.509 recipient
+func readIdentities(path string) ([]age.Identity, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read key %s", path)
+	}
+
+	if block, _ := pem.Decode(b); block != nil {
+		identity, err := newX509Identity(block)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key %s", path)
+		}
+		return []age.Identity{identity}, nil
+	}
+
+	identities, err := age.ParseIdentities(bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid key %s", path)
+	}
+	return identities, nil
+}
+
+// encryptTo returns the age encryption of r
+func encryptTo(r io.Reader, recipients []namedRecipient) (*bytes.Buffer, error) {
+	list := make([]age.Recipient, 0, len(recipients))
+	for _, recipient := range recipients {
+		list = append(list, recipient.Recipient)
+	}
+
+	encrypted := &bytes.Buffer{}
+	w, err := age.Encrypt(encrypted, list...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encrypt")
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		return nil, errors.Wrapf(err, "failed to encrypt")
+	}
+	if err = w.Close(); err != nil {
+		return nil, errors.Wrapf(err, "failed to encrypt")
+	}
+	return encrypted, nil
+}
+
+// isAgeEncrypted reports whether data starts with an age header
+func isAgeEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ageHeader))
+}
+
+// keyFingerprint identifies a public key: the base64 of the first 8 bytes of the sha256 of its PKIX encoding
+func keyFingerprint(key interface{}) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawStdEncoding.EncodeToString(sum[:8]), nil
+}
+
+// x509Recipient wraps the file key to an ECDSA P-256 key, with ephemeral ECDH and HKDF as the X25519 recipient
+// of age, or to an RSA key with OAEP
+type x509Recipient struct {
+	publicKey   interface{}
+	fingerprint string
+}
+
+func newX509Recipient(block *pem.Block) (r namedRecipient, err error) {
+	var (
+		key  interface{}
+		name string
+	)
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return r, err
+		}
+		key = cert.PublicKey
+		name = "x509:" + cert.Subject.String()
+	case "PUBLIC KEY":
+		if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return
+		}
+		name = "x509"
+	default:
+		return r, errors.Errorf("unsupported PEM block %s: use a CERTIFICATE or PUBLIC KEY", block.Type)
+	}
+
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return r, errors.New("only P-256 ECDSA keys are supported")
+		}
+	case *rsa.PublicKey:
+	default:
+		return r, errors.Errorf("unsupported public key type %T", key)
+	}
+
+	fingerprint, err := keyFingerprint(key)
+	if err != nil {
+		return
+	}
+	return namedRecipient{
+		Recipient: &x509Recipient{publicKey: key, fingerprint: fingerprint},
+		name:      fmt.Sprintf("%s (%s)", name, fingerprint),
+	}, nil
+}
+
+func (r *x509Recipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	switch key := r.publicKey.(type) {
+	case *rsa.PublicKey:
+		body, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, fileKey, []byte(rsaOAEPLabel))
+		if err != nil {
+			return nil, err
+		}
+		return []*age.Stanza{{Type: stanzaRSAOAEP, Args: []string{r.fingerprint}, Body: body}}, nil
+
+	case *ecdsa.PublicKey:
+		recipient, err := key.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		ephemeral, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := ephemeral.ECDH(recipient)
+		if err != nil {
+			return nil, err
+		}
+		ephemeralPublic := ephemeral.PublicKey().Bytes()
+
+		wrappingKey, err := p256WrappingKey(shared, ephemeralPublic, recipient.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		body, err := aeadSeal(wrappingKey, fileKey)
+		if err != nil {
+			return nil, err
+		}
+		return []*age.Stanza{{
+			Type: stanzaP256,
+			Args: []string{r.fingerprint, base64.RawStdEncoding.EncodeToString(ephemeralPublic)},
+			Body: body,
+		}}, nil
+	}
+	return nil, errors.Errorf("unsupported public key type %T", r.publicKey)
+}
+
+// x509Identity unwraps the stanzas of an x509Recipient with its private key
+type x509Identity struct {
+	privateKey  interface{}
+	fingerprint string
+}
+
+func newX509Identity(block *pem.Block) (*x509Identity, error) {
+	key, err := parsePrivateKey(block)
+	if err != nil {
+		return nil, err
+	}
+
+	var public interface{}
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		public = &k.PublicKey
+	case *rsa.PrivateKey:
+		public = &k.PublicKey
+	default:
+		return nil, errors.Errorf("unsupported private key type %T", key)
+	}
+	fingerprint, err := keyFingerprint(public)
+	if err != nil {
+		return nil, err
+	}
+	return &x509Identity{privateKey: key, fingerprint: fingerprint}, nil
+}
+
+// parsePrivateKey parses a PEM private key block: PKCS #8, SEC 1 or PKCS #1
+func parsePrivateKey(block *pem.Block) (interface{}, error) {
+	switch block.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	return nil, errors.Errorf("unsupported PEM block %s", block.Type)
+}
+
+func (i *x509Identity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	for _, s := range stanzas {
+		if len(s.Args) == 0 || s.Args[0] != i.fingerprint {
+			continue
+		}
+
+		switch key := i.privateKey.(type) {
+		case *rsa.PrivateKey:
+			if s.Type != stanzaRSAOAEP {
+				continue
+			}
+			return rsa.DecryptOAEP(sha256.New(), nil, key, s.Body, []byte(rsaOAEPLabel))
+
+		case *ecdsa.PrivateKey:
+			if s.Type != stanzaP256 || len(s.Args) != 2 {
+				continue
+			}
+			ephemeralPublic, err := base64.RawStdEncoding.DecodeString(s.Args[1])
+			if err != nil {
+				return nil, errors.Wrapf(err, "malformed %s stanza", stanzaP256)
+			}
+			ephemeral, err := ecdh.P256().NewPublicKey(ephemeralPublic)
+			if err != nil {
+				return nil, errors.Wrapf(err, "malformed %s stanza", stanzaP256)
+			}
+			private, err := key.ECDH()
+			if err != nil {
+				return nil, err
+			}
+			shared, err := private.ECDH(ephemeral)
+			if err != nil {
+				return nil, err
+			}
+
+			wrappingKey, err := p256WrappingKey(shared, ephemeralPublic, private.PublicKey().Bytes())
+			if err != nil {
+				return nil, err
+			}
+			return aeadOpen(wrappingKey, s.Body)
+		}
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+// p256WrappingKey derives the key wrapping a file key from the ECDH shared secret, with HKDF-SHA256 salted by both
+// public keys, uncompressed: the X25519 stanza of age, over P-256
+func p256WrappingKey(shared []byte, ephemeralPublic []byte, recipientPublic []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeralPublic...), recipientPublic...)
+	h := hkdf.New(sha256.New, shared, salt, []byte(p256Label))
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// aeadSeal and aeadOpen use ChaCha20-Poly1305 with a zero nonce, as age does: every wrapping key is derived from a
+// new ephemeral key, and used once
+func aeadSeal(key, plaintext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), plaintext, nil), nil
+}
+
+func aeadOpen(key, ciphertext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), ciphertext, nil)
+}
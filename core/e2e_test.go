@@ -0,0 +1,134 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// x509KeyFiles writes the PEM public key and PKCS #8 private key of key, and returns their paths
+func x509KeyFiles(t *testing.T, name string, key interface{}, public interface{}) (string, string) {
+	dir := t.TempDir()
+	publicDer, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPath, privatePath := filepath.Join(dir, name+".pub"), filepath.Join(dir, name+".key")
+	for path, block := range map[string]*pem.Block{
+		publicPath:  {Type: "PUBLIC KEY", Bytes: publicDer},
+		privatePath: {Type: "PRIVATE KEY", Bytes: privateDer},
+	} {
+		if err = ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return publicPath, privatePath
+}
+
+func newP256KeyFiles(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x509KeyFiles(t, "p256", key, &key.PublicKey)
+}
+
+func newRSAKeyFiles(t *testing.T) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x509KeyFiles(t, "rsa", key, &key.PublicKey)
+}
+
+func TestX509RecipientRoundTrip(t *testing.T) {
+	p256Public, p256Private := newP256KeyFiles(t)
+	rsaPublic, rsaPrivate := newRSAKeyFiles(t)
+	recipients, err := readRecipients([]string{p256Public, rsaPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := bytes.Repeat([]byte("msp bundle "), 10000)
+	encrypted, err := encryptTo(bytes.NewReader(plaintext), recipients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isAgeEncrypted(encrypted.Bytes()) {
+		t.Fatal("encryptTo did not write an age file")
+	}
+
+	for name, private := range map[string]string{stanzaP256: p256Private, stanzaRSAOAEP: rsaPrivate} {
+		identities, err := readIdentities(private)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := age.Decrypt(bytes.NewReader(encrypted.Bytes()), identities...)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		decrypted, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("%s: decrypted %d bytes, %v; want the %d bytes encrypted", name, len(decrypted), err,
+				len(plaintext))
+		}
+	}
+}
+
+func TestX509IdentityRefusesWrongKey(t *testing.T) {
+	fileKey := bytes.Repeat([]byte{7}, 16)
+	for name, newKeyFiles := range map[string]func(t *testing.T) (string, string){
+		stanzaP256:    newP256KeyFiles,
+		stanzaRSAOAEP: newRSAKeyFiles,
+	} {
+		t.Run(name, func(t *testing.T) {
+			public, private := newKeyFiles(t)
+			_, otherPrivate := newKeyFiles(t)
+			recipients, err := readRecipients([]string{public})
+			if err != nil {
+				t.Fatal(err)
+			}
+			stanzas, err := recipients[0].Wrap(fileKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stanzas) != 1 || stanzas[0].Type != name {
+				t.Fatalf("Wrap = %+v, want one %s stanza", stanzas, name)
+			}
+
+			identities, err := readIdentities(private)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := identities[0].Unwrap(stanzas); err != nil || !bytes.Equal(got, fileKey) {
+				t.Fatalf("Unwrap = %x, %v; want %x", got, err, fileKey)
+			}
+
+			others, err := readIdentities(otherPrivate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := others[0].Unwrap(stanzas); err != age.ErrIncorrectIdentity {
+				t.Errorf("Unwrap with another key = %x, %v; want ErrIncorrectIdentity", got, err)
+			}
+
+			stanzas[0].Body[0] ^= 1
+			if got, err := identities[0].Unwrap(stanzas); err == nil {
+				t.Errorf("Unwrap of a tampered stanza = %x, want an error", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,368 @@
+package core
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	eventCreated = "created"
+	eventUpdated = "updated"
+	eventDeleted = "deleted"
+)
+
+// eventRecord is one line of the event log
+type eventRecord struct {
+	Seq      uint64 `json:"seq"`
+	Time     string `json:"time"`
+	Type     string `json:"type"`
+	Filename string `json:"filename"`
+	FileType string `json:"fileType"`
+	Version  uint64 `json:"version"`
+	Checksum string `json:"checksum,omitempty"`
+	Size     int64  `json:"size"`
+}
+
+func (r eventRecord) toEvent() *FileEvent {
+	return &FileEvent{
+		Seq:      r.Seq,
+		Time:     r.Time,
+		Type:     r.Type,
+		Filename: r.Filename,
+		FileType: r.FileType,
+		Version:  r.Version,
+		Checksum: r.Checksum,
+		Size:     r.Size,
+	}
+}
+
+// matches tells whether the event is about a file of the folder prefix, of fileType
+func (r eventRecord) matches(prefix string, fileType string) bool {
+	if r.FileType != fileType {
+		return false
+	}
+	return prefix == "" || r.Filename == prefix || strings.HasPrefix(r.Filename, prefix+"/")
+}
+
+// file is the state of the file after the event
+func (r eventRecord) file() *eventFile {
+	t, _ := time.Parse(time.RFC3339Nano, r.Time)
+	return &eventFile{version: r.Version, checksum: r.Checksum, deleted: r.Type == eventDeleted, time: t}
+}
+
+// eventFile is the last known state of a file, as recorded by the event log
+type eventFile struct {
+	version  uint64
+	checksum string
+	deleted  bool
+	time     time.Time
+}
+
+// EventLog is the append-only log of the changes of the stored files, streamed to the subscribers. The version of
+// each file is rebuilt from the log, when it is opened.
+type EventLog struct {
+	mu          sync.Mutex
+	path        string
+	file        *os.File
+	seq         uint64
+	files       map[string]*eventFile
+	subscribers map[chan eventRecord]struct{}
+}
+
+// NewEventLog opens (or creates) the event log at path
+func NewEventLog(path string) (*EventLog, error) {
+	l := &EventLog{
+		path:        path,
+		files:       make(map[string]*eventFile),
+		subscribers: make(map[chan eventRecord]struct{}),
+	}
+
+	if err := truncatePartialLine(path, ""); err != nil {
+		return nil, errors.Wrapf(err, "failed to repair event log %s", path)
+	}
+	err := readEventLog(path, 0, func(rec eventRecord) error {
+		l.seq = rec.Seq
+		l.files[rec.FileType+"/"+rec.Filename] = rec.file()
+		return nil
+	})
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Wrapf(err, "failed to read event log %s", path)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create %s", filepath.Dir(path))
+	}
+	l.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open event log %s", path)
+	}
+	return l, nil
+}
+
+// Saved records the new content of a file, as created or updated. Saving the same content again is no event.
+func (l *EventLog) Saved(fileType string, fileId string, checksum string, size int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec := eventRecord{Type: eventCreated, Filename: fileId, FileType: fileType, Checksum: checksum, Size: size}
+	if f, ok := l.files[fileType+"/"+fileId]; ok && !f.deleted {
+		if f.checksum == checksum {
+			return nil
+		}
+		rec.Type = eventUpdated
+	}
+	return l.append(rec)
+}
+
+// Deleted records the removal of a file
+func (l *EventLog) Deleted(fileType string, fileId string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.append(eventRecord{Type: eventDeleted, Filename: fileId, FileType: fileType})
+}
+
+// append versions rec, writes it durably and notifies the subscribers; l.mu is held
+func (l *EventLog) append(rec eventRecord) error {
+	key := rec.FileType + "/" + rec.Filename
+	f, ok := l.files[key]
+	if !ok {
+		f = &eventFile{}
+	}
+
+	rec.Seq = l.seq + 1
+	rec.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	rec.Version = f.version + 1
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode event")
+	}
+	if _, err = l.file.Write(append(line, '\n')); err != nil {
+		return errors.Wrapf(err, "failed to write event")
+	}
+	if err = l.file.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to sync event log")
+	}
+
+	l.seq = rec.Seq
+	l.files[key] = rec.file()
+
+	for ch := range l.subscribers {
+		select {
+		case ch <- rec:
+		default:
+			// slow subscriber; it reads the events it missed from the log
+		}
+	}
+	return nil
+}
+
+// Subscribe returns a channel receiving every event appended from now on, and the last seq already written
+func (l *EventLog) Subscribe() (ch chan eventRecord, lastSeq uint64, cancel func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ch = make(chan eventRecord, 64)
+	l.subscribers[ch] = struct{}{}
+	cancel = func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.subscribers, ch)
+	}
+	return ch, l.seq, cancel
+}
+
+// Follow calls fn for the logged events from fromSeq onward, then for every appended event, until ctx is done or fn
+// fails. fromSeq 0 skips the logged events.
+func (l *EventLog) Follow(ctx context.Context, fromSeq uint64, fn func(rec eventRecord) error) error {
+	events, lastSeq, cancel := l.Subscribe()
+	defer cancel()
+
+	next := lastSeq + 1
+	if fromSeq > 0 {
+		next = fromSeq
+	}
+	// replay reads the events from next up to seq, e.g. missed while fn was slow
+	replay := func(seq uint64) error {
+		err := readEventLog(l.path, next, func(rec eventRecord) error {
+			if rec.Seq > seq {
+				return io.EOF
+			}
+			next = rec.Seq + 1
+			return fn(rec)
+		})
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	if next <= lastSeq {
+		if err := replay(lastSeq); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case rec := <-events:
+			if rec.Seq < next {
+				continue
+			}
+			if rec.Seq > next {
+				if err := replay(rec.Seq - 1); err != nil {
+					return err
+				}
+			}
+			next = rec.Seq + 1
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ChangedAt returns the time of the last event of a file, including its deletion
+func (l *EventLog) ChangedAt(fileType string, fileId string) (changedAt time.Time, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.files[fileType+"/"+fileId]
+	if !ok {
+		return
+	}
+	return f.time, true
+}
+
+func (l *EventLog) Path() string {
+	return l.path
+}
+
+func (l *EventLog) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file != nil {
+		_ = l.file.Close()
+	}
+}
+
+// readEventLog calls fn for each event with seq >= fromSeq, in order. It stops at a last line without a newline: an
+// event being appended.
+func readEventLog(path string, fromSeq uint64, fn func(rec eventRecord) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		b, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to read line %d", line)
+		}
+
+		var rec eventRecord
+		if err := json.Unmarshal(b, &rec); err != nil {
+			return errors.Wrapf(err, "malformed event at line %d", line)
+		}
+		if rec.Seq < fromSeq {
+			continue
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// notifySaved records the save of a file. The file is saved by then: a failure is only logged.
+func (s *ServerGRPC) notifySaved(fileType string, fileId string, data []byte) {
+	if s.eventLog == nil {
+		return
+	}
+	sum := sha256.Sum256(data)
+	if err := s.eventLog.Saved(fileType, fileId, hex.EncodeToString(sum[:]), int64(len(data))); err != nil {
+		log.Printf("cannot record event of %s: %v", fileId, err)
+	}
+}
+
+// notifyTree records the save of the folder prefix, formerly holding the files before
+func (s *ServerGRPC) notifyTree(fileType string, prefix string, before []StoredFile, files []ArchiveFile) {
+	if s.eventLog == nil {
+		return
+	}
+	saved := make(map[string]bool, len(files))
+	for _, f := range files {
+		fileId := path.Join(prefix, f.Name)
+		saved[fileId] = true
+		s.notifySaved(fileType, fileId, f.Data)
+	}
+	for _, f := range before {
+		if !saved[f.FileId] {
+			s.notifyDeleted(fileType, f.FileId)
+		}
+	}
+}
+
+func (s *ServerGRPC) notifyDeleted(fileType string, fileId string) {
+	if s.eventLog == nil {
+		return
+	}
+	if err := s.eventLog.Deleted(fileType, fileId); err != nil {
+		log.Printf("cannot record event of %s: %v", fileId, err)
+	}
+}
+
+// Subscribe streams the change events of the files of a folder, until the client goes away. Events from FromSeq
+// onward are replayed first (FromSeq 0 skips the replay).
+func (s *ServerGRPC) Subscribe(req *SubscribeRequest, stream GuploadService_SubscribeServer) error {
+	if err := s.authorize(stream.Context(), authOpDownload); err != nil {
+		return err
+	}
+	if s.eventLog == nil {
+		return logError(status.Errorf(codes.FailedPrecondition, "events are not enabled"))
+	}
+	prefix := strings.Trim(req.GetPrefix(), "/")
+	// events of private files are only streamed on request, to the identities allowed to them
+	fileType := "public"
+	if req.GetFileType() != "" && req.GetFileType() != "public" {
+		if err := s.authorizePrivate(stream.Context()); err != nil {
+			return err
+		}
+		fileType = "private"
+	}
+
+	var sendErr error
+	err := s.eventLog.Follow(stream.Context(), req.GetFromSeq(), func(rec eventRecord) error {
+		if !rec.matches(prefix, fileType) {
+			return nil
+		}
+		sendErr = stream.Send(rec.toEvent())
+		return sendErr
+	})
+	if err != nil && err != sendErr {
+		return logError(status.Errorf(codes.Internal, "cannot read event log: %v", err))
+	}
+	return err
+}
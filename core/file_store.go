@@ -2,20 +2,76 @@ package core
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 type FileStore interface {
 	Save(fileId string, fileType string, binaryData bytes.Buffer) (string, error)
+	// Open returns the content of a stored file, and its size
+	Open(fileId string, fileType string) (io.ReadCloser, int64, error)
+	// SaveMeta replaces the metadata of a file; empty metadata removes it
+	SaveMeta(fileId string, fileType string, meta FileMeta) error
+	Meta(fileId string, fileType string) (FileMeta, error)
+	// SaveTree replaces the folder prefix with files, at once
+	SaveTree(prefix string, fileType string, files []ArchiveFile) error
+	// List returns the files of the folder prefix, recursively; of the whole folder of fileType when prefix is empty
+	List(prefix string, fileType string) ([]StoredFile, error)
+	Stat(fileId string, fileType string) (StoredFile, error)
+	// Delete removes a file, its metadata, and the folders it leaves empty
+	Delete(fileId string, fileType string) error
+	// Check returns ErrInvalidFileId for an id the store cannot save as fileType
+	Check(fileId string, fileType string) error
+}
+
+// StoredFile is a file of the store, as listed
+type StoredFile struct {
+	FileId  string
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+// FileMeta is what the store keeps about a file, besides its content
+type FileMeta struct {
+	Encryption *EncryptionMeta `json:"encryption,omitempty"`
+	Signature  *SignatureMeta  `json:"signature,omitempty"`
+	// Mode is the permission bits of the uploaded file, when the client sent them
+	Mode os.FileMode `json:"mode,omitempty"`
+}
+
+func (m FileMeta) IsEmpty() bool {
+	return m.Encryption == nil && m.Signature == nil && m.Mode == 0
+}
+
+// EncryptionMeta describes a file encrypted client-side; the server cannot read it
+type EncryptionMeta struct {
+	Format     string   `json:"format"`
+	Recipients []string `json:"recipients"`
+}
+
+func (m *EncryptionMeta) proto() *Encryption {
+	return &Encryption{Format: m.Format, Recipients: m.Recipients}
 }
 
+// ErrInvalidFileId is returned for file ids escaping the store, or colliding with its layout
+var ErrInvalidFileId = errors.New("invalid file id")
+
 type DiskStore struct {
 	mutex  sync.RWMutex
 	folder string
 	files  map[string]*FileInfo
+	// masterKey encrypts the saved files at rest, when set
+	masterKey *MasterKey
 }
 
 type FileInfo struct {
@@ -31,22 +87,70 @@ func NewDiskStore(folder string) *DiskStore {
 	}
 }
 
-func (store *DiskStore) Save(fileId string, fileType string, binaryData bytes.Buffer) (string, error) {
-	var filePath string
+// NewEncryptedDiskStore encrypts saved files with AES-GCM, under data keys wrapped by key. Open decrypts them.
+func NewEncryptedDiskStore(folder string, key *MasterKey) *DiskStore {
+	store := NewDiskStore(folder)
+	store.masterKey = key
+	return store
+}
+
+// path maps a file id to its location: private files live in the store root, public files in root/public.
+// Ids may contain sub folders, but must stay inside their folder.
+func (store *DiskStore) path(fileId string, fileType string) (string, error) {
+	name := filepath.Clean(filepath.FromSlash(fileId))
+	if fileId == "" || filepath.IsAbs(name) || name == "." || name == ".." ||
+		strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", errors.Wrapf(ErrInvalidFileId, "%s", fileId)
+	}
 
 	if fileType == "public" {
-		filePath = fmt.Sprintf("%s/public/%s", store.folder, fileId)
-	} else {
-		filePath = fmt.Sprintf("%s/%s", store.folder, fileId)
+		return filepath.Join(store.folder, "public", name), nil
+	}
+
+	// the top level of the root is shared with the public folder and the internal folder
+	top := strings.SplitN(name, string(filepath.Separator), 2)[0]
+	if top == "public" || top == internalDir {
+		return "", errors.Wrapf(ErrInvalidFileId, "%s is reserved", fileId)
 	}
+	return filepath.Join(store.folder, name), nil
+}
 
-	file, err := os.Create(filePath)
+func (store *DiskStore) Check(fileId string, fileType string) error {
+	_, err := store.path(fileId, fileType)
+	return err
+}
+
+func (store *DiskStore) Save(fileId string, fileType string, binaryData bytes.Buffer) (string, error) {
+	filePath, err := store.path(fileId, fileType)
 	if err != nil {
-		return "", fmt.Errorf("cannot create file: %w", err)
+		return "", err
 	}
 
-	_, err = binaryData.WriteTo(file)
+	if err = os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return "", fmt.Errorf("cannot create folder: %w", err)
+	}
+
+	// written aside and renamed, so that readers never see a partial file
+	file, err := ioutil.TempFile(filepath.Dir(filePath), ".upload-")
 	if err != nil {
+		return "", fmt.Errorf("cannot create file: %w", err)
+	}
+	if store.masterKey != nil {
+		err = store.masterKey.encrypt(file, &binaryData)
+	} else {
+		_, err = binaryData.WriteTo(file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filePath)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
 		return "", fmt.Errorf("cannot write file: %w", err)
 	}
 
@@ -58,7 +162,13 @@ func (store *DiskStore) Save(fileId string, fileType string, binaryData bytes.Bu
 		Type:   fileType,
 		Path:   filePath,
 	}
+	store.writeIndex()
+
+	return fileId, nil
+}
 
+// writeIndex lists the public folder in public/index.txt
+func (store *DiskStore) writeIndex() {
 	// make an public/listing.txt
 	publicDir := fmt.Sprintf("%s/public", store.folder)
 	indexTxt := fmt.Sprintf("%s/public/index.txt", store.folder)
@@ -66,25 +176,255 @@ func (store *DiskStore) Save(fileId string, fileType string, binaryData bytes.Bu
 	files, err := ioutil.ReadDir(publicDir)
 	if err != nil {
 		fmt.Println(err)
-		return fileId, nil
+		return
 	}
 
 	f, err := os.Create(indexTxt)
 	if err != nil {
 		fmt.Println(err)
-		f.Close()
-		return fileId, nil
+		return
 	}
 
 	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".upload-") {
+			continue
+		}
 		_, _ = fmt.Fprintln(f, file.Name())
 	}
 	err = f.Close()
 	if err != nil {
 		fmt.Println(err)
-		return fileId, nil
+		return
 	}
 	fmt.Println("index.txt created")
+}
 
-	return fileId, nil
+func (store *DiskStore) SaveTree(prefix string, fileType string, files []ArchiveFile) error {
+	dirPath, err := store.path(prefix, fileType)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(dirPath); err == nil && !fi.IsDir() {
+		return errors.Wrapf(ErrInvalidFileId, "%s is a file", prefix)
+	}
+
+	parent := filepath.Dir(dirPath)
+	if err = os.MkdirAll(parent, 0755); err != nil {
+		return fmt.Errorf("cannot create folder: %w", err)
+	}
+	tmp, err := ioutil.TempDir(parent, ".upload-")
+	if err != nil {
+		return fmt.Errorf("cannot create folder: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, f := range files {
+		name, err := cleanArchivePath(f.Name)
+		if err != nil {
+			return errors.Wrapf(ErrInvalidFileId, "%v", err)
+		}
+		p := filepath.Join(tmp, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return fmt.Errorf("cannot create folder: %w", err)
+		}
+		// the executable bits are kept, so that the tree downloads as uploaded
+		if err = writeAtRest(p, f.Data, 0644|f.Mode&0111, store.masterKey); err != nil {
+			return fmt.Errorf("cannot write file: %w", err)
+		}
+	}
+	if err = os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	// the previous tree is moved aside, rather than removed, until the new one is in place
+	old := filepath.Join(parent, ".upload-old-"+filepath.Base(tmp))
+	if err = os.Rename(dirPath, old); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot replace folder: %w", err)
+	}
+	if err = os.Rename(tmp, dirPath); err != nil {
+		_ = os.Rename(old, dirPath)
+		return fmt.Errorf("cannot replace folder: %w", err)
+	}
+	_ = os.RemoveAll(old)
+
+	// the metadata of the previous files no longer applies
+	if metaPath, err := store.metaPath(prefix, fileType); err == nil {
+		_ = os.RemoveAll(strings.TrimSuffix(metaPath, ".json"))
+	}
+	store.writeIndex()
+	return nil
+}
+
+// root is the folder of the files of fileType
+func (store *DiskStore) root(fileType string) string {
+	if fileType == "public" {
+		return filepath.Join(store.folder, "public")
+	}
+	return store.folder
+}
+
+func (store *DiskStore) List(prefix string, fileType string) (files []StoredFile, err error) {
+	dirPath := store.root(fileType)
+	if prefix != "" {
+		if dirPath, err = store.path(prefix, fileType); err != nil {
+			return nil, err
+		}
+	}
+	// the listing, the internal folder and, for private files, the public folder are not files of the folder
+	reserved := map[string]bool{
+		filepath.Join(store.folder, "public", "index.txt"): true,
+		filepath.Join(store.folder, internalDir):           true,
+		filepath.Join(store.folder, "public"):              fileType != "public",
+	}
+	fi, err := os.Stat(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errors.Wrapf(ErrInvalidFileId, "%s is not a folder", prefix)
+	}
+
+	err = filepath.Walk(dirPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".upload-") || reserved[p] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dirPath, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, StoredFile{
+			FileId:  path.Join(filepath.ToSlash(filepath.Clean(prefix)), filepath.ToSlash(rel)),
+			Mode:    info.Mode().Perm(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	return
+}
+
+func (store *DiskStore) Stat(fileId string, fileType string) (StoredFile, error) {
+	filePath, err := store.path(fileId, fileType)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	if info.IsDir() {
+		return StoredFile{}, errors.Wrapf(ErrInvalidFileId, "%s is a folder", fileId)
+	}
+	return StoredFile{FileId: fileId, Mode: info.Mode().Perm(), ModTime: info.ModTime()}, nil
+}
+
+func (store *DiskStore) Delete(fileId string, fileType string) error {
+	filePath, err := store.path(fileId, fileType)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return errors.Wrapf(ErrInvalidFileId, "%s is a folder", fileId)
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err = os.Remove(filePath); err != nil {
+		return err
+	}
+	delete(store.files, fileId)
+	if metaPath, err := store.metaPath(fileId, fileType); err == nil {
+		_ = os.Remove(metaPath)
+	}
+	for dir := filepath.Dir(filePath); dir != store.root(fileType) && dir != store.folder; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	store.writeIndex()
+	return nil
+}
+
+func (store *DiskStore) Open(fileId string, fileType string) (io.ReadCloser, int64, error) {
+	filePath, err := store.path(fileId, fileType)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	if fileInfo.IsDir() {
+		return nil, 0, errors.Wrapf(ErrInvalidFileId, "%s is a folder", fileId)
+	}
+
+	return openAtRest(filePath, store.masterKey)
+}
+
+// metaPath maps a file to its metadata, kept in the internal folder
+func (store *DiskStore) metaPath(fileId string, fileType string) (string, error) {
+	filePath, err := store.path(fileId, fileType)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(store.folder, filePath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(store.folder, internalDir, "meta", rel+".json"), nil
+}
+
+func (store *DiskStore) SaveMeta(fileId string, fileType string, meta FileMeta) error {
+	metaPath, err := store.metaPath(fileId, fileType)
+	if err != nil {
+		return err
+	}
+	if meta.IsEmpty() {
+		if err = os.Remove(metaPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(metaPath), 0700); err != nil {
+		return fmt.Errorf("cannot create folder: %w", err)
+	}
+	return ioutil.WriteFile(metaPath, b, 0600)
+}
+
+func (store *DiskStore) Meta(fileId string, fileType string) (meta FileMeta, err error) {
+	metaPath, err := store.metaPath(fileId, fileType)
+	if err != nil {
+		return
+	}
+	b, err := ioutil.ReadFile(metaPath)
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &meta)
+	return
 }
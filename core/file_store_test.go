@@ -0,0 +1,59 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestDiskStorePath(t *testing.T) {
+	root := t.TempDir()
+	store := NewDiskStore(root)
+
+	valid := []struct {
+		fileId   string
+		fileType string
+		want     string
+	}{
+		{"a.txt", "private", filepath.Join(root, "a.txt")},
+		{"a.txt", "public", filepath.Join(root, "public", "a.txt")},
+		{"tlsca/org1.crt", "public", filepath.Join(root, "public", "tlsca", "org1.crt")},
+		{"tlsca/../a.txt", "public", filepath.Join(root, "public", "a.txt")},
+		{"./a.txt", "private", filepath.Join(root, "a.txt")},
+		{"publicity/a.txt", "private", filepath.Join(root, "publicity", "a.txt")},
+	}
+	for _, tt := range valid {
+		got, err := store.path(tt.fileId, tt.fileType)
+		if err != nil {
+			t.Errorf("path(%q, %s): %v", tt.fileId, tt.fileType, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("path(%q, %s) = %s, want %s", tt.fileId, tt.fileType, got, tt.want)
+		}
+	}
+
+	invalid := []struct {
+		fileId   string
+		fileType string
+	}{
+		{"", "private"},
+		{".", "public"},
+		{"..", "private"},
+		{"../a.txt", "private"},
+		{"../../etc/passwd", "public"},
+		{"tlsca/../../a.txt", "public"},
+		{"/etc/passwd", "private"},
+		// the private files share the root with the public folder and the internal folder
+		{"public/a.txt", "private"},
+		{"public", "private"},
+		{internalDir + "/events.log", "private"},
+		{internalDir + "/../" + internalDir + "/replication.json", "private"},
+	}
+	for _, tt := range invalid {
+		if got, err := store.path(tt.fileId, tt.fileType); errors.Cause(err) != ErrInvalidFileId {
+			t.Errorf("path(%q, %s) = %s, %v; want ErrInvalidFileId", tt.fileId, tt.fileType, got, err)
+		}
+	}
+}
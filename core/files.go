@@ -0,0 +1,143 @@
+package core
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// requestFileType maps the file type of a request to a folder of the store, private unless public
+func requestFileType(requested string) string {
+	if requested != "public" {
+		return "private"
+	}
+	return "public"
+}
+
+// remoteFile describes a stored file, with the checksum and size of its content
+func (s *ServerGRPC) remoteFile(stored StoredFile, fileType string) (*RemoteFile, error) {
+	f, size, err := s.fileStore.Open(stored.FileId, fileType)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sum, err := checksum(f)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := stored.Mode
+	if meta, err := s.fileStore.Meta(stored.FileId, fileType); err == nil && meta.Mode != 0 {
+		mode = meta.Mode
+	}
+	return &RemoteFile{
+		Filename:   stored.FileId,
+		Size:       size,
+		Checksum:   sum,
+		Mode:       uint32(mode),
+		ModifiedAt: stored.ModTime.UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// storeError maps the errors of the file store to a status
+func storeError(fileId string, err error) error {
+	switch {
+	case os.IsNotExist(errors.Cause(err)):
+		return logError(status.Errorf(codes.NotFound, "%s not found", fileId))
+	case errors.Cause(err) == ErrInvalidFileId:
+		return logError(status.Errorf(codes.InvalidArgument, "%v", err))
+	}
+	return logError(status.Errorf(codes.Internal, "%s: %v", fileId, err))
+}
+
+// List returns the files of a folder, with their checksum; an unknown folder has no files. Private files are only
+// listed to the identities allowed to them, see authorizePrivate.
+func (s *ServerGRPC) List(ctx context.Context, req *ListRequest) (res *ListResponse, err error) {
+	if err = s.authorize(ctx, authOpDownload); err != nil {
+		return
+	}
+	fileType := requestFileType(req.GetFileType())
+	if fileType == "private" {
+		if err = s.authorizePrivate(ctx); err != nil {
+			return
+		}
+	}
+
+	stored, err := s.fileStore.List(req.GetPrefix(), fileType)
+	if os.IsNotExist(errors.Cause(err)) {
+		return &ListResponse{}, nil
+	}
+	if err != nil {
+		return nil, storeError(req.GetPrefix(), err)
+	}
+
+	res = &ListResponse{}
+	for _, f := range stored {
+		file, err := s.remoteFile(f, fileType)
+		if err != nil {
+			return nil, storeError(f.FileId, err)
+		}
+		res.Files = append(res.Files, file)
+	}
+	return res, nil
+}
+
+func (s *ServerGRPC) Stat(ctx context.Context, req *StatRequest) (res *RemoteFile, err error) {
+	if err = s.authorize(ctx, authOpDownload); err != nil {
+		return
+	}
+	fileType := requestFileType(req.GetFileType())
+	if fileType == "private" {
+		if err = s.authorizePrivate(ctx); err != nil {
+			return
+		}
+	}
+
+	stored, err := s.fileStore.Stat(req.GetFilename(), fileType)
+	if err != nil {
+		return nil, storeError(req.GetFilename(), err)
+	}
+	if res, err = s.remoteFile(stored, fileType); err != nil {
+		return nil, storeError(req.GetFilename(), err)
+	}
+	return
+}
+
+// Delete removes a file; uploaders may delete, as they may overwrite
+func (s *ServerGRPC) Delete(ctx context.Context, req *DeleteRequest) (res *RemoteFile, err error) {
+	fileType := requestFileType(req.GetFileType())
+	defer func() {
+		rec := AuditRecord{Operation: auditOpDelete, Filename: req.GetFilename(), FileType: fileType}
+		if res != nil {
+			rec.Size, rec.Checksum = res.GetSize(), res.GetChecksum()
+		}
+		s.audit(ctx, rec, err)
+	}()
+
+	if err = s.authorize(ctx, authOpUpload); err != nil {
+		return
+	}
+	if err = s.authorizeMSPUpload(ctx, UploadedFile{Filename: req.GetFilename(), FileType: fileType}, nil); err != nil {
+		return
+	}
+	stored, err := s.fileStore.Stat(req.GetFilename(), fileType)
+	if err != nil {
+		return nil, storeError(req.GetFilename(), err)
+	}
+	file, err := s.remoteFile(stored, fileType)
+	if err != nil {
+		return nil, storeError(req.GetFilename(), err)
+	}
+	if err = s.fileStore.Delete(req.GetFilename(), fileType); err != nil {
+		return nil, storeError(req.GetFilename(), err)
+	}
+	s.notifyDeleted(fileType, req.GetFilename())
+	log.Printf("file deleted (%s) : %s", fileType, req.GetFilename())
+	s.webhook(ctx, webhookDeleted, fileType, req.GetFilename(), file.GetSize(), file.GetChecksum())
+	return file, nil
+}
@@ -2,28 +2,55 @@ package core
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"google.golang.org/grpc/codes"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"filippo.io/age"
 	"github.com/dustin/go-humanize"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 
 	_ "google.golang.org/grpc/encoding/gzip"
 )
 
 type Client interface {
 	UploadFile(ctx context.Context, f string) (stats Stats, err error)
-	DownloadFile(f string) (err error)
+	DownloadFile(f string, opts DownloadOptions) (dest string, err error)
+	UploadReader(ctx context.Context, content io.Reader, fileName string) (stats Stats, err error)
+	DownloadTo(fileName string, w io.Writer) (err error)
 	Check(ctx context.Context, label string, counter int) (pingStats PingStats, err error)
+	AuditTail(ctx context.Context, fromSeq uint64, follow bool, fn func(event *AuditEvent) error) (err error)
+	Share(ctx context.Context, fileName string, ttl time.Duration) (res *ShareResponse, err error)
+	RevokeShare(ctx context.Context, id string) (err error)
+	ListPending(ctx context.Context) (files []*PendingFile, err error)
+	Review(ctx context.Context, id string, approve bool, reason string) (file *PendingFile, err error)
+	UploadMSP(ctx context.Context, dir string, org string) (stats Stats, skipped []string, err error)
+	DownloadMSP(org string, outDir string, force bool) (err error)
+	UploadArchive(ctx context.Context, files []ArchiveFile, prefix string) (stats Stats, err error)
+	DownloadPrefix(prefix string, outDir string, force bool) (err error)
+	UploadFiles(ctx context.Context, paths []string, folder string, opts BatchOptions) (summary BatchSummary)
+	DownloadFiles(ctx context.Context, fileNames []string, dl DownloadOptions, opts BatchOptions) (summary BatchSummary)
+	List(ctx context.Context, prefix string) (files []*RemoteFile, err error)
+	Stat(ctx context.Context, fileName string) (file *RemoteFile, err error)
+	Delete(ctx context.Context, fileName string) (file *RemoteFile, err error)
+	SyncPlan(ctx context.Context, opts SyncOptions) (plan []SyncAction, err error)
+	Sync(ctx context.Context, opts SyncOptions, plan []SyncAction) (summary BatchSummary)
+	Watch(ctx context.Context, opts WatchOptions) (err error)
+	Subscribe(ctx context.Context, prefix string, fromSeq uint64, fn func(event *FileEvent) error) (err error)
+	ReplicationStatus(ctx context.Context) (peers []*PeerStatus, err error)
 	Close()
 }
 
@@ -33,15 +60,60 @@ type ClientGRPC struct {
 	chunkSize       int
 	filename        string
 	usePublicFolder bool
+	shareToken      string
+	quiet           bool
+	progress        io.Writer
+	retryPolicy     RetryPolicy
+	timeout         time.Duration
+	maxDownloadSize int64
+	rateLimiter     *rate.Limiter
+	recipients      []namedRecipient
+	identities      []age.Identity
+	signWith        string
+	signerCert      []byte
+	signatureFile   string
+	verify          bool
+	trustStore      *x509.CertPool
 }
 
 type ClientGRPCConfig struct {
-	Address            string
-	RootCertificate    string
+	Address         string
+	RootCertificate string
+	// Certificate and Key are the optional client certificate, presented to the server as TLS identity
+	Certificate string
+	Key         string
+	// Token is sent as "authorization: Bearer" metadata, e.g. when a proxy terminates tls and drops client certificates
+	Token string
+	// TLSPolicy restricts the tls versions, cipher suites and curves offered to the server
+	TLSPolicy          TLSPolicy
 	Compress           bool
 	ServerNameOverride string
 	Filename           string
 	UsePublicFolder    bool
+	// ShareToken downloads with a share token instead of the download permission
+	ShareToken string
+	// LimitRate caps uploads and downloads, in bytes per second; 0 is unlimited
+	LimitRate int64
+	// MaxDownloadSize fails the downloads of larger files, before they are read whole; 0 is unlimited
+	MaxDownloadSize int64
+	// Quiet turns off the progress of downloads, e.g. of concurrent ones
+	Quiet bool
+	// Progress receives the progress of downloads, and their messages; stdout when nil
+	Progress io.Writer
+	// Retry retries the operations failing with a transient status; Timeout bounds each operation, with its retries
+	Retry   RetryPolicy
+	Timeout time.Duration
+	// EncryptTo are recipient files: uploads are encrypted client-side, and the server only stores ciphertext
+	EncryptTo []string
+	// DecryptWith is the key file decrypting downloads
+	DecryptWith string
+	// SignerCert is sent with a detached signature of uploads: made with the SignWith key, or read from SignatureFile
+	SignerCert    string
+	SignWith      string
+	SignatureFile string
+	// Verify checks the signature of downloads, and the signer against TrustStore when set
+	Verify     bool
+	TrustStore []string
 }
 
 func NewClientGRPC(cfg ClientGRPCConfig) (c ClientGRPC, err error) {
@@ -53,6 +125,55 @@ func NewClientGRPC(cfg ClientGRPCConfig) (c ClientGRPC, err error) {
 	c.chunkSize = 1 << 12
 	c.usePublicFolder = cfg.UsePublicFolder
 	c.filename = cfg.Filename
+	c.shareToken = cfg.ShareToken
+	c.quiet = cfg.Quiet
+	c.progress = cfg.Progress
+	if c.progress == nil {
+		c.progress = os.Stdout
+	}
+	c.retryPolicy = cfg.Retry
+	c.timeout = cfg.Timeout
+	c.maxDownloadSize = cfg.MaxDownloadSize
+	if cfg.LimitRate > 0 {
+		c.rateLimiter = rate.NewLimiter(rate.Limit(cfg.LimitRate), int(cfg.LimitRate))
+	}
+	if len(cfg.EncryptTo) > 0 {
+		if c.recipients, err = readRecipients(cfg.EncryptTo); err != nil {
+			return
+		}
+	}
+	if cfg.DecryptWith != "" {
+		if c.identities, err = readIdentities(cfg.DecryptWith); err != nil {
+			return
+		}
+	}
+	if (cfg.SignWith != "" || cfg.SignatureFile != "") && cfg.SignerCert == "" {
+		err = errors.New("signing requires the signer certificate")
+		return
+	}
+	if cfg.SignatureFile != "" && len(cfg.EncryptTo) > 0 {
+		err = errors.New("a signature file signs the plaintext: use the signing key to sign encrypted uploads")
+		return
+	}
+	if cfg.SignerCert != "" {
+		if c.signerCert, err = ioutil.ReadFile(cfg.SignerCert); err != nil {
+			err = errors.Wrapf(err, "failed to read signer certificate %s", cfg.SignerCert)
+			return
+		}
+	}
+	c.signWith = cfg.SignWith
+	c.signatureFile = cfg.SignatureFile
+	c.verify = cfg.Verify
+	if c.verify && len(cfg.TrustStore) == 0 {
+		// without it, any self-signed signer certificate sent by the server would verify
+		err = errors.New("verify requires a trust store, to check the signer certificate")
+		return
+	}
+	if len(cfg.TrustStore) > 0 {
+		if c.trustStore, err = loadTrustStore(cfg.TrustStore); err != nil {
+			return
+		}
+	}
 
 	if cfg.Address == "" {
 		err = errors.Errorf("address must be specified")
@@ -64,9 +185,8 @@ func NewClientGRPC(cfg ClientGRPCConfig) (c ClientGRPC, err error) {
 	}
 
 	if cfg.RootCertificate != "" {
-		grpcCreds, err = credentials.NewClientTLSFromFile(cfg.RootCertificate, cfg.ServerNameOverride)
+		grpcCreds, err = clientTransportCredentials(cfg)
 		if err != nil {
-			err = errors.Wrapf(err, "failed create grpc tls client via root-cert %s", cfg.RootCertificate)
 			return
 		}
 
@@ -80,6 +200,20 @@ func NewClientGRPC(cfg ClientGRPCConfig) (c ClientGRPC, err error) {
 		//return
 	}
 
+	if cfg.Token != "" {
+		grpcOpts = append(grpcOpts, grpc.WithPerRPCCredentials(tokenCredentials{token: cfg.Token}))
+	}
+
+	// unary calls are retried by grpc, following the service config, or else by the client
+	serviceConfig, err := serviceConfig(cfg.Retry, cfg.Timeout)
+	if err != nil {
+		return
+	}
+	grpcOpts = append(grpcOpts, grpc.WithDefaultServiceConfig(serviceConfig))
+	if !strings.EqualFold(os.Getenv(grpcRetryEnv), "on") && cfg.Retry.MaxAttempts > 1 {
+		grpcOpts = append(grpcOpts, grpc.WithUnaryInterceptor(c.retryUnary))
+	}
+
 	c.conn, err = grpc.Dial(cfg.Address, grpcOpts...)
 	if err != nil {
 		err = errors.Wrapf(err, "failed to start grpc connection with address %s", cfg.Address)
@@ -91,13 +225,61 @@ func NewClientGRPC(cfg ClientGRPCConfig) (c ClientGRPC, err error) {
 	return
 }
 
+func clientTransportCredentials(cfg ClientGRPCConfig) (grpcCreds credentials.TransportCredentials, err error) {
+	pem, err := ioutil.ReadFile(cfg.RootCertificate)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read root-cert %s", cfg.RootCertificate)
+		return
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		err = errors.Errorf("no certificate found in root-cert %s", cfg.RootCertificate)
+		return
+	}
+
+	tlsConfig := &tls.Config{
+		RootCAs:    pool,
+		ServerName: cfg.ServerNameOverride,
+	}
+	cfg.TLSPolicy.apply(tlsConfig)
+
+	if cfg.Certificate != "" || cfg.Key != "" {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(cfg.Certificate, cfg.Key)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to load client cert %s and key %s", cfg.Certificate, cfg.Key)
+			return
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return credentials.NewTLS(tlsConfig), nil
+}
+
 func (c *ClientGRPC) UploadFile(ctx context.Context, f string) (stats Stats, err error) {
+	if f == "-" {
+		return c.UploadReader(ctx, os.Stdin, c.filename)
+	}
+	return c.uploadPath(ctx, f, c.filename)
+}
+
+// UploadReader uploads content of unknown size as fileName, e.g. stdin; the server enforces its size limit
+func (c *ClientGRPC) UploadReader(ctx context.Context, content io.Reader, fileName string) (stats Stats, err error) {
+	if fileName == "" {
+		err = errors.New("the file name must be set, to upload a stream")
+		return
+	}
+	fileType := "private"
+	if c.usePublicFolder {
+		fileType = "public"
+	}
+	return c.upload(ctx, "stdin", fileName, fileType, 0, content)
+}
+
+// uploadPath uploads the local file f as fileName
+func (c *ClientGRPC) uploadPath(ctx context.Context, f string, fileName string) (stats Stats, err error) {
 	var (
-		writing  = true
-		buf      []byte
-		n        int
 		file     *os.File
-		status   *UploadStatus
 		fileType string
 	)
 
@@ -107,12 +289,6 @@ func (c *ClientGRPC) UploadFile(ctx context.Context, f string) (stats Stats, err
 		return
 	}
 
-	if fi.Size() > maxFileSize {
-		fmt.Println("Too big file size to send (max 4MB)")
-		err = errors.Wrapf(err, "too big file size to send (max 4M)")
-		return
-	}
-
 	file, err = os.Open(f)
 	if err != nil {
 		err = errors.Wrapf(err, "failed to open file %s", f)
@@ -120,9 +296,108 @@ func (c *ClientGRPC) UploadFile(ctx context.Context, f string) (stats Stats, err
 	}
 	defer file.Close()
 
+	if c.usePublicFolder == true {
+		fileType = "public"
+	} else {
+		fileType = "private"
+	}
+	return c.upload(ctx, f, fileName, fileType, fi.Mode().Perm(), file)
+}
+
+// upload streams content to the server as fileName; source names the content in errors, and mode is restored
+// on download, unless 0
+func (c *ClientGRPC) upload(ctx context.Context, source string, fileName string, fileType string, mode os.FileMode,
+	content io.Reader) (stats Stats, err error) {
+	var (
+		encryption *Encryption
+		signature  *Signature
+	)
+
+	if len(c.recipients) > 0 {
+		var encrypted *bytes.Buffer
+		if encrypted, err = encryptTo(content, c.recipients); err != nil {
+			return
+		}
+		content = bytes.NewReader(encrypted.Bytes())
+		encryption = &Encryption{Format: encryptionFormatAge}
+		for _, recipient := range c.recipients {
+			encryption.Recipients = append(encryption.Recipients, recipient.name)
+		}
+	}
+
+	if c.signerCert != nil {
+		if signature, content, err = c.sign(content); err != nil {
+			return
+		}
+	}
+
+	return c.send(ctx, source, &UploadFileInfo{
+		Filename:   fileName,
+		FileType:   fileType,
+		Encryption: encryption,
+		Signature:  signature,
+		Mode:       uint32(mode),
+	}, content)
+}
+
+// replayBufferSize bounds the memory held to retry the upload of a stream, e.g. stdin
+const replayBufferSize = 16 << 20
+
+// send uploads content, retried as the client is configured to. Seekable content, e.g. a file, is rewound for each
+// attempt. Other streams are buffered to be replayed, up to replayBufferSize; a larger stream is sent once.
+func (c *ClientGRPC) send(ctx context.Context, source string, info *UploadFileInfo,
+	content io.Reader) (stats Stats, err error) {
+	if seeker, ok := content.(io.Seeker); ok {
+		if start, seekErr := seeker.Seek(0, io.SeekCurrent); seekErr == nil {
+			err = c.retry(ctx, "upload of "+source, func(ctx context.Context) (err error) {
+				if _, err = seeker.Seek(start, io.SeekStart); err != nil {
+					return errors.Wrapf(err, "failed to rewind %s", source)
+				}
+				stats, err = c.sendOnce(ctx, source, info, content)
+				return
+			})
+			return
+		}
+	}
+
+	head, err := ioutil.ReadAll(io.LimitReader(content, replayBufferSize+1))
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read %s", source)
+		return
+	}
+	if len(head) <= replayBufferSize {
+		err = c.retry(ctx, "upload of "+source, func(ctx context.Context) (err error) {
+			stats, err = c.sendOnce(ctx, source, info, bytes.NewReader(head))
+			return
+		})
+		return
+	}
+
+	if c.retryPolicy.MaxAttempts > 1 {
+		fmt.Fprintf(os.Stderr, "%s exceeds %s: it is sent once, without retries\n", source,
+			humanize.IBytes(replayBufferSize))
+	}
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	return c.sendOnce(ctx, source, info, io.MultiReader(bytes.NewReader(head), content))
+}
+
+// sendOnce streams the file info, then content in chunks
+func (c *ClientGRPC) sendOnce(ctx context.Context, source string, info *UploadFileInfo,
+	content io.Reader) (stats Stats, err error) {
+	var (
+		writing = true
+		buf     []byte
+		n       int
+		status  *UploadStatus
+	)
+
 	stream, err := c.client.Upload(ctx)
 	if err != nil {
-		err = errors.Wrapf(err, "failed to create upload stream for file %s", f)
+		err = errors.Wrapf(err, "failed to create upload stream for file %s", source)
 		return
 	}
 	defer stream.CloseSend()
@@ -130,17 +405,9 @@ func (c *ClientGRPC) UploadFile(ctx context.Context, f string) (stats Stats, err
 	stats.StartedAt = time.Now()
 
 	// file info
-	if c.usePublicFolder == true {
-		fileType = "public"
-	} else {
-		fileType = "private"
-	}
 	req := &Chunk{
 		Data: &Chunk_Info{
-			Info: &UploadFileInfo{
-				Filename: c.filename,
-				FileType: fileType,
-			},
+			Info: info,
 		},
 	}
 
@@ -153,7 +420,7 @@ func (c *ClientGRPC) UploadFile(ctx context.Context, f string) (stats Stats, err
 	// binary data
 	buf = make([]byte, c.chunkSize)
 	for writing {
-		n, err = file.Read(buf)
+		n, err = content.Read(buf)
 		if err != nil {
 			if err == io.EOF {
 				writing = false
@@ -164,11 +431,22 @@ func (c *ClientGRPC) UploadFile(ctx context.Context, f string) (stats Stats, err
 			return
 		}
 
+		if c.rateLimiter != nil {
+			if err = waitBytes(ctx, c.rateLimiter, n); err != nil {
+				return
+			}
+		}
+
 		err = stream.Send(&Chunk{
 			Data: &Chunk_Content{
 				Content: buf[:n],
 			},
 		})
+		if err == io.EOF {
+			// the server ended the stream, e.g. over its size limit: its status follows
+			writing = false
+			continue
+		}
 		if err != nil {
 			err = errors.Wrapf(err, "failed to send chunk via stream")
 			return
@@ -179,6 +457,10 @@ func (c *ClientGRPC) UploadFile(ctx context.Context, f string) (stats Stats, err
 
 	status, err = stream.CloseAndRecv()
 	if err != nil {
+		if details := statusDetails(err); details != "" {
+			err = errors.Wrapf(err, "upload rejected:\n%s\n", details)
+			return
+		}
 		err = errors.Wrapf(err, "failed to receive upstream status response")
 		return
 	}
@@ -187,45 +469,250 @@ func (c *ClientGRPC) UploadFile(ctx context.Context, f string) (stats Stats, err
 		err = errors.Errorf("upload filed - msg: %s", status.Message)
 		return
 	}
+	stats.PendingID = status.PendingId
 	return
 }
 
-func (c *ClientGRPC) DownloadFile(fileName string) (err error) {
+// DownloadOptions choose where downloads are written
+type DownloadOptions struct {
+	// Output is the path of the file. Otherwise, the remote path is created under OutDir, or the current folder.
+	Output string
+	OutDir string
+	// Overwrite replaces an existing file, and NoClobber keeps it, skipping the download; else an existing file fails
+	Overwrite bool
+	NoClobber bool
+}
+
+// ErrFileExists is returned by DownloadFile with NoClobber, when the file exists and is kept
+var ErrFileExists = errors.New("file exists")
+
+// DownloadFile downloads fileName, and writes it as opts choose, with the mode of the uploaded file. It returns the
+// path written.
+func (c *ClientGRPC) DownloadFile(fileName string, opts DownloadOptions) (dest string, err error) {
+	if dest, err = downloadPath(fileName, opts); err != nil {
+		return
+	}
+	if _, err = os.Lstat(dest); err == nil {
+		if opts.NoClobber {
+			return dest, ErrFileExists
+		}
+		if !opts.Overwrite {
+			return dest, errors.Errorf("%s already exists: use --overwrite to replace it, or --no-clobber to keep it", dest)
+		}
+	}
+
+	data, mode, err := c.download(fileName)
+	if err != nil {
+		return
+	}
+	return dest, writeFileAtomic(dest, data, mode)
+}
+
+// downloadPath returns where the remote file fileName is written. The folders of the remote path are created, and
+// must not be symlinks, so that a download never lands outside of the output folder.
+func downloadPath(fileName string, opts DownloadOptions) (string, error) {
+	if opts.Output != "" {
+		return opts.Output, os.MkdirAll(filepath.Dir(opts.Output), 0755)
+	}
+	name, err := cleanArchivePath(filepath.ToSlash(fileName))
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot write %s", fileName)
+	}
+	dir := opts.OutDir
+	if dir == "" {
+		dir = "."
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return "", errors.Errorf("output folder %s does not exist", dir)
+	}
+	parts := strings.Split(name, "/")
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			if err = os.Mkdir(dir, 0755); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if !fi.IsDir() {
+			return "", errors.Errorf("cannot write %s: %s is not a folder", fileName, dir)
+		}
+	}
+	return filepath.Join(dir, parts[len(parts)-1]), nil
+}
+
+// writeFileAtomic writes data as path with mode, defaulting to 0644; group and others never get write access.
+// The file is written aside then renamed, so that a failed download leaves no partial file.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) (err error) {
+	if mode == 0 {
+		mode = 0644
+	}
+	mode = mode&0755 | 0400
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// DownloadTo writes the content of fileName to w, e.g. stdout. Nothing is written, unless the download completes
+// and passes the checks of the client.
+func (c *ClientGRPC) DownloadTo(fileName string, w io.Writer) (err error) {
+	data, _, err := c.download(fileName)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return
+}
+
+// download returns the content of fileName, verified and decrypted when the client is configured to, and its mode
+func (c *ClientGRPC) download(fileName string) (data []byte, mode os.FileMode, err error) {
+	err = c.retry(context.Background(), "download of "+fileName, func(ctx context.Context) (err error) {
+		data, mode, err = c.downloadOnce(ctx, fileName)
+		return
+	})
+	return
+}
+
+func (c *ClientGRPC) downloadOnce(ctx context.Context, fileName string) (data []byte, mode os.FileMode, err error) {
+	content, header, err := c.fetch(ctx, fileName)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.verify {
+		if err := c.verifySignature(content, header.GetSignature()); err != nil {
+			return nil, 0, err
+		}
+	}
+	data, err = c.decrypt(content)
+	return data, os.FileMode(header.GetMode()).Perm(), err
+}
+
+// fetch downloads the content of fileName, as stored, and its header: mode, signature and encryption
+func (c *ClientGRPC) fetch(ctx context.Context, fileName string) (data []byte, header *FileResponse, err error) {
 	req := &FileRequest{
 		Filename: fileName,
+		Token:    c.shareToken,
 	}
-	stream, err := c.client.Download(context.Background(), req)
+	stream, err := c.client.Download(ctx, req)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	var downloaded int64
 	var buffer bytes.Buffer
+	header = &FileResponse{}
 
 	for {
 		res, err := stream.Recv()
 		if err == io.EOF {
-			if err := ioutil.WriteFile(fileName, buffer.Bytes(), 0644); err != nil {
-				return err
-			}
-			break
+			return buffer.Bytes(), header, nil
 		}
 		if err != nil {
-			buffer.Reset()
-			return err
+			return nil, nil, err
+		}
+		if res.GetSignature() != nil {
+			header.Signature = res.GetSignature()
+		}
+		if res.GetEncryption() != nil {
+			header.Encryption = res.GetEncryption()
+		}
+		if res.GetMode() != 0 {
+			header.Mode = res.GetMode()
 		}
 		shard := res.GetShard()
 		shardSize := len(shard)
 		downloaded += int64(shardSize)
+		if c.maxDownloadSize > 0 && downloaded > c.maxDownloadSize {
+			return nil, nil, status.Errorf(codes.InvalidArgument, "%s is too large: more than %d bytes", fileName,
+				c.maxDownloadSize)
+		}
+
+		if c.rateLimiter != nil {
+			if err := waitBytes(stream.Context(), c.rateLimiter, shardSize); err != nil {
+				return nil, nil, err
+			}
+		}
 
 		buffer.Write(shard)
-		fmt.Printf("\r%s", strings.Repeat(" ", 25))
-		fmt.Printf("\r%s downloaded", humanize.Bytes(uint64(downloaded)))
+		if !c.quiet {
+			fmt.Fprintf(c.progress, "\r%s", strings.Repeat(" ", 25))
+			fmt.Fprintf(c.progress, "\r%s downloaded", humanize.Bytes(uint64(downloaded)))
+		}
+	}
+}
+
+// sign returns the detached signature of content, as uploaded, and the content to upload
+func (c *ClientGRPC) sign(content io.Reader) (signature *Signature, data io.Reader, err error) {
+	b, err := ioutil.ReadAll(content)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to read file")
 	}
 
+	signature = &Signature{Certificate: c.signerCert}
+	if c.signatureFile != "" {
+		signature.Signature, err = ioutil.ReadFile(c.signatureFile)
+		err = errors.Wrapf(err, "failed to read signature %s", c.signatureFile)
+	} else {
+		signature.Signature, err = signDetached(b, c.signWith)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return signature, bytes.NewReader(b), nil
+}
+
+// verifySignature checks a downloaded file against its detached signature, before it is written
+func (c *ClientGRPC) verifySignature(data []byte, signature *Signature) error {
+	if signature == nil {
+		return errors.New("\nverification failed: the file is not signed")
+	}
+	signer, err := verifySignature(data, signature, c.trustStore)
+	if err != nil {
+		return errors.Wrapf(err, "\nverification failed")
+	}
+	fmt.Fprintf(c.progress, "\nsignature verified: %s\n", signer)
 	return nil
 }
 
+// decrypt returns the plaintext of a downloaded file, when the client has a key; other files are returned as is
+func (c *ClientGRPC) decrypt(data []byte) ([]byte, error) {
+	if !isAgeEncrypted(data) {
+		return data, nil
+	}
+	if len(c.identities) == 0 {
+		fmt.Fprintln(os.Stderr, "\nwarning: the file is encrypted; use --decrypt-with to decrypt it")
+		return data, nil
+	}
+
+	r, err := age.Decrypt(bytes.NewReader(data), c.identities...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt")
+	}
+	plaintext, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt")
+	}
+	return plaintext, nil
+}
+
 func (c *ClientGRPC) Check(ctx context.Context, label string, counter int) (pingStats PingStats, err error) {
 	var res *HealthCheckResponse
 	req := new(HealthCheckRequest)
@@ -243,6 +730,7 @@ func (c *ClientGRPC) Check(ctx context.Context, label string, counter int) (ping
 
 	if err == nil {
 		pingStats.serverReceivedAt = res.GetReceivedAt()
+		pingStats.warning = res.GetWarning()
 
 		if res.GetStatus() == HealthCheckResponse_SERVING {
 			pingStats.ok = true
@@ -266,6 +754,178 @@ func (c *ClientGRPC) Check(ctx context.Context, label string, counter int) (ping
 	return pingStats, err
 }
 
+// AuditTail calls fn for every audit record streamed by the server, until the stream ends or fn fails. Retries resume
+// after the last record received; a followed tail has no deadline.
+func (c *ClientGRPC) AuditTail(ctx context.Context, fromSeq uint64, follow bool, fn func(event *AuditEvent) error) (err error) {
+	if !follow && c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	err = c.retryPolicy.do(ctx, "audit tail", func(ctx context.Context) error {
+		stream, err := c.client.AuditTail(ctx, &AuditTailRequest{
+			FromSeq: fromSeq,
+			Follow:  follow,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to create audit tail stream")
+		}
+
+		for {
+			event, err := stream.Recv()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return errors.Wrapf(err, "failed to receive audit record")
+			}
+			if err = fn(event); err != nil {
+				return err
+			}
+			fromSeq = event.GetSeq() + 1
+		}
+	})
+	return
+}
+
+// Subscribe streams the change events of the files of the folder prefix, to fn, until ctx is done. Events from fromSeq
+// onward are replayed first (fromSeq 0 streams only new events); after a reconnection, the stream resumes after the last
+// event. The retries start over once events were received again.
+func (c *ClientGRPC) Subscribe(ctx context.Context, prefix string, fromSeq uint64, fn func(event *FileEvent) error) (err error) {
+	for {
+		received := false
+		err = c.subscribe(ctx, prefix, &fromSeq, func(event *FileEvent) error {
+			received = true
+			return fn(event)
+		})
+		if err == nil || !received || !c.retryPolicy.retryable(err) || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// subscribe streams the events until they end, or the retries run out; fromSeq follows the received events
+func (c *ClientGRPC) subscribe(ctx context.Context, prefix string, fromSeq *uint64, fn func(event *FileEvent) error) error {
+	return c.retryPolicy.do(ctx, "subscribe", func(ctx context.Context) error {
+		stream, err := c.client.Subscribe(ctx, &SubscribeRequest{
+			Prefix:   prefix,
+			FileType: c.fileType(),
+			FromSeq:  *fromSeq,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to subscribe to %s", prefix)
+		}
+
+		for {
+			event, err := stream.Recv()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return errors.Wrapf(err, "failed to receive event")
+			}
+			if err = fn(event); err != nil {
+				return err
+			}
+			*fromSeq = event.GetSeq() + 1
+		}
+	})
+}
+
+// Share requests a token granting download access to the current version of fileName, for ttl
+func (c *ClientGRPC) Share(ctx context.Context, fileName string, ttl time.Duration) (res *ShareResponse, err error) {
+	fileType := "private"
+	if c.usePublicFolder {
+		fileType = "public"
+	}
+
+	res, err = c.client.Share(ctx, &ShareRequest{
+		Filename:   fileName,
+		FileType:   fileType,
+		TtlSeconds: int64(ttl / time.Second),
+	})
+	if err != nil {
+		err = errors.Wrapf(err, "failed to share %s", fileName)
+	}
+	return
+}
+
+func (c *ClientGRPC) RevokeShare(ctx context.Context, id string) (err error) {
+	if _, err = c.client.RevokeShare(ctx, &RevokeShareRequest{Id: id}); err != nil {
+		err = errors.Wrapf(err, "failed to revoke share token %s", id)
+	}
+	return
+}
+
+func (c *ClientGRPC) ListPending(ctx context.Context) (files []*PendingFile, err error) {
+	res, err := c.client.ListPending(ctx, &ListPendingRequest{})
+	if err != nil {
+		err = errors.Wrapf(err, "failed to list pending files")
+		return
+	}
+	return res.GetFiles(), nil
+}
+
+// Review approves or rejects a pending file
+func (c *ClientGRPC) Review(ctx context.Context, id string, approve bool, reason string) (file *PendingFile, err error) {
+	var res *ReviewResponse
+	req := &ReviewRequest{Id: id, Reason: reason}
+	if approve {
+		res, err = c.client.Approve(ctx, req)
+	} else {
+		res, err = c.client.Reject(ctx, req)
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "failed to review pending file %s", id)
+		return
+	}
+	return res.GetFile(), nil
+}
+
+// fileType is the folder of the files of the client
+func (c *ClientGRPC) fileType() string {
+	if c.usePublicFolder {
+		return "public"
+	}
+	return "private"
+}
+
+// List returns the files of the folder prefix, recursively, with their checksum
+func (c *ClientGRPC) List(ctx context.Context, prefix string) (files []*RemoteFile, err error) {
+	res, err := c.client.List(ctx, &ListRequest{Prefix: prefix, FileType: c.fileType()})
+	if err != nil {
+		err = errors.Wrapf(err, "failed to list %s", prefix)
+		return
+	}
+	return res.GetFiles(), nil
+}
+
+func (c *ClientGRPC) Stat(ctx context.Context, fileName string) (file *RemoteFile, err error) {
+	if file, err = c.client.Stat(ctx, &StatRequest{Filename: fileName, FileType: c.fileType()}); err != nil {
+		err = errors.Wrapf(err, "failed to stat %s", fileName)
+	}
+	return
+}
+
+// Delete removes fileName from the server, and returns what it was
+func (c *ClientGRPC) Delete(ctx context.Context, fileName string) (file *RemoteFile, err error) {
+	if file, err = c.client.Delete(ctx, &DeleteRequest{Filename: fileName, FileType: c.fileType()}); err != nil {
+		err = errors.Wrapf(err, "failed to delete %s", fileName)
+	}
+	return
+}
+
+// ReplicationStatus reports the replication of the server with each of its peers
+func (c *ClientGRPC) ReplicationStatus(ctx context.Context) (peers []*PeerStatus, err error) {
+	res, err := c.client.ReplicationStatus(ctx, &ReplicationStatusRequest{})
+	if err != nil {
+		err = errors.Wrapf(err, "failed to get replication status")
+		return
+	}
+	return res.GetPeers(), nil
+}
+
 func (c *ClientGRPC) Close() {
 	if c.conn != nil {
 		_ = c.conn.Close()
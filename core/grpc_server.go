@@ -2,15 +2,20 @@ package core
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
 	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"io"
 	"log"
 	"net"
 	"os"
-	"path/filepath"
 	"strconv"
 	"sync"
 	"time"
@@ -22,13 +27,10 @@ import (
 	_ "google.golang.org/grpc/encoding/gzip"
 )
 
-// 4M
-const maxFileSize = 1 << 22
-
-// 4096
+// 4M, default max file size
 // upload location: fileserver
 // download location: fileserver/public
-const filesDir = "fileserver/public"
+const maxFileSize = 1 << 22
 
 type Server interface {
 	Listen() (err error)
@@ -37,11 +39,38 @@ type Server interface {
 
 type ServerGRPC struct {
 	fileStore   FileStore
+	auditLog    *AuditLog
+	eventLog    *EventLog
+	webhooks    *webhookSender
+	replicator  *replicator
 	server      *grpc.Server
-	port        int
+	address     string
 	certificate string
 	key         string
-	mu          sync.Mutex
+	tlsPairs    []TLSPair
+	tlsPolicy   TLSPolicy
+	clientCA    string
+	clientAuth  tls.ClientAuthType
+	// certReloader is set, once Listen serves tls
+	certReloader       *certReloader
+	certReloadInterval time.Duration
+	certExpiryWarning  time.Duration
+	stop               chan struct{}
+	maxFileSize        int64
+	authPolicy         AuthPolicy
+	tokenAuth          *tokenAuthenticator
+	shareSigner        *shareSigner
+	limiter            *limiter
+	validators         []Validator
+	scanner            *contentScanner
+	pending            *pendingStore
+	masterKey          *MasterKey
+	trustStore         *x509.CertPool
+	requireSignature   bool
+	mspIdentities      map[string][]string
+	maxShareTTL        time.Duration
+	debug              bool
+	mu                 sync.Mutex
 	// statusMap stores the serving status of the services this Server monitors.
 	statusMap map[string]HealthCheckResponse_ServingStatus
 }
@@ -49,20 +78,144 @@ type ServerGRPC struct {
 type ServerGRPCConfig struct {
 	Certificate string
 	Key         string
-	Port        int
+	// TLSPairs are additional certificates, presented to clients asking for their names through SNI
+	TLSPairs  []TLSPair
+	TLSPolicy TLSPolicy
+	// ClientCA is the CA bundle used to verify client certificates; the verified subject is recorded as TLS identity
+	ClientCA string
+	// ClientAuth applies when ClientCA is set; tls.NoClientCert requests no client certificate, even so
+	ClientAuth tls.ClientAuthType
+	// CertReloadInterval is how often the cert, key and client ca files are checked for rotation; default 30s
+	CertReloadInterval time.Duration
+	// CertExpiryWarning makes the health check warn, when the served cert expires within this duration; default 7 days
+	CertExpiryWarning time.Duration
+	// Address takes precedence over Port, e.g. "0.0.0.0:1313"
+	Address string
+	Port    int
+	// MaxFileSize defaults to 4M
+	MaxFileSize int64
+	AuthPolicy  AuthPolicy
+	// TokenAuth enables "authorization: Bearer" metadata as an alternative to client certificates
+	TokenAuth TokenAuthConfig
+	// ShareKey enables signed download links: a PEM ed25519 private key, or a file of at least 32 random bytes (hmac)
+	ShareKey string
+	// ShareDenylist lists the ids of revoked share tokens
+	ShareDenylist string
+	// MaxShareTTL caps the validity of share tokens; default 7 days
+	MaxShareTTL time.Duration
+	// Limits are the per client rate limits and the caps on concurrent transfers
+	Limits LimitConfig
+	// Validators inspect every upload before it is saved
+	Validators []Validator
+	// Scan runs an external command on every staged upload, when its Command is set
+	Scan ScanConfig
+	// PendingDir enables the approval of public uploads: they are held there until an admin approves them
+	PendingDir string
+	// MasterKey encrypts pending and quarantined files at rest; the file store is encrypted separately
+	MasterKey *MasterKey
+	// TrustStore verifies the signer of signed uploads; without it, signed uploads are refused
+	TrustStore *x509.CertPool
+	// RequireSignature refuses unsigned uploads
+	RequireSignature bool
+	// MSPIdentities are the identities allowed to replace the msp bundle of an org, by org, besides its members
+	MSPIdentities map[string][]string
+	// Debug logs every received chunk and ping
+	Debug bool
+	// AuditLog is optional; when nil, file operations are not audited
+	AuditLog *AuditLog
+	// EventLog is optional; when nil, changes of files are not streamed to subscribers
+	EventLog *EventLog
+	// Webhooks post the committed, deleted and downloaded files, when their URLs are set
+	Webhooks WebhookConfig
+	// Replication keeps the public files converged with peer servers, when peers are set; it requires EventLog
+	Replication ReplicationConfig
 }
 
 func NewServerGRPC(cfg ServerGRPCConfig, fileStore FileStore) (s ServerGRPC, err error) {
 
-	if cfg.Port == 0 {
+	if cfg.Address == "" && cfg.Port == 0 {
 		err = errors.Errorf("Port must be specified")
 		return
 	}
 
-	s.port = cfg.Port
+	s.address = cfg.Address
+	if s.address == "" {
+		s.address = ":" + strconv.Itoa(cfg.Port)
+	}
+	s.maxFileSize = cfg.MaxFileSize
+	if s.maxFileSize == 0 {
+		s.maxFileSize = maxFileSize
+	}
 	s.certificate = cfg.Certificate
 	s.key = cfg.Key
+	s.tlsPairs = cfg.TLSPairs
+	s.tlsPolicy = cfg.TLSPolicy
+	s.clientCA = cfg.ClientCA
+	s.clientAuth = cfg.ClientAuth
+	s.certReloadInterval = cfg.CertReloadInterval
+	if s.certReloadInterval == 0 {
+		s.certReloadInterval = 30 * time.Second
+	}
+	s.certExpiryWarning = cfg.CertExpiryWarning
+	if s.certExpiryWarning == 0 {
+		s.certExpiryWarning = 7 * 24 * time.Hour
+	}
+	s.stop = make(chan struct{})
+	s.authPolicy = cfg.AuthPolicy
+	if cfg.ShareKey != "" {
+		s.shareSigner, err = newShareSigner(cfg.ShareKey, cfg.ShareDenylist)
+		if err != nil {
+			return
+		}
+	}
+	s.maxShareTTL = cfg.MaxShareTTL
+	s.limiter = newLimiter(cfg.Limits)
+	s.validators = cfg.Validators
+	s.masterKey = cfg.MasterKey
+	s.trustStore = cfg.TrustStore
+	s.requireSignature = cfg.RequireSignature
+	s.mspIdentities = cfg.MSPIdentities
+	if cfg.PendingDir != "" {
+		s.pending, err = newPendingStore(cfg.PendingDir, cfg.MasterKey)
+		if err != nil {
+			return
+		}
+	}
+	if cfg.Scan.Command != "" {
+		s.scanner, err = newContentScanner(cfg.Scan)
+		if err != nil {
+			return
+		}
+	}
+	if len(cfg.Webhooks.URLs) > 0 {
+		s.webhooks, err = newWebhookSender(cfg.Webhooks)
+		if err != nil {
+			return
+		}
+	}
+	if s.maxShareTTL == 0 {
+		s.maxShareTTL = 7 * 24 * time.Hour
+	}
+	if cfg.TokenAuth.TokenFile != "" || cfg.TokenAuth.JWTPublicKey != "" {
+		s.tokenAuth, err = newTokenAuthenticator(cfg.TokenAuth)
+		if err != nil {
+			return
+		}
+	}
+	s.debug = cfg.Debug
 	s.fileStore = fileStore
+	s.auditLog = cfg.AuditLog
+	s.eventLog = cfg.EventLog
+	if len(cfg.Replication.Peers) > 0 {
+		if s.eventLog == nil {
+			err = errors.New("replication requires the event log")
+			return
+		}
+		s.replicator, err = newReplicator(cfg.Replication, s.maxFileSize)
+		if err != nil {
+			return
+		}
+	}
 
 	// healthcheck
 	s.statusMap = make(map[string]HealthCheckResponse_ServingStatus)
@@ -77,25 +230,35 @@ func (s *ServerGRPC) Listen() (err error) {
 		grpcCreds credentials.TransportCredentials
 	)
 
-	listener, err = net.Listen("tcp", ":"+strconv.Itoa(s.port))
+	listener, err = net.Listen("tcp", s.address)
 	if err != nil {
-		err = errors.Wrapf(err, "failed to listen on port %d", s.port)
+		err = errors.Wrapf(err, "failed to listen on %s", s.address)
 		return
 	}
 
 	if s.certificate != "" && s.key != "" {
-		grpcCreds, err = credentials.NewServerTLSFromFile(s.certificate, s.key)
+		grpcCreds, err = s.transportCredentials()
 		if err != nil {
-			err = errors.Wrapf(err, "failed to create tls grpc serve using cert %s and key %s", s.certificate, s.key)
 			return
 		}
 
 		grpcOpts = append(grpcOpts, grpc.Creds(grpcCreds))
 	}
 
+	grpcOpts = append(grpcOpts,
+		grpc.ChainUnaryInterceptor(s.unaryLimitInterceptor),
+		grpc.ChainStreamInterceptor(s.streamLimitInterceptor))
+
 	s.server = grpc.NewServer(grpcOpts...)
 	RegisterGuploadServiceServer(s.server, s)
 
+	if s.webhooks != nil {
+		go s.webhooks.run(s.stop)
+	}
+	if s.replicator != nil {
+		go s.replicator.run(s, s.stop)
+	}
+
 	err = s.server.Serve(listener)
 	if err != nil {
 		err = errors.Wrapf(err, "errored listening for grpc connections")
@@ -104,26 +267,127 @@ func (s *ServerGRPC) Listen() (err error) {
 	return
 }
 
-func (s *ServerGRPC) Download(request *FileRequest, stream GuploadService_DownloadServer) error {
-	var shard []byte
+func (s *ServerGRPC) transportCredentials() (grpcCreds credentials.TransportCredentials, err error) {
+	pairs := append([]TLSPair{{Certificate: s.certificate, Key: s.key}}, s.tlsPairs...)
+	s.certReloader, err = newCertReloader(pairs, s.clientCA)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to create tls grpc serve using cert %s and key %s", s.certificate, s.key)
+		return
+	}
+	go s.certReloader.watch(s.certReloadInterval, s.stop)
+
+	tlsConfig := &tls.Config{
+		GetCertificate: s.certReloader.GetCertificate,
+	}
+	s.tlsPolicy.apply(tlsConfig)
+	if s.clientCA != "" {
+		tlsConfig.ClientAuth = s.clientAuth
+		tlsConfig.GetConfigForClient = s.certReloader.GetConfigForClient(tlsConfig.Clone())
+	}
+
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// certWarning returns a non-empty warning, when the served certificate is close to expiry
+func (s *ServerGRPC) certWarning() string {
+	if s.certReloader == nil {
+		return ""
+	}
+
+	notAfter := s.certReloader.NotAfter()
+	if time.Until(notAfter) > s.certExpiryWarning {
+		return ""
+	}
+	if time.Now().After(notAfter) {
+		return fmt.Sprintf("tls certificate expired at %s", notAfter.UTC())
+	}
+	return fmt.Sprintf("tls certificate expires at %s", notAfter.UTC())
+}
+
+func (s *ServerGRPC) Download(request *FileRequest, stream GuploadService_DownloadServer) (err error) {
+	var (
+		shard              []byte
+		totalBytesStreamed int64
+		hash               = sha256.New()
+	)
 	fileName := request.GetFilename()
-	path := filepath.Join(filesDir, fileName)
+	fileType := "public"
+	token := request.GetToken()
+	if token == "" {
+		if md, ok := metadata.FromIncomingContext(stream.Context()); ok && len(md.Get(shareTokenMetadata)) > 0 {
+			token = md.Get(shareTokenMetadata)[0]
+		}
+	}
+	if request.GetPrefix() != "" {
+		return s.downloadPrefix(request.GetPrefix(), token, stream)
+	}
 
-	fileInfo, err := os.Stat(path)
-	if err != nil {
-		log.Println(err)
-		return logError(status.Errorf(codes.NotFound, "filepath is invalid"))
+	defer func() {
+		s.audit(stream.Context(), AuditRecord{
+			Operation: auditOpDownload,
+			Filename:  fileName,
+			FileType:  fileType,
+			Size:      totalBytesStreamed,
+			Checksum:  hex.EncodeToString(hash.Sum(nil)),
+		}, err)
+	}()
+
+	var f io.ReadCloser
+	var fileSize int64
+	if token != "" {
+		// a share token replaces the download permission, for one version of one file
+		var claims shareClaims
+		if claims, err = s.verifyShareToken(token, fileName); err != nil {
+			return
+		}
+		fileName, fileType = claims.Filename, claims.FileType
+		f, fileSize, err = s.openSharedFile(claims)
+		if err != nil {
+			return
+		}
+	} else {
+		if err = s.authorize(stream.Context(), authOpDownload); err != nil {
+			return
+		}
+
+		f, fileSize, err = s.fileStore.Open(fileName, fileType)
+		if err != nil {
+			log.Println(err)
+			if os.IsNotExist(err) || errors.Cause(err) == ErrInvalidFileId {
+				return logError(status.Errorf(codes.NotFound, "filepath is invalid"))
+			}
+			return logError(status.Errorf(codes.Aborted, "cannot open file"))
+		}
 	}
-	fileSize := fileInfo.Size()
+	defer f.Close()
 
-	f, err := os.Open(path)
+	// the signature and mode come first, so that clients can verify the content as it arrives
+	meta, err := s.fileStore.Meta(fileName, fileType)
 	if err != nil {
-		log.Println(err)
-		return logError(status.Errorf(codes.Aborted, "cannot open file"))
+		return logError(status.Errorf(codes.Internal, "cannot read file metadata: %v", err))
+	}
+	header := &FileResponse{Mode: uint32(meta.Mode)}
+	if meta.Signature != nil {
+		header.Signature = meta.Signature.proto()
+	}
+	if meta.Encryption != nil {
+		header.Encryption = meta.Encryption.proto()
+	}
+	if header.Mode == 0 {
+		// files of a folder upload keep their mode in the store
+		if stored, statErr := s.fileStore.Stat(fileName, fileType); statErr == nil {
+			header.Mode = uint32(stored.Mode)
+		}
+	}
+	if err = stream.Send(header); err != nil {
+		return err
 	}
-	defer f.Close()
 
-	var totalBytesStreamed int64
+	var streamLimiter *rate.Limiter
+	if s.limiter.cfg.DownloadStreamBytesPerSecond > 0 {
+		rateLimit := s.limiter.cfg.DownloadStreamBytesPerSecond
+		streamLimiter = rate.NewLimiter(rate.Limit(rateLimit), int(rateLimit))
+	}
 
 	for totalBytesStreamed < fileSize {
 		bytesleft := fileSize - totalBytesStreamed
@@ -140,28 +404,54 @@ func (s *ServerGRPC) Download(request *FileRequest, stream GuploadService_Downlo
 		if err != nil {
 			return err
 		}
+		if streamLimiter != nil {
+			if err := waitBytes(stream.Context(), streamLimiter, bytesRead); err != nil {
+				return err
+			}
+		}
 		if err := stream.Send(&FileResponse{
-			Shard: shard,
+			Shard: shard[:bytesRead],
 		}); err != nil {
 			return err
 		}
+		hash.Write(shard[:bytesRead])
 		totalBytesStreamed += int64(bytesRead)
 	}
 	log.Println("download complete: " + fileName)
+	s.webhook(stream.Context(), webhookDownloaded, fileType, fileName, totalBytesStreamed, hex.EncodeToString(hash.Sum(nil)))
 	return nil
 }
 
 func (s *ServerGRPC) Upload(stream GuploadService_UploadServer) (err error) {
+	if err = s.authorize(stream.Context(), authOpUpload); err != nil {
+		return
+	}
+
 	req, err := stream.Recv()
 	if err != nil {
 		return logError(status.Errorf(codes.Unknown, "cannot receive file info"))
 	}
 	fileId := req.GetInfo().GetFilename()
 	fileType := req.GetInfo().GetFileType()
+	encryption := req.GetInfo().GetEncryption()
+	signature := req.GetInfo().GetSignature()
+	archive := req.GetInfo().GetArchive()
+	mode := os.FileMode(req.GetInfo().GetMode()).Perm()
 	log.Printf("receive an upload request for fileId '%s' with type '%s'", fileId, fileType)
 
 	data := bytes.Buffer{}
 	filesize := 0
+	hash := sha256.New()
+
+	defer func() {
+		s.audit(stream.Context(), AuditRecord{
+			Operation: auditOpUpload,
+			Filename:  fileId,
+			FileType:  fileType,
+			Size:      int64(filesize),
+			Checksum:  hex.EncodeToString(hash.Sum(nil)),
+		}, err)
+	}()
 
 	for {
 		req, err := stream.Recv()
@@ -177,23 +467,97 @@ func (s *ServerGRPC) Upload(stream GuploadService_UploadServer) (err error) {
 		}
 		chunk := req.GetContent()
 		size := len(chunk)
-		fmt.Print("‣")
+		if s.debug {
+			fmt.Print("‣")
+		}
 
 		filesize += size
-		if filesize > maxFileSize {
-			return logError(status.Errorf(codes.InvalidArgument, "file is too large: %d > %d", filesize, maxFileSize))
+		if int64(filesize) > s.maxFileSize {
+			return logError(status.Errorf(codes.InvalidArgument, "file is too large: %d > %d", filesize, s.maxFileSize))
 		}
 
 		_, err = data.Write(chunk)
 		if err != nil {
 			return logError(status.Errorf(codes.Internal, "cannot write chunk data: %v", err))
 		}
+		hash.Write(chunk)
+	}
+
+	meta := FileMeta{Mode: mode}
+	if archive && (encryption != nil || signature != nil) {
+		return logError(status.Errorf(codes.InvalidArgument, "archives cannot be encrypted or signed"))
+	}
+	if encryption != nil {
+		if encryption.GetFormat() != encryptionFormatAge || !isAgeEncrypted(data.Bytes()) {
+			return logError(status.Errorf(codes.InvalidArgument, "content is not encrypted as declared (%s)", encryption.GetFormat()))
+		}
+		meta.Encryption = &EncryptionMeta{Format: encryption.GetFormat(), Recipients: encryption.GetRecipients()}
+	}
+	if signature != nil {
+		if meta.Signature, err = s.verifyUploadSignature(fileId, data.Bytes(), signature); err != nil {
+			return
+		}
+	} else if s.requireSignature {
+		return logError(status.Errorf(codes.InvalidArgument, "%s rejected: a detached signature is required", fileId))
 	}
 
-	_, err = s.fileStore.Save(fileId, fileType, data)
+	uploaded := UploadedFile{Filename: fileId, FileType: fileType, Data: data.Bytes(), Encrypted: encryption != nil,
+		Archive: archive}
+	var files []ArchiveFile
+	if archive {
+		if files, err = s.validateArchive(uploaded); err != nil {
+			return
+		}
+	} else if err = s.validateFile(uploaded); err != nil {
+		return
+	}
+	if err = s.authorizeMSPUpload(stream.Context(), uploaded, meta.Signature); err != nil {
+		return
+	}
+	if s.scanner != nil {
+		if err = s.scanUpload(stream.Context(), uploaded, hex.EncodeToString(hash.Sum(nil))); err != nil {
+			return
+		}
+	}
+
+	if s.pending != nil && fileType == "public" {
+		// checked now, as the save would, rather than at approval
+		if err = s.fileStore.Check(fileId, fileType); err != nil {
+			return logError(status.Errorf(codes.InvalidArgument, "cannot save file: %v", err))
+		}
+		var item *PendingFile
+		if item, err = s.holdForApproval(stream.Context(), uploaded, meta, hex.EncodeToString(hash.Sum(nil))); err != nil {
+			return
+		}
+		err = stream.SendAndClose(&UploadStatus{
+			Message:   "Upload received, pending approval",
+			Code:      StatusCode_Ok,
+			PendingId: item.Id,
+		})
+		if err != nil {
+			err = errors.Wrapf(err, "failed to send status code")
+		}
+		return
+	}
+
+	var before []StoredFile
+	if archive {
+		before, _ = s.fileStore.List(fileId, fileType)
+		err = s.fileStore.SaveTree(fileId, fileType, files)
+	} else if _, err = s.fileStore.Save(fileId, fileType, data); err == nil {
+		err = s.fileStore.SaveMeta(fileId, fileType, meta)
+	}
+	if errors.Cause(err) == ErrInvalidFileId {
+		return logError(status.Errorf(codes.InvalidArgument, "cannot save file: %v", err))
+	}
 	if err != nil {
 		return logError(status.Errorf(codes.Internal, "cannot save file: %v", err))
 	}
+	if archive {
+		s.notifyTree(fileType, fileId, before, files)
+	} else {
+		s.notifySaved(fileType, fileId, uploaded.Data)
+	}
 
 	err = stream.SendAndClose(&UploadStatus{
 		Message: "Upload received with success",
@@ -204,6 +568,11 @@ func (s *ServerGRPC) Upload(stream GuploadService_UploadServer) (err error) {
 		return
 	}
 	log.Printf("file saved (%s) : %s", fileType, fileId)
+	if archive {
+		s.webhookTree(stream.Context(), fileType, fileId, files)
+	} else {
+		s.webhook(stream.Context(), webhookCommitted, fileType, fileId, int64(filesize), hex.EncodeToString(hash.Sum(nil)))
+	}
 	return
 }
 
@@ -211,13 +580,20 @@ func (s *ServerGRPC) Check(ctx context.Context, in *HealthCheckRequest) (*Health
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	log.Printf("label:%s-%s ping at %s\n", in.Label, in.Counter, in.PingAt)
+	if s.debug {
+		log.Printf("label:%s-%s ping at %s\n", in.Label, in.Counter, in.PingAt)
+	}
 
 	if in.Service == "" {
 		// check the server overall health status.
+		warning := s.certWarning()
+		if warning != "" {
+			log.Printf("health check warning: %s", warning)
+		}
 		return &HealthCheckResponse{
 			Status:     HealthCheckResponse_SERVING,
 			ReceivedAt: time.Now().UTC().String(),
+			Warning:    warning,
 		}, nil
 	}
 
@@ -230,7 +606,107 @@ func (s *ServerGRPC) Check(ctx context.Context, in *HealthCheckRequest) (*Health
 	return nil, status.Error(codes.NotFound, "unknown service")
 }
 
+// AuditTail streams audit records. Records from FromSeq onward are replayed first (FromSeq 0 skips the replay);
+// with Follow, newly appended records are streamed until the client goes away.
+func (s *ServerGRPC) AuditTail(req *AuditTailRequest, stream GuploadService_AuditTailServer) error {
+	if err := s.authorize(stream.Context(), authOpAdmin); err != nil {
+		return err
+	}
+	if s.auditLog == nil {
+		return logError(status.Errorf(codes.FailedPrecondition, "audit log is not enabled"))
+	}
+
+	records, lastSeq, cancel := s.auditLog.Subscribe()
+	defer cancel()
+
+	next := lastSeq + 1
+	// replay sends the records from next up to seq, as read from the log
+	replay := func(seq uint64) error {
+		err := readAuditLog(s.auditLog.Path(), next, func(rec AuditRecord) error {
+			if rec.Seq > seq {
+				// the rest arrives through the subscription
+				return io.EOF
+			}
+			next = rec.Seq + 1
+			return stream.Send(rec.toEvent())
+		})
+		if err != nil && err != io.EOF {
+			return logError(status.Errorf(codes.Internal, "cannot read audit log: %v", err))
+		}
+		return nil
+	}
+	if req.GetFromSeq() > 0 {
+		next = req.GetFromSeq()
+		if err := replay(lastSeq); err != nil {
+			return err
+		}
+	}
+
+	if !req.GetFollow() {
+		return nil
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case rec := <-records:
+			if rec.Seq < next {
+				continue
+			}
+			if rec.Seq > next {
+				// the subscription dropped records while the stream was slow
+				if err := replay(rec.Seq - 1); err != nil {
+					return err
+				}
+			}
+			if err := stream.Send(rec.toEvent()); err != nil {
+				return err
+			}
+			next = rec.Seq + 1
+		}
+	}
+}
+
+// audit appends a record for a finished file operation; err is the outcome of the operation
+func (s *ServerGRPC) audit(ctx context.Context, rec AuditRecord, err error) {
+	if s.auditLog == nil {
+		return
+	}
+
+	rec.Peer, _ = peerInfo(ctx)
+	if id, err := s.identity(ctx); err == nil {
+		rec.Identity = id.Name
+	}
+	s.appendAudit(rec, err)
+}
+
+// auditReplica appends a record for a file written or deleted here by the replication from peer
+func (s *ServerGRPC) auditReplica(peer PeerConfig, rec AuditRecord, err error) {
+	if s.auditLog == nil {
+		return
+	}
+
+	rec.Peer, rec.Identity = peer.Address, replicaUploader+peer.Name
+	s.appendAudit(rec, err)
+}
+
+func (s *ServerGRPC) appendAudit(rec AuditRecord, err error) {
+	rec.Outcome = auditOutcomeOk
+	if err != nil {
+		rec.Outcome = err.Error()
+	}
+
+	if _, err := s.auditLog.Append(rec); err != nil {
+		log.Printf("failed to write audit record: %v", err)
+	}
+}
+
 func (s *ServerGRPC) Close() {
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
 	if s.server != nil {
 		s.server.Stop()
 	}
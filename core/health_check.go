@@ -13,7 +13,7 @@ var HealthCheckCommand = cli.Command{
 	Name:   "ping",
 	Usage:  "health check",
 	Action: healtCheckAction,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
 			Name:  "address",
 			Value: "localhost:1313",
@@ -37,7 +37,7 @@ var HealthCheckCommand = cli.Command{
 			Name:  "servername-override",
 			Usage: "use serverNameOverride for tls ca cert",
 		},
-	},
+	}, clientSecurityFlags...),
 }
 
 func healtCheckAction(c *cli.Context) (err error) {
@@ -59,11 +59,18 @@ func healtCheckAction(c *cli.Context) (err error) {
 		must(errors.New("invalid interval"))
 	}
 
+	tlsPolicy, err := newClientTLSPolicy(c)
+	must(err)
+	token, err := newClientToken(c)
+	must(err)
+
 	grpcClient, err := NewClientGRPC(ClientGRPCConfig{
 		Address:            address,
 		RootCertificate:    rootCertificate,
 		Compress:           true,
 		ServerNameOverride: serverNameOverride,
+		TLSPolicy:          tlsPolicy,
+		Token:              token,
 	})
 	must(err)
 	client = &grpcClient
@@ -79,6 +86,9 @@ func healtCheckAction(c *cli.Context) (err error) {
 			log.Printf("can't connect grpc server: %v, code: %v\n", err, grpc.Code(err))
 		} else {
 			log.Printf("label:%s-%d duration (ms) %d; --> %s\n", label, counter, stats.pingFinishedAt.Sub(stats.pingStartAt).Milliseconds(), stats.serverReceivedAt)
+			if stats.warning != "" {
+				log.Printf("⚠️  warning: %s\n", stats.warning)
+			}
 		}
 		<-time.After(duration)
 	}
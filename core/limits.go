@@ -0,0 +1,219 @@
+package core
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// idleClientLimiter is how long the limiter of a silent client is kept
+const idleClientLimiter = 10 * time.Minute
+
+// LimitConfig holds the per client token buckets, keyed by identity (or ip for anonymous callers),
+// and the global caps on concurrent streams. Zero values disable a limit.
+type LimitConfig struct {
+	RequestsPerSecond float64
+	RequestBurst      int
+	// BytesPerSecond throttles the upload and download streams of a client
+	BytesPerSecond int64
+	// DownloadStreamBytesPerSecond caps every single download stream
+	DownloadStreamBytesPerSecond int64
+	MaxConcurrentUploads         int
+	MaxConcurrentDownloads       int
+}
+
+type clientLimiter struct {
+	requests *rate.Limiter
+	bytes    *rate.Limiter
+	lastSeen time.Time
+}
+
+// limiter enforces a LimitConfig in grpc interceptors, returning codes.ResourceExhausted when a limit is hit
+type limiter struct {
+	cfg       LimitConfig
+	uploads   chan struct{}
+	downloads chan struct{}
+
+	mu        sync.Mutex
+	clients   map[string]*clientLimiter
+	lastPrune time.Time
+}
+
+func newLimiter(cfg LimitConfig) *limiter {
+	l := &limiter{
+		cfg:     cfg,
+		clients: make(map[string]*clientLimiter),
+	}
+	if cfg.MaxConcurrentUploads > 0 {
+		l.uploads = make(chan struct{}, cfg.MaxConcurrentUploads)
+	}
+	if cfg.MaxConcurrentDownloads > 0 {
+		l.downloads = make(chan struct{}, cfg.MaxConcurrentDownloads)
+	}
+	return l
+}
+
+// client returns the buckets of key, and drops those of clients idle for a while
+func (l *limiter) client(key string) *clientLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPrune) > time.Minute {
+		for k, c := range l.clients {
+			if now.Sub(c.lastSeen) > idleClientLimiter {
+				delete(l.clients, k)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	c, ok := l.clients[key]
+	if !ok {
+		c = &clientLimiter{}
+		if l.cfg.RequestsPerSecond > 0 {
+			burst := l.cfg.RequestBurst
+			if burst < 1 {
+				burst = 1
+			}
+			c.requests = rate.NewLimiter(rate.Limit(l.cfg.RequestsPerSecond), burst)
+		}
+		if l.cfg.BytesPerSecond > 0 {
+			c.bytes = rate.NewLimiter(rate.Limit(l.cfg.BytesPerSecond), int(l.cfg.BytesPerSecond))
+		}
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+	return c
+}
+
+// limitKey identifies the caller of ctx: its authenticated identity, or else its ip
+func (s *ServerGRPC) limitKey(ctx context.Context) string {
+	if id, err := s.identity(ctx); err == nil && id.Name != "" {
+		return "id:" + id.Name
+	}
+	addr, _ := peerInfo(ctx)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return "ip:" + host
+	}
+	return "ip:" + addr
+}
+
+// allowRequest takes a token of the request bucket of the caller. Health checks are never limited,
+// so that probes keep working while a client is throttled.
+func (s *ServerGRPC) allowRequest(ctx context.Context, fullMethod string) (*clientLimiter, error) {
+	key := s.limitKey(ctx)
+	c := s.limiter.client(key)
+	if c.requests != nil && !strings.HasSuffix(fullMethod, "/Check") && !c.requests.Allow() {
+		return nil, logError(status.Errorf(codes.ResourceExhausted, "rate limit of %g requests/s exceeded by %s",
+			s.limiter.cfg.RequestsPerSecond, key))
+	}
+	return c, nil
+}
+
+func (s *ServerGRPC) unaryLimitInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	if _, err := s.allowRequest(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *ServerGRPC) streamLimitInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+	c, err := s.allowRequest(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+
+	var slots chan struct{}
+	switch {
+	case strings.HasSuffix(info.FullMethod, "/Upload"):
+		slots = s.limiter.uploads
+	case strings.HasSuffix(info.FullMethod, "/Download"):
+		slots = s.limiter.downloads
+	}
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		default:
+			return logError(status.Errorf(codes.ResourceExhausted, "too many concurrent transfers (max %d)", cap(slots)))
+		}
+	}
+
+	if c.bytes != nil {
+		stream = &throttledStream{ServerStream: stream, bytes: c.bytes}
+	}
+	return handler(srv, stream)
+}
+
+// throttledStream takes the size of every message received or sent from the byte bucket of its client
+type throttledStream struct {
+	grpc.ServerStream
+	bytes *rate.Limiter
+}
+
+func (t *throttledStream) RecvMsg(m interface{}) error {
+	if err := t.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return t.wait(m)
+}
+
+func (t *throttledStream) SendMsg(m interface{}) error {
+	if err := t.wait(m); err != nil {
+		return err
+	}
+	return t.ServerStream.SendMsg(m)
+}
+
+func (t *throttledStream) wait(m interface{}) error {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return nil
+	}
+	return waitBytes(t.Context(), t.bytes, proto.Size(msg))
+}
+
+// parseRate parses a transfer rate such as "2MB/s", "512KiB" or "0"; empty means 0 (unlimited)
+func parseRate(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	bytes, err := humanize.ParseBytes(strings.TrimSuffix(value, "/s"))
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid rate %s: use e.g. 2MB/s", value)
+	}
+	return int64(bytes), nil
+}
+
+// waitBytes blocks until n bytes are available from limiter, in pieces no larger than its burst.
+// It fails with codes.ResourceExhausted when the wait would outlast the deadline of ctx.
+func waitBytes(ctx context.Context, limiter *rate.Limiter, n int) error {
+	for n > 0 {
+		size := n
+		if size > limiter.Burst() {
+			size = limiter.Burst()
+		}
+		if err := limiter.WaitN(ctx, size); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return status.Errorf(codes.ResourceExhausted, "bandwidth limit: %v", err)
+		}
+		n -= size
+	}
+	return nil
+}
@@ -0,0 +1,362 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// mspFolder is the public sub folder of the MSP bundles, stored as <mspFolder>/<org>.tar.gz
+	mspFolder     = "msp"
+	mspBundleExt  = ".tar.gz"
+	mspConfigFile = "config.yaml"
+	mspKeystore   = "keystore"
+	validatorMSP  = "msp"
+)
+
+// mspCertFolders are the folders of a Fabric MSP holding PEM certificates; crls holds PEM CRLs.
+// The keystore is never packaged: private keys don't leave the org.
+var mspCertFolders = []string{
+	"cacerts", "intermediatecerts", "admincerts", "signcerts", "tlscacerts", "tlsintermediatecerts",
+}
+
+var mspOrgPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// mspBundleName is the file id of the MSP bundle of org
+func mspBundleName(org string) (string, error) {
+	if !mspOrgPattern.MatchString(org) {
+		return "", errors.Errorf("invalid org %s: use letters, digits, '.', '_' and '-'", org)
+	}
+	return mspFolder + "/" + org + mspBundleExt, nil
+}
+
+// isMSPBundle reports whether fileId names an MSP bundle
+func isMSPBundle(fileId string, fileType string) bool {
+	dir, name := path.Split(filepath.ToSlash(filepath.Clean(fileId)))
+	return fileType == "public" && dir == mspFolder+"/" && strings.HasSuffix(name, mspBundleExt)
+}
+
+// readMSPDir reads an MSP tree; the keystore is skipped, and returned as skipped
+func readMSPDir(dir string) (files []ArchiveFile, skipped []string, err error) {
+	files, err = readTree(dir, func(name string) bool {
+		if name == mspKeystore || strings.HasPrefix(name, mspKeystore+"/") {
+			skipped = append(skipped, name)
+			return true
+		}
+		return false
+	})
+	return
+}
+
+// validateMSP checks the structure of an MSP tree: known folders only, one level deep, at least one CA cert,
+// parsable certificates and CRLs, and config.yaml referring to files of the tree
+func validateMSP(files []ArchiveFile) (violations []Violation) {
+	violation := func(format string, args ...interface{}) {
+		violations = append(violations, Violation{validatorMSP, fmt.Sprintf(format, args...)})
+	}
+
+	names := map[string]bool{}
+	caCerts := 0
+	for _, f := range files {
+		names[f.Name] = true
+		parts := strings.Split(f.Name, "/")
+
+		switch {
+		case len(parts) == 1 && f.Name == mspConfigFile:
+			continue
+		case len(parts) == 1:
+			violation("%s: unexpected file at the msp root", f.Name)
+			continue
+		case len(parts) > 2:
+			violation("%s: msp folders hold no sub folders", f.Name)
+			continue
+		}
+
+		folder := parts[0]
+		switch {
+		case folder == "crls":
+			if err := checkPEMBlocks(f.Data, "X509 CRL", func(b []byte) error {
+				_, err := x509.ParseCRL(b)
+				return err
+			}); err != nil {
+				violation("%s: %v", f.Name, err)
+			}
+		case folder == mspKeystore:
+			violation("%s: private keys cannot be shared", f.Name)
+		case contains(mspCertFolders, folder):
+			if err := checkPEMBlocks(f.Data, "CERTIFICATE", func(b []byte) error {
+				_, err := x509.ParseCertificate(b)
+				return err
+			}); err != nil {
+				violation("%s: %v", f.Name, err)
+			}
+			if folder == "cacerts" {
+				caCerts++
+			}
+		default:
+			violation("%s: unknown msp folder %s", f.Name, folder)
+		}
+	}
+	if caCerts == 0 {
+		violation("cacerts: at least one CA certificate is required")
+	}
+
+	for _, f := range files {
+		if f.Name != mspConfigFile {
+			continue
+		}
+		var config interface{}
+		if err := yaml.Unmarshal(f.Data, &config); err != nil {
+			violation("%s: %v", mspConfigFile, err)
+			continue
+		}
+		missing := map[string]bool{}
+		for _, ref := range mspConfigCertificates(config) {
+			if !names[path.Clean(ref)] && !missing[ref] {
+				missing[ref] = true
+				violation("%s: certificate %s is not in the msp", mspConfigFile, ref)
+			}
+		}
+	}
+	return
+}
+
+// mspConfigCertificates returns the values of the Certificate keys of config.yaml, e.g. of its NodeOUs
+func mspConfigCertificates(node interface{}) (refs []string) {
+	switch n := node.(type) {
+	case map[interface{}]interface{}:
+		for k, v := range n {
+			if ref, ok := v.(string); ok && k == "Certificate" {
+				refs = append(refs, ref)
+				continue
+			}
+			refs = append(refs, mspConfigCertificates(v)...)
+		}
+	case []interface{}:
+		for _, v := range n {
+			refs = append(refs, mspConfigCertificates(v)...)
+		}
+	}
+	return
+}
+
+// checkPEMBlocks checks that data holds at least one PEM block, and that every block of blockType parses
+func checkPEMBlocks(data []byte, blockType string, parse func([]byte) error) error {
+	found := false
+	for rest := data; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != blockType {
+			return errors.Errorf("unexpected PEM block %s", block.Type)
+		}
+		if err := parse(block.Bytes); err != nil {
+			return err
+		}
+		found = true
+	}
+	if !found {
+		return errors.Errorf("no %s PEM block found", blockType)
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// packMSP archives an MSP tree as a gzipped tar, with its file modes
+func packMSP(files []ArchiveFile) (*bytes.Buffer, error) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	if err := writeTar(gz, files); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// unpackMSP reads an archive of packMSP, see readTar
+func unpackMSP(data []byte, maxSize int64) ([]ArchiveFile, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid msp bundle")
+	}
+	files, err := readTar(gz, maxSize)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid msp bundle")
+	}
+	return files, nil
+}
+
+// validateMSPBundle rejects an upload to the msp folder, unless it is a valid MSP bundle
+func (s *ServerGRPC) validateMSPBundle(f UploadedFile) error {
+	org := strings.TrimSuffix(path.Base(filepath.ToSlash(f.Filename)), mspBundleExt)
+	var violations []Violation
+	if _, err := mspBundleName(org); err != nil {
+		violations = append(violations, Violation{validatorMSP, err.Error()})
+	} else if f.Encrypted {
+		violations = append(violations, Violation{validatorMSP, "msp bundles cannot be encrypted"})
+	} else if files, err := unpackMSP(f.Data, s.maxFileSize*16); err != nil {
+		violations = append(violations, Violation{validatorMSP, err.Error()})
+	} else {
+		violations = validateMSP(files)
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return rejectedError(f.Filename, violations)
+}
+
+// authorizeMSPUpload binds the msp bundle of an org to that org: the caller must belong to it, i.e. the O or OU of
+// its certificate or the org of its token, or be listed for it by --msp-identities; or the bundle must be signed by a
+// trusted certificate of that org, by the same rules. Archives cannot be uploaded into the msp folder: they would
+// replace the bundles of every org.
+func (s *ServerGRPC) authorizeMSPUpload(ctx context.Context, f UploadedFile, signature *SignatureMeta) error {
+	if f.FileType != "public" {
+		return nil
+	}
+	if f.Archive {
+		prefix := path.Clean(filepath.ToSlash(f.Filename))
+		if prefix == mspFolder || strings.HasPrefix(prefix, mspFolder+"/") {
+			return logError(status.Errorf(codes.InvalidArgument, "%s rejected: msp bundles are uploaded one by one, with upload-msp",
+				f.Filename))
+		}
+		return nil
+	}
+	if !isMSPBundle(f.Filename, f.FileType) {
+		return nil
+	}
+
+	org := strings.TrimSuffix(path.Base(filepath.ToSlash(f.Filename)), mspBundleExt)
+	id, err := s.identity(ctx)
+	if err != nil {
+		return logError(status.Errorf(codes.Unauthenticated, "%v", err))
+	}
+	if memberOf(org, id.Orgs) || s.mspIdentity(org, id.Name) {
+		return nil
+	}
+	if signature != nil {
+		signer, err := parseSignerCertificates(signature.Certificate)
+		if err == nil && (memberOf(org, certOrgs(signer[0])) || s.mspIdentity(org, signer[0].Subject.CommonName)) {
+			return nil
+		}
+	}
+	return logError(status.Errorf(codes.PermissionDenied,
+		"%s rejected: only an identity of %s, or a signature by one, can replace the msp bundle of %s", f.Filename, org, org))
+}
+
+// mspIdentity reports whether name is listed by --msp-identities for org
+func (s *ServerGRPC) mspIdentity(org string, name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, identity := range s.mspIdentities[strings.ToLower(org)] {
+		if identity == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMSPIdentities reads org=identity values into the identities of each org, keyed by the lower case org
+func parseMSPIdentities(values []string) (map[string][]string, error) {
+	identities := make(map[string][]string)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, errors.Errorf("invalid msp identity %s: use org=identity, e.g. Org1MSP=org1-admin", value)
+		}
+		org := strings.ToLower(strings.TrimSpace(parts[0]))
+		identities[org] = append(identities[org], strings.TrimSpace(parts[1]))
+	}
+	return identities, nil
+}
+
+// memberOf reports whether org is one of orgs, ignoring case
+func memberOf(org string, orgs []string) bool {
+	for _, o := range orgs {
+		if strings.EqualFold(o, org) {
+			return true
+		}
+	}
+	return false
+}
+
+// UploadMSP validates and packages the MSP tree dir, and uploads it as the public bundle of org
+func (c *ClientGRPC) UploadMSP(ctx context.Context, dir string, org string) (stats Stats, skipped []string, err error) {
+	fileName, err := mspBundleName(org)
+	if err != nil {
+		return
+	}
+	files, skipped, err := readMSPDir(dir)
+	if err != nil {
+		return
+	}
+	if violations := validateMSP(files); len(violations) > 0 {
+		lines := make([]string, 0, len(violations))
+		for _, violation := range violations {
+			lines = append(lines, "  - "+violation.Description)
+		}
+		err = errors.Errorf("invalid msp %s:\n%s\n", dir, strings.Join(lines, "\n"))
+		return
+	}
+
+	bundle, err := packMSP(files)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to package msp %s", dir)
+		return
+	}
+	stats, err = c.upload(ctx, dir, fileName, "public", 0, bundle)
+	return
+}
+
+// DownloadMSP downloads the bundle of org, and recreates its MSP tree as outDir. The bundle unpacks to at most 16 times
+// the max download size, as the server validates it against its max-file-size.
+func (c *ClientGRPC) DownloadMSP(org string, outDir string, force bool) (err error) {
+	fileName, err := mspBundleName(org)
+	if err != nil {
+		return
+	}
+	if _, err = os.Stat(outDir); err == nil && !force {
+		return errors.Errorf("%s already exists: use --force to replace it", outDir)
+	}
+	data, _, err := c.download(fileName)
+	if err != nil {
+		return
+	}
+	maxSize := c.maxDownloadSize
+	if maxSize <= 0 {
+		maxSize = maxFileSize
+	}
+	files, err := unpackMSP(data, maxSize*16)
+	if err != nil {
+		return
+	}
+	if violations := validateMSP(files); len(violations) > 0 {
+		return errors.Errorf("invalid msp bundle of %s: %s", org, violations[0].Description)
+	}
+	return writeTree(files, outDir, force)
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/net/context"
+)
+
+var UploadMSPCommand = cli.Command{
+	Name:   "upload-msp",
+	Usage:  "validate and upload a Fabric MSP folder, as the public msp bundle of an org; the keystore is never sent",
+	Action: uploadMSPAction,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "dir",
+			Usage: "MSP folder, holding cacerts, tlscacerts, admincerts, config.yaml...",
+		},
+		&cli.StringFlag{
+			Name:  "org",
+			Usage: "MSP id of the org, e.g. Org1MSP",
+		},
+		&cli.StringFlag{
+			Name:  "sign-with",
+			Usage: "PEM private key signing the bundle, e.g. the msp/keystore key of the org",
+		},
+		&cli.StringFlag{
+			Name:  "signer-cert",
+			Usage: "PEM certificate of the signer, e.g. msp/signcerts, of the org",
+		},
+	}, clientConnectionFlags...),
+}
+
+var DownloadMSPCommand = cli.Command{
+	Name:   "download-msp",
+	Usage:  "download the msp bundle of an org, and recreate its MSP folder",
+	Action: downloadMSPAction,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "org",
+			Usage: "MSP id of the org, e.g. Org1MSP",
+		},
+		&cli.StringFlag{
+			Name:  "out",
+			Usage: "MSP folder to create, e.g. ./peers/org1/msp",
+		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "replace the out folder, when it exists",
+		},
+		&cli.StringFlag{
+			Name:  "max-file-size",
+			Usage: "max-file-size of the server: larger bundles, or unpacking to more than 16 times it, are refused",
+			Value: "4MiB",
+		},
+	}, clientConnectionFlags...),
+}
+
+func uploadMSPAction(c *cli.Context) (err error) {
+	var (
+		dir = c.String("dir")
+		org = c.String("org")
+	)
+
+	if dir == "" {
+		must(errors.New("dir must be set"))
+	}
+
+	if org == "" {
+		must(errors.New("org must be set"))
+	}
+
+	client := newClientFromFlags(c, true)
+	defer client.Close()
+
+	stat, skipped, err := client.UploadMSP(context.Background(), dir, org)
+	must(err)
+
+	for _, name := range skipped {
+		fmt.Printf("skipped: %s\n", name)
+	}
+	fmt.Printf("⏱  Time duration (ms): %d\n", stat.FinishedAt.Sub(stat.StartedAt).Milliseconds())
+	if stat.PendingID != "" {
+		fmt.Printf("⏳ pending approval, id: %s\n", stat.PendingID)
+	}
+	return
+}
+
+func downloadMSPAction(c *cli.Context) (err error) {
+	var (
+		org = c.String("org")
+		out = c.String("out")
+	)
+
+	if org == "" {
+		must(errors.New("org must be set"))
+	}
+
+	if out == "" {
+		must(errors.New("out must be set"))
+	}
+
+	client := newClientFromFlags(c, true)
+	defer client.Close()
+
+	must(client.DownloadMSP(org, out, c.Bool("force")))
+	fmt.Printf("\nsuccessfully downloaded msp of %s: %s\n", org, out)
+	return
+}
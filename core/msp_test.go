@@ -0,0 +1,55 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthorizeMSPUpload(t *testing.T) {
+	identities, err := parseMSPIdentities([]string{"Org1MSP=org1-admin", " org2msp = org2-admin "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ServerGRPC{mspIdentities: identities}
+	bundle := UploadedFile{Filename: "msp/Org1MSP.tar.gz", FileType: "public"}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		f    UploadedFile
+		want codes.Code
+	}{
+		{"org in O", certContext("peer0", "Org1MSP"), bundle, codes.OK},
+		{"org in O, other case", certContext("peer0", "org1msp"), bundle, codes.OK},
+		{"listed identity", certContext("org1-admin", "org1"), bundle, codes.OK},
+		{"identity listed for another org", certContext("org2-admin", "org2"), bundle, codes.PermissionDenied},
+		{"other org", certContext("peer0", "Org2MSP"), bundle, codes.PermissionDenied},
+		{"anonymous", context.Background(), bundle, codes.PermissionDenied},
+		{"not a bundle", certContext("stranger"), UploadedFile{Filename: "msp/readme.txt", FileType: "public"},
+			codes.OK},
+		{"folder into msp", certContext("org1-admin", "Org1MSP"),
+			UploadedFile{Filename: "msp", FileType: "public", Archive: true}, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		if got := status.Code(s.authorizeMSPUpload(tt.ctx, tt.f, nil)); got != tt.want {
+			t.Errorf("%s: authorizeMSPUpload = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseMSPIdentities(t *testing.T) {
+	got, err := parseMSPIdentities([]string{"Org1MSP=org1-admin", "org1msp=org1-ops", "Org2MSP=org2-admin"})
+	want := map[string][]string{"org1msp": {"org1-admin", "org1-ops"}, "org2msp": {"org2-admin"}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("parseMSPIdentities = %v, %v; want %v", got, err, want)
+	}
+	for _, value := range []string{"Org1MSP", "=org1-admin", "Org1MSP="} {
+		if _, err := parseMSPIdentities([]string{value}); err == nil {
+			t.Errorf("parseMSPIdentities(%s): want an error", value)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package core
+
+import (
+	"crypto/x509"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// peerInfo returns the remote address of the caller, and its verified TLS client identity (subject common name).
+// The identity is empty, when the client did not present a certificate.
+func peerInfo(ctx context.Context) (addr string, identity string) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", ""
+	}
+	if p.Addr != nil {
+		addr = p.Addr.String()
+	}
+	if cert := peerCertificate(ctx); cert != nil {
+		identity = cert.Subject.CommonName
+	}
+	return
+}
+
+// peerCertificate returns the verified TLS client certificate of the caller, or nil
+func peerCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return tlsInfo.State.VerifiedChains[0][0]
+}
+
+// certOrgs returns the organizations (O) and organizational units (OU) of the subject of cert
+func certOrgs(cert *x509.Certificate) []string {
+	if cert == nil {
+		return nil
+	}
+	return append(append([]string{}, cert.Subject.Organization...), cert.Subject.OrganizationalUnit...)
+}
@@ -0,0 +1,280 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	pendingDataExt = ".data"
+	pendingMetaExt = ".json"
+)
+
+// errPendingNotFound is returned for unknown (or already reviewed) pending ids
+var errPendingNotFound = errors.New("no pending file with this id")
+
+// pendingRecord is the <id>.json of a pending file
+type pendingRecord struct {
+	*PendingFile
+	Meta FileMeta `json:"meta"`
+	// Archive is set for a folder upload, published as the tree Filename
+	Archive bool `json:"archive,omitempty"`
+	// UploaderOrgs are the orgs of the uploader, none of which may approve the file
+	UploaderOrgs []string `json:"uploaderOrgs,omitempty"`
+}
+
+// pendingStore holds public uploads awaiting approval: the content as <id>.data, and its pendingRecord as <id>.json
+type pendingStore struct {
+	dir string
+	// key encrypts the pending content at rest, when set
+	key *MasterKey
+	// mu serializes reviews, so that an item is approved or rejected once
+	mu sync.Mutex
+}
+
+func newPendingStore(dir string, key *MasterKey) (*pendingStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create pending folder %s", dir)
+	}
+	return &pendingStore{dir: dir, key: key}, nil
+}
+
+// Add stores f, and returns its pending record. The metadata is written last, so that List only sees complete items.
+func (p *pendingStore) Add(f UploadedFile, meta FileMeta, uploader Identity, peer string, checksum string) (*PendingFile,
+	error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	item := &PendingFile{
+		Id:         hex.EncodeToString(b),
+		Filename:   f.Filename,
+		Uploader:   uploader.Name,
+		Peer:       peer,
+		Size:       int64(len(f.Data)),
+		Checksum:   checksum,
+		UploadedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if err := writeAtRest(filepath.Join(p.dir, item.Id+pendingDataExt), f.Data, 0600, p.key); err != nil {
+		return nil, errors.Wrapf(err, "failed to write pending file")
+	}
+	rec, err := json.Marshal(pendingRecord{PendingFile: item, Meta: meta, Archive: f.Archive, UploaderOrgs: uploader.Orgs})
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(filepath.Join(p.dir, item.Id+pendingMetaExt), rec, 0600); err != nil {
+		return nil, errors.Wrapf(err, "failed to write pending metadata")
+	}
+	return item, nil
+}
+
+// List returns the pending files, oldest first
+func (p *pendingStore) List() (items []*PendingFile, err error) {
+	entries, err := ioutil.ReadDir(p.dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list pending files")
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), pendingMetaExt) {
+			continue
+		}
+		rec, err := p.get(strings.TrimSuffix(entry.Name(), pendingMetaExt))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, rec.PendingFile)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].UploadedAt < items[j].UploadedAt })
+	return
+}
+
+// Held returns the pending item of filename with checksum, or nil
+func (p *pendingStore) Held(filename string, checksum string) (*PendingFile, error) {
+	items, err := p.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if item.Filename == filename && item.Checksum == checksum {
+			return item, nil
+		}
+	}
+	return nil, nil
+}
+
+func (p *pendingStore) get(id string) (*pendingRecord, error) {
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return nil, errPendingNotFound
+	}
+	b, err := ioutil.ReadFile(filepath.Join(p.dir, id+pendingMetaExt))
+	if os.IsNotExist(err) {
+		return nil, errPendingNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read pending metadata %s", id)
+	}
+	rec := &pendingRecord{PendingFile: &PendingFile{}}
+	if err = json.Unmarshal(b, rec); err != nil {
+		return nil, errors.Wrapf(err, "invalid pending metadata %s", id)
+	}
+	return rec, nil
+}
+
+// review calls fn with the pending item id and its content, and removes the item when fn succeeds
+func (p *pendingStore) review(id string, fn func(rec *pendingRecord, data []byte) error) (*PendingFile, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rec, err := p.get(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readAtRest(filepath.Join(p.dir, id+pendingDataExt), p.key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read pending file %s", id)
+	}
+	if err = fn(rec, data); err != nil {
+		return nil, err
+	}
+
+	// metadata first: a half removed item is no longer listed
+	if err = os.Remove(filepath.Join(p.dir, id+pendingMetaExt)); err != nil {
+		return nil, err
+	}
+	return rec.PendingFile, os.Remove(filepath.Join(p.dir, id+pendingDataExt))
+}
+
+// holdForApproval keeps a public upload in the pending area, when approval is required
+func (s *ServerGRPC) holdForApproval(ctx context.Context, f UploadedFile, meta FileMeta, checksum string) (*PendingFile, error) {
+	addr, _ := peerInfo(ctx)
+	id, _ := s.identity(ctx)
+	item, err := s.pending.Add(f, meta, id, addr, checksum)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot hold file for approval: %v", err))
+	}
+	log.Printf("public file %s is pending approval: id %s", f.Filename, item.Id)
+	return item, nil
+}
+
+func (s *ServerGRPC) ListPending(ctx context.Context, req *ListPendingRequest) (res *ListPendingResponse, err error) {
+	if err = s.authorize(ctx, authOpAdmin); err != nil {
+		return
+	}
+	if s.pending == nil {
+		return nil, logError(status.Errorf(codes.FailedPrecondition, "approval is not enabled"))
+	}
+
+	items, err := s.pending.List()
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "%v", err))
+	}
+	return &ListPendingResponse{Files: items}, nil
+}
+
+// Approve publishes a pending file. The reviewer must not be its uploader, nor of an org of the uploader, and both must
+// be identified.
+func (s *ServerGRPC) Approve(ctx context.Context, req *ReviewRequest) (res *ReviewResponse, err error) {
+	return s.review(ctx, req, auditOpApprove, func(rec *pendingRecord, data []byte) error {
+		var (
+			err    error
+			files  []ArchiveFile
+			before []StoredFile
+		)
+		if rec.Archive {
+			if files, err = readTar(bytes.NewReader(data), s.maxFileSize); err == nil {
+				before, _ = s.fileStore.List(rec.Filename, "public")
+				err = s.fileStore.SaveTree(rec.Filename, "public", files)
+			}
+		} else if _, err = s.fileStore.Save(rec.Filename, "public", *bytes.NewBuffer(data)); err == nil {
+			err = s.fileStore.SaveMeta(rec.Filename, "public", rec.Meta)
+		}
+		if err != nil {
+			return logError(status.Errorf(codes.Internal, "cannot publish file: %v", err))
+		}
+		if rec.Archive {
+			s.notifyTree("public", rec.Filename, before, files)
+		} else {
+			s.notifySaved("public", rec.Filename, data)
+		}
+		log.Printf("pending file %s approved: %s published", rec.Id, rec.Filename)
+		if rec.Archive {
+			s.webhookTree(ctx, "public", rec.Filename, files)
+		} else {
+			s.webhook(ctx, webhookCommitted, "public", rec.Filename, rec.Size, rec.Checksum)
+		}
+		return nil
+	})
+}
+
+// Reject discards a pending file
+func (s *ServerGRPC) Reject(ctx context.Context, req *ReviewRequest) (res *ReviewResponse, err error) {
+	return s.review(ctx, req, auditOpReject, func(rec *pendingRecord, data []byte) error {
+		log.Printf("pending file %s rejected: %s (%s)", rec.Id, rec.Filename, req.GetReason())
+		return nil
+	})
+}
+
+func (s *ServerGRPC) review(ctx context.Context, req *ReviewRequest, op string,
+	fn func(rec *pendingRecord, data []byte) error) (res *ReviewResponse, err error) {
+	var item *PendingFile
+	defer func() {
+		rec := AuditRecord{Operation: op, Filename: req.GetId(), FileType: "public"}
+		if item != nil {
+			rec.Filename, rec.Size, rec.Checksum = item.Filename, item.Size, item.Checksum
+		}
+		s.audit(ctx, rec, err)
+	}()
+
+	if err = s.authorize(ctx, authOpAdmin); err != nil {
+		return
+	}
+	if s.pending == nil {
+		return nil, logError(status.Errorf(codes.FailedPrecondition, "approval is not enabled"))
+	}
+	reviewer, _ := s.identity(ctx)
+
+	item, err = s.pending.review(req.GetId(), func(rec *pendingRecord, data []byte) error {
+		if op == auditOpApprove && (rec.Uploader == "" || reviewer.Name == "") {
+			return logError(status.Errorf(codes.PermissionDenied,
+				"anonymous uploads cannot be approved, nor approved anonymously: reject it and upload with an identity"))
+		}
+		if op == auditOpApprove && rec.Uploader == reviewer.Name {
+			return logError(status.Errorf(codes.PermissionDenied, "'%s' cannot approve own upload", reviewer.Name))
+		}
+		if op == auditOpApprove {
+			for _, org := range reviewer.Orgs {
+				if memberOf(org, rec.UploaderOrgs) {
+					return logError(status.Errorf(codes.PermissionDenied,
+						"'%s' cannot approve an upload of '%s': both belong to %s", reviewer.Name, rec.Uploader, org))
+				}
+			}
+		}
+		return fn(rec, data)
+	})
+	if err == errPendingNotFound {
+		return nil, logError(status.Errorf(codes.NotFound, "%s: %v", req.GetId(), err))
+	}
+	if _, ok := status.FromError(err); err != nil && !ok {
+		return nil, logError(status.Errorf(codes.Internal, "%v", err))
+	}
+	if err != nil {
+		return
+	}
+	return &ReviewResponse{File: item}, nil
+}
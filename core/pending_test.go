@@ -0,0 +1,59 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newPendingServer(t *testing.T) *ServerGRPC {
+	root := t.TempDir()
+	pending, err := newPendingStore(filepath.Join(root, internalDir, "pending"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ServerGRPC{
+		fileStore:   NewDiskStore(root),
+		pending:     pending,
+		maxFileSize: maxFileSize,
+		authPolicy:  AuthPolicy{Admins: []string{"org1-ops", "org1-admin", "org2-admin"}},
+	}
+}
+
+func TestApproveRequiresAnotherOrg(t *testing.T) {
+	tests := []struct {
+		name     string
+		uploader context.Context
+		reviewer context.Context
+		want     codes.Code
+	}{
+		{"own upload", certContext("org1-ops", "org1"), certContext("org1-ops", "org1"), codes.PermissionDenied},
+		{"same org", certContext("org1-ops", "org1"), certContext("org1-admin", "org1"), codes.PermissionDenied},
+		{"same org, other case", certContext("org1-ops", "Org1"), certContext("org1-admin", "org1"),
+			codes.PermissionDenied},
+		{"anonymous upload", context.Background(), certContext("org2-admin", "org2"), codes.PermissionDenied},
+		{"other org", certContext("org1-ops", "org1"), certContext("org2-admin", "org2"), codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newPendingServer(t)
+			f := UploadedFile{Filename: "tlsca/org1.crt", FileType: "public", Data: []byte("ca")}
+			item, err := s.holdForApproval(tt.uploader, f, FileMeta{}, "checksum")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = s.Approve(tt.reviewer, &ReviewRequest{Id: item.Id})
+			if got := status.Code(err); got != tt.want {
+				t.Fatalf("Approve = %s (%v), want %s", got, err, tt.want)
+			}
+			_, statErr := s.fileStore.Stat(f.Filename, "public")
+			if published := statErr == nil; published != (tt.want == codes.OK) {
+				t.Errorf("published = %v after Approve = %s", published, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,630 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	replicatePull = "pull"
+	replicatePush = "push"
+	replicateBoth = "both"
+
+	// replicaUploader prefixes the peer name, as the uploader of the replicas held for approval
+	replicaUploader = "replica:"
+)
+
+// PeerConfig is another server replicating the public files
+type PeerConfig struct {
+	// Name identifies the peer in the logs, the status and the state file; the address by default
+	Name               string
+	Address            string
+	RootCertificate    string
+	ServerNameOverride string
+	// Certificate and Key are the client certificate presented to the peer
+	Certificate string
+	Key         string
+	// TokenFile holds a bearer token presented to the peer
+	TokenFile string
+	// Mode is pull (the default), push or both
+	Mode string
+}
+
+type ReplicationConfig struct {
+	// Peers replicate the public files; replication is disabled when empty
+	Peers []PeerConfig
+	// StateFile keeps the event seq reached with each peer, across restarts
+	StateFile string
+}
+
+// parsePeers reads peers as urls, e.g.
+// grpcs://org2.example.com:1313?name=org2&cacert=org2-ca.crt&cert=tls.crt&key=tls.key&mode=both
+func parsePeers(values []string) (peers []PeerConfig, err error) {
+	names := map[string]bool{}
+	for _, value := range values {
+		u, err := url.Parse(value)
+		if err != nil || u.Scheme != "grpcs" || u.Host == "" {
+			return nil, errors.Errorf("invalid peer %s: use grpcs://host:port?cacert=path/to/ca.crt", value)
+		}
+		q := u.Query()
+		peer := PeerConfig{
+			Name:               q.Get("name"),
+			Address:            u.Host,
+			RootCertificate:    q.Get("cacert"),
+			ServerNameOverride: q.Get("servername"),
+			Certificate:        q.Get("cert"),
+			Key:                q.Get("key"),
+			TokenFile:          q.Get("token-file"),
+			Mode:               q.Get("mode"),
+		}
+		if peer.Name == "" {
+			peer.Name = peer.Address
+		}
+		if peer.Mode == "" {
+			peer.Mode = replicatePull
+		}
+		switch {
+		case peer.Mode != replicatePull && peer.Mode != replicatePush && peer.Mode != replicateBoth:
+			return nil, errors.Errorf("invalid mode of peer %s: use pull, push or both", peer.Name)
+		case peer.RootCertificate == "":
+			return nil, errors.Errorf("peer %s requires cacert", peer.Name)
+		case (peer.Certificate == "") != (peer.Key == ""):
+			return nil, errors.Errorf("cert and key of peer %s must be set together", peer.Name)
+		case names[peer.Name]:
+			return nil, errors.Errorf("duplicate peer %s", peer.Name)
+		}
+		names[peer.Name] = true
+		peers = append(peers, peer)
+	}
+	return
+}
+
+// replicaCursor is the last event seq applied with a peer
+type replicaCursor struct {
+	PullSeq uint64 `json:"pullSeq,omitempty"`
+	PushSeq uint64 `json:"pushSeq,omitempty"`
+}
+
+// peerStatus is the state of the replication with a peer, as reported by the ReplicationStatus rpc
+type peerStatus struct {
+	connected   bool
+	lastSyncAt  time.Time
+	lastError   string
+	lastErrorAt time.Time
+	pulled      int64
+	pushed      int64
+	deleted     int64
+}
+
+// replicaPeer is a peer, and the client connected to it
+type replicaPeer struct {
+	cfg    PeerConfig
+	client *ClientGRPC
+	mu     sync.Mutex
+	status peerStatus
+}
+
+func (p *replicaPeer) update(fn func(st *peerStatus)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fn(&p.status)
+}
+
+// fileFailed records the failure of a single file. It returns err when the peer failed, rather than the file: the
+// replication then starts over after a backoff.
+func (p *replicaPeer) fileFailed(ctx context.Context, fileId string, err error) error {
+	if ctx.Err() != nil || p.client.retryPolicy.retryable(err) {
+		return err
+	}
+	log.Printf("replication of %s with %s failed: %v", fileId, p.cfg.Name, err)
+	p.update(func(st *peerStatus) {
+		st.lastError = fileId + ": " + err.Error()
+		st.lastErrorAt = time.Now()
+	})
+	return nil
+}
+
+// replicator keeps the public files converged with the peers. Pulling follows the events of a peer, and pushing the
+// local events; each starts with a full comparison of the files, after every reconnection. Files with different
+// checksums resolve to the last change, by time.
+type replicator struct {
+	cfg     ReplicationConfig
+	peers   []*replicaPeer
+	mu      sync.Mutex
+	cursors map[string]*replicaCursor
+}
+
+// newReplicator connects to the peers; maxFileSize bounds the files pulled from them, as it bounds uploads
+func newReplicator(cfg ReplicationConfig, maxFileSize int64) (*replicator, error) {
+	r := &replicator{cfg: cfg, cursors: map[string]*replicaCursor{}}
+	b, err := ioutil.ReadFile(cfg.StateFile)
+	if err == nil {
+		err = json.Unmarshal(b, &r.cursors)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read replication state %s", cfg.StateFile)
+	}
+
+	retryCodes, err := parseRetryCodes(DefaultRetryCodes)
+	if err != nil {
+		return nil, err
+	}
+	for _, peer := range cfg.Peers {
+		var token string
+		if peer.TokenFile != "" {
+			b, err := ioutil.ReadFile(peer.TokenFile)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read token of peer %s", peer.Name)
+			}
+			token = strings.TrimSpace(string(b))
+		}
+		client, err := NewClientGRPC(ClientGRPCConfig{
+			Address:            peer.Address,
+			RootCertificate:    peer.RootCertificate,
+			ServerNameOverride: peer.ServerNameOverride,
+			Certificate:        peer.Certificate,
+			Key:                peer.Key,
+			Token:              token,
+			UsePublicFolder:    true,
+			Quiet:              true,
+			Progress:           ioutil.Discard,
+			MaxDownloadSize:    maxFileSize,
+			Retry: RetryPolicy{MaxAttempts: 3, InitialBackoff: 500 * time.Millisecond, MaxBackoff: 10 * time.Second,
+				Multiplier: 2, Jitter: 0.2, Codes: retryCodes},
+			Timeout: time.Minute,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to connect to peer %s", peer.Name)
+		}
+		if r.cursors[peer.Name] == nil {
+			r.cursors[peer.Name] = &replicaCursor{}
+		}
+		r.peers = append(r.peers, &replicaPeer{cfg: peer, client: &client})
+	}
+	return r, nil
+}
+
+func (r *replicator) cursor(name string) replicaCursor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return *r.cursors[name]
+}
+
+// advance updates the cursor of a peer, and saves the state file
+func (r *replicator) advance(name string, fn func(cursor *replicaCursor)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fn(r.cursors[name])
+	b, err := json.MarshalIndent(r.cursors, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(r.cfg.StateFile), 0700); err != nil {
+		return err
+	}
+	return errors.Wrapf(writeFileAtomic(r.cfg.StateFile, b, 0600), "failed to save replication state %s",
+		r.cfg.StateFile)
+}
+
+// run replicates with every peer, until stop is closed
+func (r *replicator) run(s *ServerGRPC, stop chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	for _, p := range r.peers {
+		if p.cfg.Mode != replicatePush {
+			go r.loop(ctx, s, p, replicatePull, r.pull)
+		}
+		if p.cfg.Mode != replicatePull {
+			go r.loop(ctx, s, p, replicatePush, r.push)
+		}
+	}
+}
+
+// loop runs fn until ctx is done; fn returns on failure, and starts over after a backoff, reset once the peer answered
+func (r *replicator) loop(ctx context.Context, s *ServerGRPC, p *replicaPeer, mode string,
+	fn func(ctx context.Context, s *ServerGRPC, p *replicaPeer) error) {
+	backoff := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Minute, Multiplier: 2, Jitter: 0.2}
+	for failures := 1; ; failures++ {
+		err := fn(ctx, s, p)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errors.New("stream ended")
+		}
+		p.update(func(st *peerStatus) {
+			if st.connected {
+				failures = 1
+			}
+			st.connected = false
+			st.lastError = err.Error()
+			st.lastErrorAt = time.Now()
+		})
+		wait := backoff.backoff(failures)
+		log.Printf("%s replication with %s failed, retrying in %s: %v", mode, p.cfg.Name,
+			wait.Round(time.Millisecond), err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// synced records the end of a full comparison with the peer
+func (p *replicaPeer) synced() {
+	p.update(func(st *peerStatus) {
+		st.connected = true
+		st.lastSyncAt = time.Now()
+	})
+}
+
+// pull copies the files of the peer which are missing, or older, here; then follows the events of the peer
+func (r *replicator) pull(ctx context.Context, s *ServerGRPC, p *replicaPeer) error {
+	remote, err := p.client.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	for _, f := range remote {
+		modifiedAt, _ := time.Parse(time.RFC3339, f.GetModifiedAt())
+		if err = r.pullFile(ctx, s, p, f.GetFilename(), f.GetChecksum(), modifiedAt); err != nil {
+			return err
+		}
+	}
+	p.synced()
+
+	return p.client.Subscribe(ctx, "", r.cursor(p.cfg.Name).PullSeq+1, func(event *FileEvent) error {
+		changedAt, _ := time.Parse(time.RFC3339Nano, event.GetTime())
+		var err error
+		if event.GetType() == eventDeleted {
+			err = r.pullDelete(s, p, event.GetFilename(), changedAt)
+		} else {
+			err = r.pullFile(ctx, s, p, event.GetFilename(), event.GetChecksum(), changedAt)
+		}
+		if err != nil {
+			return err
+		}
+		return r.advance(p.cfg.Name, func(cursor *replicaCursor) { cursor.PullSeq = event.GetSeq() })
+	})
+}
+
+// pullFile copies fileId from the peer, unless the local copy has the same checksum, or changed last
+func (r *replicator) pullFile(ctx context.Context, s *ServerGRPC, p *replicaPeer, fileId string, sum string,
+	changedAt time.Time) error {
+	localSum, _, localChangedAt, err := s.localFile(fileId)
+	if err != nil {
+		return p.fileFailed(ctx, fileId, err)
+	}
+	if localSum == sum || !changedAt.After(localChangedAt) {
+		return nil
+	}
+
+	var (
+		data   []byte
+		header *FileResponse
+	)
+	err = p.client.retry(ctx, "download of "+fileId, func(ctx context.Context) (err error) {
+		data, header, err = p.client.fetch(ctx, fileId)
+		return
+	})
+	if status.Code(errors.Cause(err)) == codes.NotFound {
+		// deleted meanwhile; its event follows
+		return nil
+	}
+	var held bool
+	if err == nil {
+		held, err = s.saveReplica(ctx, p.cfg, fileId, data, header)
+	}
+	if err != nil {
+		return p.fileFailed(ctx, fileId, err)
+	}
+	if held {
+		return nil
+	}
+	log.Printf("file replicated (public) : %s, from %s", fileId, p.cfg.Name)
+	p.update(func(st *peerStatus) { st.pulled++ })
+	return nil
+}
+
+// pullDelete removes fileId, deleted by the peer, unless it changed here since. With --require-approval, the
+// deletions of the peer are not replicated: they would unpublish an approved file without a review.
+func (r *replicator) pullDelete(s *ServerGRPC, p *replicaPeer, fileId string, deletedAt time.Time) error {
+	localSum, size, localChangedAt, err := s.localFile(fileId)
+	if err != nil || localSum == "" || !deletedAt.After(localChangedAt) {
+		return err
+	}
+	if s.pending != nil {
+		log.Printf("deletion of %s by %s is not replicated: uploads require approval", fileId, p.cfg.Name)
+		return nil
+	}
+	err = s.fileStore.Delete(fileId, "public")
+	s.auditReplica(p.cfg, AuditRecord{
+		Operation: auditOpDelete,
+		Filename:  fileId,
+		FileType:  "public",
+		Size:      size,
+		Checksum:  localSum,
+	}, err)
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete %s", fileId)
+	}
+	s.notifyDeleted("public", fileId)
+	log.Printf("file deleted (public) : %s, by %s", fileId, p.cfg.Name)
+	p.update(func(st *peerStatus) { st.deleted++ })
+	return nil
+}
+
+// push copies the local files which are missing, or older, on the peer; then follows the local events
+func (r *replicator) push(ctx context.Context, s *ServerGRPC, p *replicaPeer) error {
+	remote, err := p.client.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	remoteFiles := make(map[string]*RemoteFile, len(remote))
+	for _, f := range remote {
+		remoteFiles[f.GetFilename()] = f
+	}
+	local, err := s.fileStore.List("", "public")
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return err
+	}
+	for _, f := range local {
+		if err = r.pushFile(ctx, s, p, f.FileId, remoteFiles[f.FileId]); err != nil {
+			return err
+		}
+	}
+	p.synced()
+
+	return s.eventLog.Follow(ctx, r.cursor(p.cfg.Name).PushSeq+1, func(rec eventRecord) error {
+		if rec.FileType == "public" {
+			if err := r.pushEvent(ctx, s, p, rec); err != nil {
+				return err
+			}
+		}
+		return r.advance(p.cfg.Name, func(cursor *replicaCursor) { cursor.PushSeq = rec.Seq })
+	})
+}
+
+func (r *replicator) pushEvent(ctx context.Context, s *ServerGRPC, p *replicaPeer, rec eventRecord) error {
+	remote, err := p.client.Stat(ctx, rec.Filename)
+	if status.Code(errors.Cause(err)) == codes.NotFound {
+		remote, err = nil, nil
+	}
+	if err != nil {
+		return p.fileFailed(ctx, rec.Filename, err)
+	}
+	if rec.Type != eventDeleted {
+		return r.pushFile(ctx, s, p, rec.Filename, remote)
+	}
+
+	deletedAt, _ := time.Parse(time.RFC3339Nano, rec.Time)
+	localSum, _, _, err := s.localFile(rec.Filename)
+	if err != nil || localSum != "" || remote == nil {
+		// created again since, or already gone from the peer
+		return err
+	}
+	if modifiedAt, _ := time.Parse(time.RFC3339, remote.GetModifiedAt()); modifiedAt.After(deletedAt) {
+		return nil
+	}
+	_, err = p.client.Delete(ctx, rec.Filename)
+	if status.Code(errors.Cause(err)) == codes.NotFound {
+		err = nil
+	}
+	if err != nil {
+		return p.fileFailed(ctx, rec.Filename, err)
+	}
+	p.update(func(st *peerStatus) { st.deleted++ })
+	return nil
+}
+
+// pushFile uploads fileId to the peer, unless remote, its copy there, has the same checksum, or changed last
+func (r *replicator) pushFile(ctx context.Context, s *ServerGRPC, p *replicaPeer, fileId string,
+	remote *RemoteFile) error {
+	localSum, _, localChangedAt, err := s.localFile(fileId)
+	if err != nil {
+		return p.fileFailed(ctx, fileId, err)
+	}
+	if localSum == "" {
+		// deleted meanwhile; its event follows
+		return nil
+	}
+	if remote != nil {
+		modifiedAt, _ := time.Parse(time.RFC3339, remote.GetModifiedAt())
+		if remote.GetChecksum() == localSum || modifiedAt.After(localChangedAt) {
+			return nil
+		}
+	}
+
+	data, info, err := s.replicaUpload(fileId)
+	if err == nil {
+		_, err = p.client.send(ctx, fileId, info, bytes.NewReader(data))
+	}
+	if err != nil {
+		return p.fileFailed(ctx, fileId, err)
+	}
+	log.Printf("file replicated (public) : %s, to %s", fileId, p.cfg.Name)
+	p.update(func(st *peerStatus) { st.pushed++ })
+	return nil
+}
+
+// localFile returns the checksum of a public file, empty when it does not exist, its size, and the time of its last
+// change, including its deletion
+func (s *ServerGRPC) localFile(fileId string) (sum string, size int64, changedAt time.Time, err error) {
+	changedAt, known := s.eventLog.ChangedAt("public", fileId)
+	stored, err := s.fileStore.Stat(fileId, "public")
+	if os.IsNotExist(errors.Cause(err)) {
+		return "", 0, changedAt, nil
+	}
+	if err != nil {
+		return
+	}
+	if !known {
+		changedAt = stored.ModTime
+	}
+
+	f, size, err := s.fileStore.Open(fileId, "public")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sum, err = checksum(f)
+	return
+}
+
+// replicaUpload reads a public file as stored, with its metadata, to upload it to a peer
+func (s *ServerGRPC) replicaUpload(fileId string) (data []byte, info *UploadFileInfo, err error) {
+	f, _, err := s.fileStore.Open(fileId, "public")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if data, err = ioutil.ReadAll(f); err != nil {
+		return
+	}
+
+	meta, err := s.fileStore.Meta(fileId, "public")
+	if err != nil {
+		return
+	}
+	info = &UploadFileInfo{Filename: fileId, FileType: "public", Mode: uint32(meta.Mode)}
+	if meta.Signature != nil {
+		info.Signature = meta.Signature.proto()
+	}
+	if meta.Encryption != nil {
+		info.Encryption = meta.Encryption.proto()
+	}
+	return
+}
+
+// saveReplica saves a public file copied from peer. It is checked as an upload is, and held for approval when approval
+// is required, as uploaded by replica:<peer name>; held reports it. The same content is held once, however often it is
+// pulled.
+func (s *ServerGRPC) saveReplica(ctx context.Context, peer PeerConfig, fileId string, data []byte,
+	header *FileResponse) (held bool, err error) {
+	sum, err := checksum(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	defer func() {
+		s.auditReplica(peer, AuditRecord{
+			Operation: auditOpUpload,
+			Filename:  fileId,
+			FileType:  "public",
+			Size:      int64(len(data)),
+			Checksum:  sum,
+		}, err)
+	}()
+
+	if int64(len(data)) > s.maxFileSize {
+		return false, logError(status.Errorf(codes.InvalidArgument, "file is too large: %d > %d", len(data),
+			s.maxFileSize))
+	}
+	if err = s.fileStore.Check(fileId, "public"); err != nil {
+		return false, logError(status.Errorf(codes.InvalidArgument, "cannot save file: %v", err))
+	}
+
+	meta := FileMeta{Mode: os.FileMode(header.GetMode()).Perm()}
+	if encryption := header.GetEncryption(); encryption != nil {
+		meta.Encryption = &EncryptionMeta{Format: encryption.GetFormat(), Recipients: encryption.GetRecipients()}
+	}
+	if signature := header.GetSignature(); signature != nil {
+		if meta.Signature, err = s.verifyUploadSignature(fileId, data, signature); err != nil {
+			return
+		}
+	} else if s.requireSignature {
+		return false, logError(status.Errorf(codes.InvalidArgument, "%s rejected: a detached signature is required",
+			fileId))
+	}
+
+	uploaded := UploadedFile{Filename: fileId, FileType: "public", Data: data, Encrypted: meta.Encryption != nil}
+	if s.pending != nil {
+		if item, err := s.pending.Held(fileId, sum); err != nil || item != nil {
+			return item != nil, err
+		}
+	}
+	if err = s.validateFile(uploaded); err != nil {
+		return
+	}
+	if s.scanner != nil {
+		if err = s.scanUpload(ctx, uploaded, sum); err != nil {
+			return
+		}
+	}
+
+	if s.pending != nil {
+		item, err := s.pending.Add(uploaded, meta, Identity{Name: replicaUploader + peer.Name}, peer.Address,
+			sum)
+		if err != nil {
+			return false, errors.Wrapf(err, "cannot hold %s for approval", fileId)
+		}
+		log.Printf("public file %s from %s is pending approval: id %s", fileId, peer.Name, item.Id)
+		return true, nil
+	}
+
+	if _, err = s.fileStore.Save(fileId, "public", *bytes.NewBuffer(data)); err == nil {
+		err = s.fileStore.SaveMeta(fileId, "public", meta)
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "cannot save %s", fileId)
+	}
+	s.notifySaved("public", fileId, data)
+	return false, nil
+}
+
+// ReplicationStatus reports the replication with each peer (admin)
+func (s *ServerGRPC) ReplicationStatus(ctx context.Context, req *ReplicationStatusRequest) (res *ReplicationStatusResponse,
+	err error) {
+	if err = s.authorize(ctx, authOpAdmin); err != nil {
+		return
+	}
+	if s.replicator == nil {
+		return nil, logError(status.Errorf(codes.FailedPrecondition, "replication is not enabled"))
+	}
+
+	res = &ReplicationStatusResponse{}
+	for _, p := range s.replicator.peers {
+		cursor := s.replicator.cursor(p.cfg.Name)
+		p.mu.Lock()
+		peer := &PeerStatus{
+			Name:      p.cfg.Name,
+			Address:   p.cfg.Address,
+			Mode:      p.cfg.Mode,
+			Connected: p.status.connected,
+			PullSeq:   cursor.PullSeq,
+			PushSeq:   cursor.PushSeq,
+			LastError: p.status.lastError,
+			Pulled:    p.status.pulled,
+			Pushed:    p.status.pushed,
+			Deleted:   p.status.deleted,
+		}
+		if !p.status.lastSyncAt.IsZero() {
+			peer.LastSyncAt = p.status.lastSyncAt.UTC().Format(time.RFC3339)
+		}
+		if !p.status.lastErrorAt.IsZero() {
+			peer.LastErrorAt = p.status.lastErrorAt.UTC().Format(time.RFC3339)
+		}
+		p.mu.Unlock()
+		res.Peers = append(res.Peers, peer)
+	}
+	return
+}
@@ -0,0 +1,45 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/net/context"
+)
+
+var ReplicationCommand = cli.Command{
+	Name:  "replication",
+	Usage: "inspect the replication of the public files between servers",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "status",
+			Usage:  "show the replication of the server with each of its peers (admin)",
+			Action: replicationStatusAction,
+			Flags:  clientConnectionFlags,
+		},
+	},
+}
+
+func replicationStatusAction(c *cli.Context) (err error) {
+	client := newClientFromFlags(c, false)
+	defer client.Close()
+
+	peers, err := client.ReplicationStatus(context.Background())
+	must(err)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tADDRESS\tMODE\tCONNECTED\tPULL SEQ\tPUSH SEQ\tPULLED\tPUSHED\tDELETED\tLAST SYNC\tLAST ERROR")
+	for _, p := range peers {
+		lastError := p.GetLastError()
+		if lastError != "" {
+			lastError = p.GetLastErrorAt() + " " + strconv.Quote(lastError)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%d\t%d\t%d\t%d\t%d\t%s\t%s\n", p.GetName(), p.GetAddress(), p.GetMode(),
+			p.GetConnected(), p.GetPullSeq(), p.GetPushSeq(), p.GetPulled(), p.GetPushed(), p.GetDeleted(),
+			p.GetLastSyncAt(), lastError)
+	}
+	return w.Flush()
+}
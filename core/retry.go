@@ -0,0 +1,156 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// grpcRetryEnv enables the retries of the service config in grpc-go 1.31; without it, the client retries unary calls
+// itself
+const grpcRetryEnv = "GRPC_GO_RETRY"
+
+// RetryPolicy retries the operations failing with a transient status, with exponential backoff and jitter
+type RetryPolicy struct {
+	// MaxAttempts counts the first attempt; 0 or 1 disables retries
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter randomizes each backoff by up to this fraction, e.g. 0.2 for ±20%
+	Jitter float64
+	// Codes are the status codes worth another attempt
+	Codes []codes.Code
+}
+
+// DefaultRetryCodes are the transient status codes: the server is unreachable, overloaded or rate limiting
+var DefaultRetryCodes = []string{"unavailable", "resource-exhausted", "aborted"}
+
+// parseRetryCodes reads status code names, e.g. unavailable or RESOURCE_EXHAUSTED
+func parseRetryCodes(names []string) (retryCodes []codes.Code, err error) {
+	for _, name := range names {
+		var code codes.Code
+		upper := strings.ToUpper(strings.Replace(strings.TrimSpace(name), "-", "_", -1))
+		if err = code.UnmarshalJSON([]byte(strconv.Quote(upper))); err != nil || code == codes.OK {
+			return nil, errors.Errorf("invalid status code %s", name)
+		}
+		retryCodes = append(retryCodes, code)
+	}
+	return
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	st, ok := status.FromError(errors.Cause(err))
+	if !ok {
+		return false
+	}
+	for _, code := range p.Codes {
+		if st.Code() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff is the wait after the failed attempt
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	d := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	d *= 1 + p.Jitter*(2*rand.Float64()-1)
+	return time.Duration(d)
+}
+
+// do calls fn until it succeeds, fails with a status not worth a retry, or the attempts or ctx run out. Retries are
+// reported on stderr, naming the operation op.
+func (p RetryPolicy) do(ctx context.Context, op string, fn func(ctx context.Context) error) (err error) {
+	for attempt := 1; ; attempt++ {
+		if err = fn(ctx); err == nil || attempt >= p.MaxAttempts || !p.retryable(err) || ctx.Err() != nil {
+			return
+		}
+		wait := p.backoff(attempt)
+		fmt.Fprintf(os.Stderr, "\n%s failed (attempt %d of %d), retrying in %s: %v\n", op, attempt, p.MaxAttempts,
+			wait.Round(time.Millisecond), err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// retry runs an operation of the client under its timeout and retry policy
+func (c *ClientGRPC) retry(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	return c.retryPolicy.do(ctx, op, fn)
+}
+
+// retryUnary is the unary interceptor retrying the calls, when grpc does not
+func (c *ClientGRPC) retryUnary(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return c.retry(ctx, method, func(ctx context.Context) error {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	})
+}
+
+// serviceConfig is the grpc service config of the unary methods: their timeout, and their retries
+func serviceConfig(p RetryPolicy, timeout time.Duration) (string, error) {
+	type name struct {
+		Service string `json:"service"`
+		Method  string `json:"method"`
+	}
+	type retryPolicy struct {
+		MaxAttempts          int          `json:"maxAttempts"`
+		InitialBackoff       string       `json:"initialBackoff"`
+		MaxBackoff           string       `json:"maxBackoff"`
+		BackoffMultiplier    float64      `json:"backoffMultiplier"`
+		RetryableStatusCodes []codes.Code `json:"retryableStatusCodes"`
+	}
+	type methodConfig struct {
+		Name        []name       `json:"name"`
+		Timeout     string       `json:"timeout,omitempty"`
+		RetryPolicy *retryPolicy `json:"retryPolicy,omitempty"`
+	}
+	seconds := func(d time.Duration) string {
+		return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+	}
+
+	var config methodConfig
+	for _, method := range _GuploadService_serviceDesc.Methods {
+		config.Name = append(config.Name, name{_GuploadService_serviceDesc.ServiceName, method.MethodName})
+	}
+	if timeout > 0 {
+		config.Timeout = seconds(timeout)
+	}
+	if p.MaxAttempts > 1 && len(p.Codes) > 0 && p.InitialBackoff > 0 && p.MaxBackoff > 0 {
+		config.RetryPolicy = &retryPolicy{
+			MaxAttempts:          p.MaxAttempts,
+			InitialBackoff:       seconds(p.InitialBackoff),
+			MaxBackoff:           seconds(p.MaxBackoff),
+			BackoffMultiplier:    math.Max(p.Multiplier, 1),
+			RetryableStatusCodes: p.Codes,
+		}
+	}
+	b, err := json.Marshal(map[string][]methodConfig{"methodConfig": {config}})
+	return string(b), err
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/net/context"
+	"os"
+	"text/tabwriter"
+)
+
+var ApproveCommand = cli.Command{
+	Name:   "approve",
+	Usage:  "publish a public upload held for approval (admin); --list shows them",
+	Action: approveAction,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "id",
+			Usage: "id of the pending file",
+		},
+		&cli.BoolFlag{
+			Name:  "list",
+			Usage: "list the pending files",
+		},
+	}, clientConnectionFlags...),
+}
+
+var RejectCommand = cli.Command{
+	Name:   "reject",
+	Usage:  "discard a public upload held for approval (admin)",
+	Action: rejectAction,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "id",
+			Usage: "id of the pending file",
+		},
+		&cli.StringFlag{
+			Name:  "reason",
+			Usage: "reason of the rejection, as logged by the server",
+		},
+	}, clientConnectionFlags...),
+}
+
+func approveAction(c *cli.Context) (err error) {
+	id := c.String("id")
+
+	if id == "" && !c.Bool("list") {
+		must(errors.New("id or list must be set"))
+	}
+
+	client := newClientFromFlags(c, true)
+	defer client.Close()
+
+	if c.Bool("list") {
+		files, err := client.ListPending(context.Background())
+		must(err)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tFILENAME\tUPLOADER\tSIZE\tUPLOADED AT\tSHA256")
+		for _, f := range files {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", f.GetId(), f.GetFilename(), f.GetUploader(), f.GetSize(),
+				f.GetUploadedAt(), f.GetChecksum())
+		}
+		return w.Flush()
+	}
+
+	file, err := client.Review(context.Background(), id, true, "")
+	must(err)
+	fmt.Printf("✅ %s approved: %s is public\n", id, file.GetFilename())
+	return
+}
+
+func rejectAction(c *cli.Context) (err error) {
+	id := c.String("id")
+
+	if id == "" {
+		must(errors.New("id must be set"))
+	}
+
+	client := newClientFromFlags(c, true)
+	defer client.Close()
+
+	file, err := client.Review(context.Background(), id, false, c.String("reason"))
+	must(err)
+	fmt.Printf("❌ %s rejected: %s discarded\n", id, file.GetFilename())
+	return
+}
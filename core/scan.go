@@ -0,0 +1,288 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// internalDir is the folder of the store root reserved for staging and quarantine; it is never served
+const internalDir = ".gupload"
+
+// maxScanOutput bounds the scanner output kept as rejection reason
+const maxScanOutput = 1024
+
+type ScanConfig struct {
+	// Command is run with the staged file appended as last argument, or substituted for "{}";
+	// exit code 0 commits the upload, any other code rejects it. It is split into arguments as by a shell, quotes
+	// included, but without expansions.
+	Command       string
+	Timeout       time.Duration
+	MaxConcurrent int
+	StagingDir    string
+	QuarantineDir string
+}
+
+// QuarantineRecord is the metadata written next to a quarantined file
+type QuarantineRecord struct {
+	Filename   string `json:"filename"`
+	FileType   string `json:"fileType"`
+	Identity   string `json:"identity"`
+	Peer       string `json:"peer"`
+	Size       int64  `json:"size"`
+	Checksum   string `json:"checksum"`
+	Time       string `json:"time"`
+	Command    string `json:"command"`
+	ExitCode   int    `json:"exitCode"`
+	Reason     string `json:"reason"`
+	Quarantine string `json:"quarantine"`
+}
+
+// contentScanner runs the external scan command on staged uploads
+type contentScanner struct {
+	args  []string
+	cfg   ScanConfig
+	slots chan struct{}
+}
+
+func newContentScanner(cfg ScanConfig) (*contentScanner, error) {
+	args, err := splitCommand(cfg.Command)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid scan-cmd")
+	}
+	if len(args) == 0 {
+		return nil, errors.New("scan-cmd is empty")
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return nil, errors.Wrapf(err, "invalid scan-cmd")
+	}
+	if cfg.MaxConcurrent < 1 {
+		cfg.MaxConcurrent = 1
+	}
+	for _, dir := range []string{cfg.StagingDir, cfg.QuarantineDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, errors.Wrapf(err, "failed to create %s", dir)
+		}
+	}
+	return &contentScanner{
+		args:  args,
+		cfg:   cfg,
+		slots: make(chan struct{}, cfg.MaxConcurrent),
+	}, nil
+}
+
+// splitCommand splits a command line into its arguments, as a POSIX shell does before expansions: single quotes keep
+// their content as is, double quotes too but for \\, \", \$ and \`, and a backslash escapes any other character
+func splitCommand(line string) ([]string, error) {
+	var (
+		args    []string
+		arg     strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else if r == '\\' && i+1 < len(runes) && strings.ContainsRune(`\"$`+"`", runes[i+1]) {
+				i++
+				arg.WriteRune(runes[i])
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\\':
+			escaped, inArg = true, true
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, errors.New("trailing backslash")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// scan runs the command on path. A rejected file yields a reason; err reports a scanner that could not decide.
+func (sc *contentScanner) scan(ctx context.Context, path string) (exitCode int, reason string, err error) {
+	select {
+	case sc.slots <- struct{}{}:
+		defer func() { <-sc.slots }()
+	case <-ctx.Done():
+		return -1, "", ctx.Err()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sc.cfg.Timeout)
+	defer cancel()
+
+	args := make([]string, 0, len(sc.args)+1)
+	substituted := false
+	for _, arg := range sc.args[1:] {
+		if strings.Contains(arg, "{}") {
+			arg = strings.Replace(arg, "{}", path, -1)
+			substituted = true
+		}
+		args = append(args, arg)
+	}
+	if !substituted {
+		args = append(args, path)
+	}
+
+	// a file rather than a pipe: children of a killed scanner must not hold up Run until they exit
+	output, err := ioutil.TempFile(sc.cfg.StagingDir, "scan-output-")
+	if err != nil {
+		return -1, "", errors.Wrapf(err, "failed to create scan output")
+	}
+	defer os.Remove(output.Name())
+	defer output.Close()
+
+	cmd := exec.CommandContext(ctx, sc.args[0], args...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	err = cmd.Run()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return -1, "", errors.Errorf("scan timed out after %s", sc.cfg.Timeout)
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() < 0 {
+		// killed by a signal: no verdict
+		return -1, "", errors.Wrapf(err, "scan-cmd crashed")
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		out, _ := ioutil.ReadAll(io.NewSectionReader(output, 0, maxScanOutput))
+		reason = strings.TrimSpace(string(out))
+		if reason == "" {
+			reason = exitErr.Error()
+		}
+		return exitErr.ExitCode(), reason, nil
+	}
+	if err != nil {
+		return -1, "", errors.Wrapf(err, "failed to run scan-cmd")
+	}
+	return 0, "", nil
+}
+
+// scanUpload stages f, runs the scanner, and moves rejected files to quarantine. It returns codes.InvalidArgument
+// for rejected files, and codes.Unavailable when the scanner failed, e.g. crashed or timed out, without quarantining
+// the file; either way the upload is not committed. The staged copy is in plaintext, even with a master key, for the
+// scanner to read it: it is created 0600, and removed once scanned.
+func (s *ServerGRPC) scanUpload(ctx context.Context, f UploadedFile, checksum string) error {
+	staged, err := ioutil.TempFile(s.scanner.cfg.StagingDir, "upload-")
+	if err != nil {
+		return logError(status.Errorf(codes.Internal, "cannot stage file: %v", err))
+	}
+	stagedPath := staged.Name()
+	_, err = staged.Write(f.Data)
+	if closeErr := staged.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(stagedPath)
+		return logError(status.Errorf(codes.Internal, "cannot stage file: %v", err))
+	}
+
+	exitCode, reason, scanErr := s.scanner.scan(ctx, stagedPath)
+	if scanErr != nil || exitCode == 0 {
+		_ = os.Remove(stagedPath)
+	}
+	if scanErr != nil {
+		return logError(status.Errorf(codes.Unavailable, "%s was not committed: scan failed: %v", f.Filename, scanErr))
+	}
+	if exitCode == 0 {
+		return nil
+	}
+
+	addr, _ := peerInfo(ctx)
+	id, _ := s.identity(ctx)
+	quarantined := filepath.Join(s.scanner.cfg.QuarantineDir,
+		fmt.Sprintf("%s-%s-%s", time.Now().UTC().Format("20060102T150405"), checksum[:12], filepath.Base(f.Filename)))
+	rec := QuarantineRecord{
+		Filename:   f.Filename,
+		FileType:   f.FileType,
+		Identity:   id.Name,
+		Peer:       addr,
+		Size:       int64(len(f.Data)),
+		Checksum:   checksum,
+		Time:       time.Now().UTC().Format(time.RFC3339),
+		Command:    s.scanner.cfg.Command,
+		ExitCode:   exitCode,
+		Reason:     reason,
+		Quarantine: quarantined,
+	}
+	if err := s.quarantine(stagedPath, rec); err != nil {
+		log.Printf("cannot quarantine %s: %v", f.Filename, err)
+		_ = os.Remove(stagedPath)
+	}
+
+	st := status.Newf(codes.InvalidArgument, "%s rejected by scan (exit code %d)", f.Filename, exitCode)
+	if detailed, err := st.WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: "scan", Description: reason}},
+	}); err == nil {
+		st = detailed
+	}
+	return logError(st.Err())
+}
+
+// quarantine moves a staged file to rec.Quarantine, encrypted with the master key if any, and writes rec next to it as
+// .json. The file is copied, as the staging folder may be another file system, e.g. a tmpfs.
+func (s *ServerGRPC) quarantine(stagedPath string, rec QuarantineRecord) error {
+	data, err := ioutil.ReadFile(stagedPath)
+	if err != nil {
+		return err
+	}
+	if s.masterKey != nil {
+		err = writeAtRest(rec.Quarantine, data, 0600, s.masterKey)
+	} else {
+		err = ioutil.WriteFile(rec.Quarantine, data, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(stagedPath)
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(rec.Quarantine+".json", b, 0600)
+}
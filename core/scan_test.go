@@ -0,0 +1,141 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// stubScanner is a shell script deciding by the content of the scanned file
+const stubScanner = `#!/bin/sh
+case "$(cat "$1")" in
+  *EICAR*) echo "infected: EICAR test signature"; exit 1 ;;
+  *HANG*) exec sleep 10 ;;
+  *CRASH*) kill -9 $$ ;;
+esac
+exit 0
+`
+
+func newStubScanServer(t *testing.T) (*ServerGRPC, ScanConfig) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the stub scanner is a shell script")
+	}
+	dir := t.TempDir()
+	script := filepath.Join(dir, "scan.sh")
+	if err := ioutil.WriteFile(script, []byte(stubScanner), 0700); err != nil {
+		t.Fatal(err)
+	}
+	cfg := ScanConfig{
+		Command:       script + " {}",
+		Timeout:       500 * time.Millisecond,
+		StagingDir:    filepath.Join(dir, internalDir, "staging"),
+		QuarantineDir: filepath.Join(dir, internalDir, "quarantine"),
+	}
+	scanner, err := newContentScanner(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ServerGRPC{scanner: scanner}, cfg
+}
+
+func dirNames(t *testing.T, dir string) (names []string) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return
+}
+
+func TestScanUpload(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		want        codes.Code
+		quarantined bool
+	}{
+		{"clean file is committed", "hello", codes.OK, false},
+		{"verdict quarantines", "X5O EICAR", codes.InvalidArgument, true},
+		{"timeout is no verdict", "HANG", codes.Unavailable, false},
+		{"crash is no verdict", "CRASH", codes.Unavailable, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, cfg := newStubScanServer(t)
+			f := UploadedFile{Filename: "upload.txt", FileType: "public", Data: []byte(tt.content)}
+
+			err := s.scanUpload(context.Background(), f, strings.Repeat("ab", 32))
+			if got := status.Code(err); got != tt.want {
+				t.Fatalf("scanUpload = %s (%v), want %s", got, err, tt.want)
+			}
+			if staged := dirNames(t, cfg.StagingDir); len(staged) > 0 {
+				t.Errorf("staging holds %v, want it empty", staged)
+			}
+
+			quarantined := dirNames(t, cfg.QuarantineDir)
+			if !tt.quarantined {
+				if len(quarantined) > 0 {
+					t.Errorf("quarantine holds %v, want it empty", quarantined)
+				}
+				return
+			}
+			if len(quarantined) != 2 {
+				t.Fatalf("quarantine holds %v, want the file and its record", quarantined)
+			}
+			var rec QuarantineRecord
+			b, err := ioutil.ReadFile(filepath.Join(cfg.QuarantineDir, quarantined[1]))
+			if err == nil {
+				err = json.Unmarshal(b, &rec)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.ExitCode != 1 || !strings.Contains(rec.Reason, "infected") || rec.Filename != f.Filename {
+				t.Errorf("quarantine record = %+v", rec)
+			}
+			data, err := ioutil.ReadFile(rec.Quarantine)
+			if err != nil || string(data) != tt.content {
+				t.Errorf("quarantined content = %q, %v; want %q", data, err, tt.content)
+			}
+		})
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"clamscan --no-summary", []string{"clamscan", "--no-summary"}},
+		{"  clamscan\t--no-summary  ", []string{"clamscan", "--no-summary"}},
+		{`sh -c "clamscan --no-summary {}"`, []string{"sh", "-c", "clamscan --no-summary {}"}},
+		{`sh -c 'grep -q "EICAR" {} && exit 1'`, []string{"sh", "-c", `grep -q "EICAR" {} && exit 1`}},
+		{`scan --db=/var/lib/"clam av"/db`, []string{"scan", "--db=/var/lib/clam av/db"}},
+		{`echo "a \"b\" \\ \n" 'c\d' e\ f`, []string{"echo", `a "b" \ \n`, `c\d`, "e f"}},
+		{`scan ""`, []string{"scan", ""}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got, err := splitCommand(tt.line)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitCommand(%s) = %q, %v; want %q", tt.line, got, err, tt.want)
+		}
+	}
+
+	for _, line := range []string{`sh -c "clamscan`, `sh -c 'clamscan`, `scan \`} {
+		if got, err := splitCommand(line); err == nil {
+			t.Errorf("splitCommand(%s) = %q, want an error", line, got)
+		}
+	}
+}
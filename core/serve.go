@@ -1,49 +1,379 @@
 package core
 
 import (
+	"crypto/x509"
 	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
 	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
 )
 
+var serveFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "config",
+		Usage:   "path to a yaml or toml config file; keys are the flag names",
+		EnvVars: envVars("config"),
+	},
+	altsrc.NewIntFlag(&cli.IntFlag{
+		Name:    "port",
+		Usage:   "port to bind to",
+		Value:   1313,
+		EnvVars: envVars("port"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "address",
+		Usage:   "listen address, e.g. 0.0.0.0:1313; overrides port",
+		EnvVars: envVars("address"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "root",
+		Usage:   "root directory of the file store",
+		Value:   "fileserver",
+		EnvVars: envVars("root"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "max-file-size",
+		Usage:   "max size of an uploaded file, e.g. 4MiB or 500KB",
+		Value:   "4MiB",
+		EnvVars: envVars("max-file-size"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "key",
+		Usage:   "path to TLS key",
+		EnvVars: envVars("key"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "certificate",
+		Usage:   "path to TLS certificate",
+		EnvVars: envVars("certificate"),
+	}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+		Name:    "tls-pair",
+		Usage:   "additional cert:key pair, presented to clients requesting one of its names (SNI)",
+		EnvVars: envVars("tls-pair"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "tls-min-version",
+		Usage:   "minimum TLS version: 1.0, 1.1, 1.2 or 1.3",
+		Value:   "1.2",
+		EnvVars: envVars("tls-min-version"),
+	}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+		Name:    "tls-cipher-suites",
+		Usage:   "allowed TLS 1.2 cipher suites, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256; Go defaults when empty",
+		EnvVars: envVars("tls-cipher-suites"),
+	}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+		Name:    "tls-curves",
+		Usage:   "preferred curves: X25519, P256, P384, P521; Go defaults when empty",
+		EnvVars: envVars("tls-curves"),
+	}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+		Name:    "alpn",
+		Usage:   "application protocols offered through ALPN, in addition to h2",
+		EnvVars: envVars("alpn"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "client-ca",
+		Usage:   "path to CA bundle verifying client certificates (optional mTLS identity)",
+		EnvVars: envVars("client-ca"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "client-auth",
+		Usage:   "client certificate policy: none, verify-if-given or require (default: verify-if-given with client-ca)",
+		EnvVars: envVars("client-auth"),
+	}),
+	altsrc.NewDurationFlag(&cli.DurationFlag{
+		Name:    "cert-reload-interval",
+		Usage:   "how often the certificate, key and client-ca files are checked for rotation",
+		Value:   30 * time.Second,
+		EnvVars: envVars("cert-reload-interval"),
+	}),
+	altsrc.NewDurationFlag(&cli.DurationFlag{
+		Name:    "cert-expiry-warning",
+		Usage:   "health check warns, when the served certificate expires within this duration",
+		Value:   7 * 24 * time.Hour,
+		EnvVars: envVars("cert-expiry-warning"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "audit-log",
+		Usage:   "path to the append-only, hash-chained audit log; disabled when empty",
+		EnvVars: envVars("audit-log"),
+	}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+		Name:    "upload-identities",
+		Usage:   "identities allowed to upload; empty allows everyone, \"*\" allows anonymous",
+		EnvVars: envVars("upload-identities"),
+	}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+		Name:    "download-identities",
+		Usage:   "identities allowed to download; empty allows everyone",
+		EnvVars: envVars("download-identities"),
+	}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+		Name:    "admin-identities",
+		Usage:   "identities allowed to use admin operations, e.g. audit tail; empty denies everyone",
+		EnvVars: envVars("admin-identities"),
+	}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+		Name:    "share-identities",
+		Usage:   "identities allowed to issue share tokens, besides the admins; empty allows the admins only",
+		EnvVars: envVars("share-identities"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "token-file",
+		Usage:   "yaml file of hashed bearer tokens with scopes and expiry; see gupload token generate",
+		EnvVars: envVars("token-file"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "jwt-public-key",
+		Usage:   "PEM public key or certificate verifying JWT bearer tokens",
+		EnvVars: envVars("jwt-public-key"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "jwt-issuer",
+		Usage:   "required iss claim of JWT bearer tokens",
+		EnvVars: envVars("jwt-issuer"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "jwt-audience",
+		Usage:   "required aud claim of JWT bearer tokens",
+		EnvVars: envVars("jwt-audience"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "share-key",
+		Usage:   "signing key of share tokens: PEM ed25519 private key, or file of >= 32 random bytes (hmac); sharing is disabled when empty",
+		EnvVars: envVars("share-key"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "share-denylist",
+		Usage:   "file of revoked share token ids, one per line",
+		EnvVars: envVars("share-denylist"),
+	}),
+	altsrc.NewDurationFlag(&cli.DurationFlag{
+		Name:    "share-max-ttl",
+		Usage:   "maximum validity of share tokens",
+		Value:   7 * 24 * time.Hour,
+		EnvVars: envVars("share-max-ttl"),
+	}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+		Name:    "validators",
+		Usage:   "validators every upload must pass before it is saved: size, extension, mime, pem",
+		EnvVars: envVars("validators"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "min-file-size",
+		Usage:   "smallest upload accepted by the size validator",
+		Value:   "1B",
+		EnvVars: envVars("min-file-size"),
+	}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+		Name:    "allowed-extensions",
+		Usage:   "file extensions accepted by the extension validator, e.g. .pem,.crt,.yaml",
+		EnvVars: envVars("allowed-extensions"),
+	}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+		Name:    "allowed-mime-types",
+		Usage:   "sniffed content types accepted by the mime validator, e.g. text/plain,application/*",
+		EnvVars: envVars("allowed-mime-types"),
+	}),
+	altsrc.NewBoolFlag(&cli.BoolFlag{
+		Name:    "require-approval",
+		Usage:   "hold public uploads until an admin approves them, see gupload approve",
+		EnvVars: envVars("require-approval"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "master-key-file",
+		Usage:   "32 bytes key, raw or base64, encrypting stored files at rest; or set GUPLOAD_MASTER_KEY. See gupload admin rekey",
+		EnvVars: envVars("master-key-file"),
+	}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+		Name:    "signature-trust-store",
+		Usage:   "PEM certificates, or folders of them, e.g. the msp/cacerts of each org, verifying signed uploads",
+		EnvVars: envVars("signature-trust-store"),
+	}),
+	altsrc.NewBoolFlag(&cli.BoolFlag{
+		Name:    "require-signature",
+		Usage:   "refuse uploads without a detached signature",
+		EnvVars: envVars("require-signature"),
+	}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+		Name:    "msp-identities",
+		Usage:   "org=identity, e.g. Org1MSP=org1-admin, allowed to replace the msp bundle of org, when its certificates do not carry the org in O or OU",
+		EnvVars: envVars("msp-identities"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "scan-cmd",
+		Usage:   "command scanning every upload before commit, e.g. \"clamscan --no-summary\"; the staged file is appended, or replaces {}. Exit code 0 commits",
+		EnvVars: envVars("scan-cmd"),
+	}),
+	altsrc.NewDurationFlag(&cli.DurationFlag{
+		Name:    "scan-timeout",
+		Usage:   "uploads whose scan takes longer are not committed",
+		Value:   time.Minute,
+		EnvVars: envVars("scan-timeout"),
+	}),
+	altsrc.NewIntFlag(&cli.IntFlag{
+		Name:    "scan-concurrency",
+		Usage:   "scans running at the same time; further uploads wait",
+		Value:   2,
+		EnvVars: envVars("scan-concurrency"),
+	}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+		Name:    "webhook",
+		Usage:   "url receiving a json POST for every committed, deleted or downloaded file",
+		EnvVars: envVars("webhook"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "webhook-secret",
+		Usage:   "file of the hmac key (>= 16 bytes) signing the webhook requests, in the X-Gupload-Signature header",
+		EnvVars: envVars("webhook-secret"),
+	}),
+	altsrc.NewIntFlag(&cli.IntFlag{
+		Name:    "webhook-max-attempts",
+		Usage:   "failed webhook deliveries are retried with backoff, then dropped after as many attempts",
+		Value:   10,
+		EnvVars: envVars("webhook-max-attempts"),
+	}),
+	altsrc.NewDurationFlag(&cli.DurationFlag{
+		Name:    "webhook-timeout",
+		Usage:   "timeout of each webhook request",
+		Value:   10 * time.Second,
+		EnvVars: envVars("webhook-timeout"),
+	}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+		Name: "peer",
+		Usage: "server replicating the public files, e.g. " +
+			"grpcs://org2:1313?cacert=org2-ca.crt&cert=tls.crt&key=tls.key&mode=both; mode is pull (default), push or both",
+		EnvVars: envVars("peer"),
+	}),
+	altsrc.NewFloat64Flag(&cli.Float64Flag{
+		Name:    "rate-limit",
+		Usage:   "requests per second allowed per identity (or ip); 0 disables",
+		EnvVars: envVars("rate-limit"),
+	}),
+	altsrc.NewIntFlag(&cli.IntFlag{
+		Name:    "rate-limit-burst",
+		Usage:   "requests allowed in a burst above rate-limit",
+		Value:   10,
+		EnvVars: envVars("rate-limit-burst"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "bandwidth-limit",
+		Usage:   "bytes per second transferred per identity (or ip), e.g. 10MiB/s; 0 disables",
+		Value:   "0",
+		EnvVars: envVars("bandwidth-limit"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "download-stream-limit",
+		Usage:   "bytes per second sent on each download stream, e.g. 2MB/s; 0 disables",
+		Value:   "0",
+		EnvVars: envVars("download-stream-limit"),
+	}),
+	altsrc.NewIntFlag(&cli.IntFlag{
+		Name:    "max-concurrent-uploads",
+		Usage:   "uploads in progress across all clients; 0 is unlimited",
+		EnvVars: envVars("max-concurrent-uploads"),
+	}),
+	altsrc.NewIntFlag(&cli.IntFlag{
+		Name:    "max-concurrent-downloads",
+		Usage:   "downloads in progress across all clients; 0 is unlimited",
+		EnvVars: envVars("max-concurrent-downloads"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "log-file",
+		Usage:   "write logs to this file instead of stderr",
+		EnvVars: envVars("log-file"),
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:    "log-level",
+		Usage:   "info or debug",
+		Value:   logLevelInfo,
+		EnvVars: envVars("log-level"),
+	}),
+}
+
 var ServeCommand = cli.Command{
 	Name:   "serve",
-	Usage:  "initiates a gRPC upload server (max 4MB per file)",
+	Usage:  "initiates a gRPC upload server",
 	Action: serveAction,
-	Flags: []cli.Flag{
-		&cli.IntFlag{
-			Name:  "port",
-			Usage: "port to bind to",
-			Value: 1313,
-		},
-		&cli.StringFlag{
-			Name:  "key",
-			Usage: "path to TLS key",
-		},
-		&cli.StringFlag{
-			Name:  "certificate",
-			Usage: "path to TLS certificate",
-		},
-	},
+	Flags:  serveFlags,
 }
 
 func serveAction(c *cli.Context) (err error) {
 	var (
-		port        = c.Int("port")
-		key         = c.String("key")
-		certificate = c.String("certificate")
-		server      Server
+		auditLog *AuditLog
+		eventLog *EventLog
+		server   Server
 	)
-	fileStore := NewDiskStore("fileserver")
+
+	cfg, err := newServeConfig(c, serveFlags)
+	must(err)
+	must(cfg.setupLogging())
+
+	must(os.MkdirAll(filepath.Join(cfg.Root, "public"), 0755))
+	fileStore := NewEncryptedDiskStore(cfg.Root, cfg.MasterKey)
+	if cfg.MasterKey != nil {
+		log.Printf("encryption at rest enabled, master key %s", cfg.MasterKey.ID)
+	}
+
+	if cfg.AuditLog != "" {
+		auditLog, err = NewAuditLog(cfg.AuditLog)
+		must(err)
+		defer auditLog.Close()
+	}
+
+	eventLog, err = NewEventLog(filepath.Join(cfg.Root, internalDir, "events.log"))
+	must(err)
+	defer eventLog.Close()
+
+	validators, err := newValidators(cfg.Validation)
+	must(err)
+
+	var trustStore *x509.CertPool
+	if len(cfg.SignatureTrustStore) > 0 {
+		trustStore, err = loadTrustStore(cfg.SignatureTrustStore)
+		must(err)
+	}
 
 	grpcServer, err := NewServerGRPC(ServerGRPCConfig{
-		Port:        port,
-		Certificate: certificate,
-		Key:         key,
+		Address:            cfg.Address,
+		Certificate:        cfg.Certificate,
+		Key:                cfg.Key,
+		TLSPairs:           cfg.TLSPairs,
+		TLSPolicy:          cfg.TLSPolicy,
+		ClientCA:           cfg.ClientCA,
+		ClientAuth:         cfg.ClientAuth,
+		CertReloadInterval: cfg.CertReloadInterval,
+		CertExpiryWarning:  cfg.CertExpiryWarning,
+		MaxFileSize:        cfg.MaxFileSize,
+		AuthPolicy:         cfg.Auth,
+		TokenAuth:          cfg.TokenAuth,
+		ShareKey:           cfg.ShareKey,
+		ShareDenylist:      cfg.ShareDenylist,
+		MaxShareTTL:        cfg.MaxShareTTL,
+		Limits:             cfg.Limits,
+		Validators:         validators,
+		Scan:               cfg.Scan,
+		Webhooks:           cfg.Webhooks,
+		Replication:        cfg.Replication,
+		PendingDir:         cfg.PendingDir,
+		MasterKey:          cfg.MasterKey,
+		TrustStore:         trustStore,
+		RequireSignature:   cfg.RequireSignature,
+		MSPIdentities:      cfg.MSPIdentities,
+		Debug:              cfg.LogLevel == logLevelDebug,
+		AuditLog:           auditLog,
+		EventLog:           eventLog,
 	}, fileStore)
 	must(err)
 	server = &grpcServer
 
-	fmt.Printf("🚀 Gupload server listen at: %d\n", port)
+	fmt.Printf("🚀 Gupload server listen at: %s\n", cfg.Address)
 	err = server.Listen()
 	must(err)
 	defer server.Close()
@@ -0,0 +1,367 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// shareTokenMetadata is the metadata key carrying a share token, as an alternative to FileRequest.Token
+const shareTokenMetadata = "x-gupload-share-token"
+
+// minShareKeySize is the minimum size of a hmac share key
+const minShareKeySize = 32
+
+// shareClaims grant download access to one version (sha256) of one file, until Expires (unix seconds)
+type shareClaims struct {
+	ID       string `json:"id"`
+	Filename string `json:"file"`
+	FileType string `json:"type"`
+	Checksum string `json:"sha256"`
+	Expires  int64  `json:"exp"`
+}
+
+// shareSigner signs and verifies share tokens, with either a hmac secret or an ed25519 key.
+// Revoked token ids are listed one per line in the denylist file, which is re-read when modified.
+type shareSigner struct {
+	hmacKey    []byte
+	privateKey ed25519.PrivateKey
+	denylist   string
+
+	mu           sync.Mutex
+	denyModTime  time.Time
+	deniedTokens map[string]bool
+}
+
+// newShareSigner reads keyFile: a PEM ed25519 private key (PKCS #8), or else at least 32 bytes of hmac secret
+func newShareSigner(keyFile string, denylist string) (*shareSigner, error) {
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read share key %s", keyFile)
+	}
+	signer := &shareSigner{
+		denylist:     denylist,
+		deniedTokens: make(map[string]bool),
+	}
+
+	if block, _ := pem.Decode(b); block != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse share key %s", keyFile)
+		}
+		edKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.Errorf("share key %s: only ed25519 private keys are supported", keyFile)
+		}
+		signer.privateKey = edKey
+		return signer, nil
+	}
+
+	if len(b) < minShareKeySize {
+		return nil, errors.Errorf("share key %s: hmac secret needs at least %d bytes", keyFile, minShareKeySize)
+	}
+	signer.hmacKey = b
+	return signer, nil
+}
+
+func (s *shareSigner) sign(payload []byte) []byte {
+	if s.privateKey != nil {
+		return ed25519.Sign(s.privateKey, payload)
+	}
+	mac := hmac.New(sha256.New, s.hmacKey)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func (s *shareSigner) verify(payload []byte, sig []byte) bool {
+	if s.privateKey != nil {
+		return ed25519.Verify(s.privateKey.Public().(ed25519.PublicKey), payload, sig)
+	}
+	return hmac.Equal(s.sign(payload), sig)
+}
+
+// Issue returns a token for the given file version
+func (s *shareSigner) Issue(filename, fileType, checksum string, ttl time.Duration) (token string, claims shareClaims, err error) {
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		return
+	}
+	claims = shareClaims{
+		ID:       hex.EncodeToString(id),
+		Filename: filename,
+		FileType: fileType,
+		Checksum: checksum,
+		Expires:  time.Now().Add(ttl).Unix(),
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return
+	}
+	token = base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(s.sign(payload))
+	return
+}
+
+// Verify checks signature, expiry and denylist of a token, and returns its claims
+func (s *shareSigner) Verify(token string) (claims shareClaims, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return claims, errors.New("malformed share token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, errors.New("malformed share token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, errors.New("malformed share token")
+	}
+
+	if !s.verify(payload, sig) {
+		return claims, errors.New("invalid share token signature")
+	}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return claims, errors.New("malformed share token")
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return claims, errors.Errorf("share token expired at %s", time.Unix(claims.Expires, 0).UTC())
+	}
+
+	revoked, err := s.isRevoked(claims.ID)
+	if err != nil {
+		return
+	}
+	if revoked {
+		return claims, errors.New("share token is revoked")
+	}
+	return
+}
+
+func (s *shareSigner) isRevoked(id string) (bool, error) {
+	if s.denylist == "" {
+		return false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fi, err := os.Stat(s.denylist)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read share denylist %s", s.denylist)
+	}
+	if !fi.ModTime().Equal(s.denyModTime) {
+		f, err := os.Open(s.denylist)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to read share denylist %s", s.denylist)
+		}
+		defer f.Close()
+
+		denied := make(map[string]bool)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				denied[line] = true
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			return false, errors.Wrapf(err, "failed to read share denylist %s", s.denylist)
+		}
+		s.deniedTokens = denied
+		s.denyModTime = fi.ModTime()
+	}
+	return s.deniedTokens[id], nil
+}
+
+// Revoke appends a token id to the denylist
+func (s *shareSigner) Revoke(id string) error {
+	if s.denylist == "" {
+		return errors.New("no share denylist configured")
+	}
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return errors.Errorf("invalid share token id %s", id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.denylist, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open share denylist %s", s.denylist)
+	}
+	defer f.Close()
+
+	// re-read on the next check, even if the modification time did not change
+	s.denyModTime = time.Time{}
+	_, err = fmt.Fprintln(f, id)
+	return err
+}
+
+// shareTokenFilename reads the filename of a share token, without verifying it
+func shareTokenFilename(token string) string {
+	var claims shareClaims
+	payload, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return ""
+	}
+	return claims.Filename
+}
+
+// checksum returns the hex sha256 of r
+func checksum(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Share issues a token granting download access to the current version of a file
+func (s *ServerGRPC) Share(ctx context.Context, req *ShareRequest) (res *ShareResponse, err error) {
+	var claims shareClaims
+	defer func() {
+		s.audit(ctx, AuditRecord{
+			Operation: auditOpShare,
+			Filename:  req.GetFilename(),
+			FileType:  req.GetFileType(),
+			Checksum:  claims.Checksum,
+		}, err)
+	}()
+
+	if err = s.authorize(ctx, authOpShare, authOpAdmin); err != nil {
+		return
+	}
+	if s.shareSigner == nil {
+		return nil, logError(status.Errorf(codes.FailedPrecondition, "sharing is not enabled"))
+	}
+
+	ttl := time.Duration(req.GetTtlSeconds()) * time.Second
+	if ttl <= 0 || ttl > s.maxShareTTL {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "ttl must be between 1s and %s", s.maxShareTTL))
+	}
+	fileType := requestFileType(req.GetFileType())
+	if fileType == "private" {
+		if err = s.authorizePrivate(ctx); err != nil {
+			return
+		}
+	}
+
+	f, size, err := s.fileStore.Open(req.GetFilename(), fileType)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.NotFound, "cannot share %s: %v", req.GetFilename(), err))
+	}
+	if size > s.maxFileSize {
+		f.Close()
+		return nil, s.shareTooLarge(req.GetFilename())
+	}
+	sum, err := checksum(f)
+	f.Close()
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot read %s: %v", req.GetFilename(), err))
+	}
+
+	token, claims, err := s.shareSigner.Issue(req.GetFilename(), fileType, sum, ttl)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot issue share token: %v", err))
+	}
+	log.Printf("share token %s issued for (%s) %s, expires at %s", claims.ID, fileType, claims.Filename,
+		time.Unix(claims.Expires, 0).UTC())
+
+	return &ShareResponse{
+		Token:     token,
+		Id:        claims.ID,
+		ExpiresAt: time.Unix(claims.Expires, 0).UTC().Format(time.RFC3339),
+		Checksum:  sum,
+	}, nil
+}
+
+// RevokeShare adds a share token id to the denylist
+func (s *ServerGRPC) RevokeShare(ctx context.Context, req *RevokeShareRequest) (res *RevokeShareResponse, err error) {
+	defer func() {
+		s.audit(ctx, AuditRecord{Operation: auditOpRevoke, Filename: req.GetId()}, err)
+	}()
+
+	if err = s.authorize(ctx, authOpAdmin); err != nil {
+		return
+	}
+	if s.shareSigner == nil {
+		return nil, logError(status.Errorf(codes.FailedPrecondition, "sharing is not enabled"))
+	}
+
+	if err = s.shareSigner.Revoke(req.GetId()); err != nil {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "cannot revoke share token: %v", err))
+	}
+	log.Printf("share token %s revoked", req.GetId())
+	return &RevokeShareResponse{}, nil
+}
+
+// verifyShareToken returns codes.PermissionDenied for a token that is invalid, or not for filename
+func (s *ServerGRPC) verifyShareToken(token string, filename string) (claims shareClaims, err error) {
+	if s.shareSigner == nil {
+		return claims, logError(status.Errorf(codes.FailedPrecondition, "sharing is not enabled"))
+	}
+
+	claims, err = s.shareSigner.Verify(token)
+	if err != nil {
+		return claims, logError(status.Errorf(codes.PermissionDenied, "%v", err))
+	}
+	if filename != "" && filename != claims.Filename {
+		return claims, logError(status.Errorf(codes.PermissionDenied, "share token is not valid for %s", filename))
+	}
+	return
+}
+
+// openSharedFile returns the file of a share token, when its content is still the shared version. The content is
+// buffered, so that the version checked is the version streamed; files over the max-file-size are refused.
+func (s *ServerGRPC) openSharedFile(claims shareClaims) (io.ReadCloser, int64, error) {
+	f, size, err := s.fileStore.Open(claims.Filename, claims.FileType)
+	if err != nil {
+		return nil, 0, logError(status.Errorf(codes.NotFound, "filepath is invalid"))
+	}
+	defer f.Close()
+	if size > s.maxFileSize {
+		return nil, 0, s.shareTooLarge(claims.Filename)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(f, s.maxFileSize+1))
+	if err != nil {
+		return nil, 0, logError(status.Errorf(codes.Aborted, "cannot open file"))
+	}
+	if int64(len(data)) > s.maxFileSize {
+		return nil, 0, s.shareTooLarge(claims.Filename)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != claims.Checksum {
+		return nil, 0, logError(status.Errorf(codes.FailedPrecondition, "%s changed since it was shared", claims.Filename))
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func (s *ServerGRPC) shareTooLarge(fileName string) error {
+	return logError(status.Errorf(codes.FailedPrecondition,
+		"%s is larger than the max-file-size, %d bytes: it cannot be downloaded with a share token", fileName,
+		s.maxFileSize))
+}
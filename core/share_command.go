@@ -0,0 +1,78 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/net/context"
+	"time"
+)
+
+var ShareCommand = cli.Command{
+	Name:   "share",
+	Usage:  "issue a time-limited token to download one file without credentials",
+	Action: shareAction,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "file",
+			Usage: "filename to share, as uploaded",
+		},
+		&cli.DurationFlag{
+			Name:  "ttl",
+			Usage: "validity of the token",
+			Value: 24 * time.Hour,
+		},
+		&cli.BoolFlag{
+			Name:  "public",
+			Usage: "share a file of the public folder",
+		},
+	}, clientConnectionFlags...),
+	Subcommands: []*cli.Command{
+		{
+			Name:   "revoke",
+			Usage:  "revoke a share token by id (admin)",
+			Action: shareRevokeAction,
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{
+					Name:  "id",
+					Usage: "id of the share token, as printed by gupload share",
+				},
+			}, clientConnectionFlags...),
+		},
+	},
+}
+
+func shareAction(c *cli.Context) (err error) {
+	file := c.String("file")
+
+	if file == "" {
+		must(errors.New("file must be set"))
+	}
+
+	client := newClientFromFlags(c, c.Bool("public"))
+	defer client.Close()
+
+	res, err := client.Share(context.Background(), file, c.Duration("ttl"))
+	must(err)
+
+	fmt.Printf("token:   %s\n", res.GetToken())
+	fmt.Printf("id:      %s\n", res.GetId())
+	fmt.Printf("expires: %s\n", res.GetExpiresAt())
+	fmt.Printf("sha256:  %s\n", res.GetChecksum())
+	return
+}
+
+func shareRevokeAction(c *cli.Context) (err error) {
+	id := c.String("id")
+
+	if id == "" {
+		must(errors.New("id must be set"))
+	}
+
+	client := newClientFromFlags(c, false)
+	defer client.Close()
+
+	must(client.RevokeShare(context.Background(), id))
+	fmt.Printf("share token %s revoked\n", id)
+	return
+}
@@ -0,0 +1,210 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// shareKeyFiles writes a hmac secret and a PEM ed25519 key, as share keys
+func shareKeyFiles(t *testing.T) map[string]string {
+	dir := t.TempDir()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string][]byte{
+		"hmac":    []byte("0123456789abcdef0123456789abcdef"),
+		"ed25519": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+	}
+	paths := make(map[string]string)
+	for name, key := range keys {
+		paths[name] = filepath.Join(dir, name+".key")
+		if err = ioutil.WriteFile(paths[name], key, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return paths
+}
+
+func TestShareTokenSignAndVerify(t *testing.T) {
+	for name, keyFile := range shareKeyFiles(t) {
+		t.Run(name, func(t *testing.T) {
+			signer, err := newShareSigner(keyFile, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, claims, err := signer.Issue("tlsca/org1.crt", "public", "checksum", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := signer.Verify(token); err != nil || got != claims {
+				t.Fatalf("Verify = %+v, %v; want %+v", got, err, claims)
+			}
+			if got := shareTokenFilename(token); got != "tlsca/org1.crt" {
+				t.Errorf("shareTokenFilename = %q", got)
+			}
+
+			other, _, err := signer.Issue("a.txt", "private", "checksum", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expired, _, err := signer.Issue("tlsca/org1.crt", "public", "checksum", -time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload, sig := strings.Split(token, ".")[0], strings.Split(token, ".")[1]
+			invalid := map[string]struct {
+				token string
+				want  string
+			}{
+				"other claims":   {strings.Split(other, ".")[0] + "." + sig, "invalid share token signature"},
+				"truncated sig":  {payload + "." + sig[:len(sig)-4], "invalid share token signature"},
+				"expired":        {expired, "expired"},
+				"no signature":   {payload, "malformed"},
+				"not base64":     {payload + ".!!", "malformed"},
+				"empty":          {"", "malformed"},
+				"three segments": {token + "." + sig, "malformed"},
+			}
+			for name, tt := range invalid {
+				if _, err := signer.Verify(tt.token); err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Errorf("%s: Verify = %v, want an error containing %q", name, err, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestShareTokenOfAnotherKey(t *testing.T) {
+	keys := shareKeyFiles(t)
+	hmacSigner, err := newShareSigner(keys["hmac"], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	edSigner, err := newShareSigner(keys["ed25519"], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := hmacSigner.Issue("a.txt", "public", "checksum", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = edSigner.Verify(token); err == nil {
+		t.Error("a token of another key was accepted")
+	}
+}
+
+func TestShareTokenRevoke(t *testing.T) {
+	denylist := filepath.Join(t.TempDir(), "share.deny")
+	signer, err := newShareSigner(shareKeyFiles(t)["hmac"], denylist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, claims, err := signer.Issue("a.txt", "public", "checksum", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, _, err := signer.Issue("a.txt", "public", "checksum", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = signer.Verify(token); err != nil {
+		t.Fatalf("Verify before Revoke: %v", err)
+	}
+
+	if err = signer.Revoke(claims.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = signer.Verify(token); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("Verify after Revoke = %v, want revoked", err)
+	}
+	if _, err = signer.Verify(kept); err != nil {
+		t.Errorf("Verify of another token after Revoke: %v", err)
+	}
+
+	for _, id := range []string{"", "not-hex", "../x"} {
+		if err = signer.Revoke(id); err == nil {
+			t.Errorf("Revoke(%q): want an error", id)
+		}
+	}
+	if err = (&shareSigner{}).Revoke(claims.ID); err == nil {
+		t.Error("Revoke without a denylist: want an error")
+	}
+}
+
+func TestNewShareSignerRefusesWeakKeys(t *testing.T) {
+	dir := t.TempDir()
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string][]byte{
+		"short hmac": []byte("0123456789abcdef"),
+		"ecdsa":      pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+	}
+	for name, key := range keys {
+		path := filepath.Join(dir, strings.Replace(name, " ", "-", -1))
+		if err = ioutil.WriteFile(path, key, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = newShareSigner(path, ""); err == nil {
+			t.Errorf("%s: newShareSigner accepted the key", name)
+		}
+	}
+}
+
+func TestOpenSharedFile(t *testing.T) {
+	s := &ServerGRPC{fileStore: NewDiskStore(t.TempDir()), maxFileSize: 16}
+	save := func(content string) {
+		if _, err := s.fileStore.Save("a.txt", "public", *bytes.NewBufferString(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save("shared")
+	sum, err := checksum(strings.NewReader("shared"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := shareClaims{Filename: "a.txt", FileType: "public", Checksum: sum}
+
+	f, size, err := s.openSharedFile(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(f)
+	if string(data) != "shared" || size != 6 {
+		t.Errorf("openSharedFile = %q, %d bytes", data, size)
+	}
+
+	save("replaced")
+	if _, _, err = s.openSharedFile(claims); status.Code(err) != codes.FailedPrecondition ||
+		!strings.Contains(err.Error(), "changed") {
+		t.Errorf("openSharedFile of a replaced file = %v, want FailedPrecondition", err)
+	}
+
+	save("larger than the max-file-size")
+	if _, _, err = s.openSharedFile(claims); status.Code(err) != codes.FailedPrecondition ||
+		!strings.Contains(err.Error(), "max-file-size") {
+		t.Errorf("openSharedFile of a large file = %v, want FailedPrecondition", err)
+	}
+}
@@ -0,0 +1,181 @@
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SignatureMeta is the detached signature of a file, as verified on upload
+type SignatureMeta struct {
+	Signature []byte `json:"signature"`
+	// Certificate is the PEM signer certificate, and its intermediates
+	Certificate []byte `json:"certificate"`
+	Signer      string `json:"signer"`
+	VerifiedAt  string `json:"verifiedAt"`
+}
+
+func (m *SignatureMeta) proto() *Signature {
+	return &Signature{Signature: m.Signature, Certificate: m.Certificate, Signer: m.Signer}
+}
+
+// loadTrustStore reads the PEM certificates of files, or of every file in folders, e.g. the cacerts of each org MSP
+func loadTrustStore(paths []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	found := false
+	for _, path := range paths {
+		files := []string{path}
+		if fi, err := os.Stat(path); err != nil {
+			return nil, errors.Wrapf(err, "invalid trust store")
+		} else if fi.IsDir() {
+			entries, err := ioutil.ReadDir(path)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid trust store")
+			}
+			files = files[:0]
+			for _, entry := range entries {
+				if entry.Mode().IsRegular() {
+					files = append(files, filepath.Join(path, entry.Name()))
+				}
+			}
+		}
+
+		for _, file := range files {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid trust store")
+			}
+			if pool.AppendCertsFromPEM(b) {
+				found = true
+			}
+		}
+	}
+	if !found {
+		return nil, errors.New("no certificate found in trust store")
+	}
+	return pool, nil
+}
+
+// verifySignature checks the detached signature of data, and the signer certificate chain against roots, unless
+// roots is nil. It returns the subject of the signer.
+func verifySignature(data []byte, sig *Signature, roots *x509.CertPool) (string, error) {
+	certs, err := parseSignerCertificates(sig.GetCertificate())
+	if err != nil {
+		return "", err
+	}
+	signer := certs[0]
+
+	if roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := signer.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return "", errors.Wrapf(err, "signer '%s' is not trusted", signer.Subject)
+		}
+	}
+
+	algorithm := x509.SHA256WithRSA
+	switch signer.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		algorithm = x509.ECDSAWithSHA256
+	case ed25519.PublicKey:
+		algorithm = x509.PureEd25519
+	}
+	if err := signer.CheckSignature(algorithm, data, sig.GetSignature()); err != nil {
+		return "", errors.Wrapf(err, "invalid signature by '%s'", signer.Subject)
+	}
+	return signer.Subject.String(), nil
+}
+
+// parseSignerCertificates parses the PEM signer certificate, and its intermediates
+func parseSignerCertificates(b []byte) (certs []*x509.Certificate, err error) {
+	rest := b
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid signer certificate")
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no signer certificate")
+	}
+	return certs, nil
+}
+
+// signDetached signs data with a PEM private key, as verifySignature checks it
+func signDetached(data []byte, keyFile string) ([]byte, error) {
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read signing key %s", keyFile)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.Errorf("no PEM block found in signing key %s", keyFile)
+	}
+	key, err := parsePrivateKey(block)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid signing key %s", keyFile)
+	}
+
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return ed25519.Sign(k, data), nil
+	case crypto.Signer:
+		digest := sha256.Sum256(data)
+		return k.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	return nil, errors.Errorf("unsupported signing key type %T", key)
+}
+
+// verifyUploadSignature checks the signature of an upload against the trust store, and returns it as metadata
+func (s *ServerGRPC) verifyUploadSignature(fileId string, data []byte, sig *Signature) (*SignatureMeta, error) {
+	if s.trustStore == nil {
+		return nil, logError(status.Errorf(codes.FailedPrecondition, "signature verification is not enabled"))
+	}
+
+	signer, err := verifySignature(data, sig, s.trustStore)
+	if err != nil {
+		st := status.Newf(codes.InvalidArgument, "%s rejected: %v", fileId, err)
+		if detailed, detailErr := st.WithDetails(&errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: "signature", Description: err.Error()}},
+		}); detailErr == nil {
+			st = detailed
+		}
+		return nil, logError(st.Err())
+	}
+	log.Printf("signature of %s verified: %s", fileId, signer)
+	return &SignatureMeta{
+		Signature:   sig.GetSignature(),
+		Certificate: sig.GetCertificate(),
+		Signer:      signer,
+		VerifiedAt:  time.Now().UTC().Format(time.RFC3339),
+	}, nil
+}
@@ -0,0 +1,207 @@
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testCert is a certificate of a test PKI, with its key
+type testCert struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	pem  []byte
+}
+
+// newTestCert issues a certificate for key, by parent, or self-signed when parent is nil
+func newTestCert(t *testing.T, commonName string, key crypto.Signer, isCA bool, parent *testCert) *testCert {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"org1"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	issuer, issuerKey := template, key
+	if parent != nil {
+		issuer, issuerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, key.Public(), issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func newECKey(t *testing.T) crypto.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// keyFile writes the PKCS #8 PEM of the key of c
+func (c *testCert) keyFile(t *testing.T) string {
+	der, err := x509.MarshalPKCS8PrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "signer.key")
+	if err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerifySignature(t *testing.T) {
+	root := newTestCert(t, "ca.org1", newECKey(t), true, nil)
+	intermediate := newTestCert(t, "ica.org1", newECKey(t), true, root)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+	data := []byte("msp bundle of org1")
+
+	signers := []struct {
+		name   string
+		signer *testCert
+		chain  []byte
+	}{
+		{"ecdsa, with an intermediate", newTestCert(t, "admin.org1", newECKey(t), false, intermediate), intermediate.pem},
+		{"rsa", newTestCert(t, "rsa.org1", rsaKey, false, root), nil},
+		{"ed25519", newTestCert(t, "ed.org1", edKey, false, root), nil},
+	}
+	for _, tt := range signers {
+		t.Run(tt.name, func(t *testing.T) {
+			signature, err := signDetached(data, tt.signer.keyFile(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sig := &Signature{Signature: signature, Certificate: append(append([]byte{}, tt.signer.pem...), tt.chain...)}
+			subject, err := verifySignature(data, sig, roots)
+			if err != nil || !strings.Contains(subject, "CN="+tt.signer.cert.Subject.CommonName) {
+				t.Fatalf("verifySignature = %q, %v", subject, err)
+			}
+
+			if _, err = verifySignature([]byte("another bundle"), sig, roots); err == nil ||
+				!strings.Contains(err.Error(), "invalid signature") {
+				t.Errorf("verifySignature of other data = %v, want an invalid signature", err)
+			}
+		})
+	}
+}
+
+func TestVerifySignatureRefusesUntrustedSigners(t *testing.T) {
+	root := newTestCert(t, "ca.org1", newECKey(t), true, nil)
+	intermediate := newTestCert(t, "ica.org1", newECKey(t), true, root)
+	other := newTestCert(t, "ca.stranger", newECKey(t), true, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+	data := []byte("msp bundle of org1")
+
+	sign := func(signer *testCert, chain ...*testCert) *Signature {
+		signature, err := signDetached(data, signer.keyFile(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := &Signature{Signature: signature, Certificate: append([]byte{}, signer.pem...)}
+		for _, cert := range chain {
+			sig.Certificate = append(sig.Certificate, cert.pem...)
+		}
+		return sig
+	}
+	stranger := sign(newTestCert(t, "admin.stranger", newECKey(t), false, other))
+	tests := []struct {
+		name string
+		sig  *Signature
+		want string
+	}{
+		{"signer of another root", stranger, "not trusted"},
+		{"self-signed signer", sign(newTestCert(t, "admin.org1", newECKey(t), false, nil)), "not trusted"},
+		{"missing intermediate", sign(newTestCert(t, "admin.org1", newECKey(t), false, intermediate)), "not trusted"},
+		{"certificate of another signer", &Signature{Signature: stranger.Signature, Certificate: root.pem},
+			"invalid signature"},
+		{"no certificate", &Signature{Signature: stranger.Signature}, "no signer certificate"},
+	}
+	for _, tt := range tests {
+		if _, err := verifySignature(data, tt.sig, roots); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: verifySignature = %v, want an error containing %q", tt.name, err, tt.want)
+		}
+	}
+
+	// without a trust store, only the signature is checked
+	if _, err := verifySignature(data, stranger, nil); err != nil {
+		t.Errorf("verifySignature without roots: %v", err)
+	}
+}
+
+func TestVerifyUploadSignature(t *testing.T) {
+	root := newTestCert(t, "ca.org1", newECKey(t), true, nil)
+	signer := newTestCert(t, "admin.org1", newECKey(t), false, root)
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.pem"), root.pem, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "README"), []byte("cacerts of org1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	trustStore, err := loadTrustStore([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("msp bundle of org1")
+	signature, err := signDetached(data, signer.keyFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := &Signature{Signature: signature, Certificate: signer.pem}
+
+	s := &ServerGRPC{trustStore: trustStore}
+	meta, err := s.verifyUploadSignature("msp/org1.tar.gz", data, sig)
+	if err != nil || !strings.Contains(meta.Signer, "CN=admin.org1") || string(meta.Certificate) != string(signer.pem) {
+		t.Fatalf("verifyUploadSignature = %+v, %v", meta, err)
+	}
+	if _, err = s.verifyUploadSignature("msp/org1.tar.gz", []byte("tampered"), sig); status.Code(err) !=
+		codes.InvalidArgument {
+		t.Errorf("verifyUploadSignature of tampered data = %v, want InvalidArgument", err)
+	}
+	if _, err = (&ServerGRPC{}).verifyUploadSignature("msp/org1.tar.gz", data, sig); status.Code(err) !=
+		codes.FailedPrecondition {
+		t.Errorf("verifyUploadSignature without trust store = %v, want FailedPrecondition", err)
+	}
+
+	if _, err = loadTrustStore([]string{t.TempDir()}); err == nil {
+		t.Error("loadTrustStore of an empty folder: want an error")
+	}
+}
@@ -7,6 +7,8 @@ import (
 type Stats struct {
 	StartedAt  time.Time
 	FinishedAt time.Time
+	// PendingID is set, when the server holds the upload for approval
+	PendingID string
 }
 
 type PingStats struct {
@@ -14,4 +16,5 @@ type PingStats struct {
 	pingStartAt      time.Time
 	pingFinishedAt   time.Time
 	serverReceivedAt string
+	warning          string
 }
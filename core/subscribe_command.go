@@ -0,0 +1,149 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/net/context"
+)
+
+var SubscribeCommand = cli.Command{
+	Name:   "subscribe",
+	Usage:  "stream the created, updated and deleted files of a folder, optionally running a command for each",
+	Action: subscribeAction,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "prefix",
+			Usage: "folder of the files, e.g. tlsca; every file when empty",
+		},
+		&cli.BoolFlag{
+			Name:  "public",
+			Usage: "files of the public folder, the default",
+		},
+		&cli.BoolFlag{
+			Name:  "private",
+			Usage: "files of the private folder, for the identities listed as uploaders or admins",
+		},
+		&cli.Uint64Flag{
+			Name:  "from",
+			Usage: "replay events starting at this seq; 0 streams only new events",
+		},
+		&cli.StringFlag{
+			Name:  "seq-file",
+			Usage: "file keeping the seq of the last handled event, to resume from after a restart",
+		},
+		&cli.StringSliceFlag{
+			Name:  "type",
+			Usage: "only these event types: created, updated, deleted",
+		},
+		&cli.StringFlag{
+			Name:  "exec",
+			Usage: "command run for each event, {} being replaced by the filename, or appended; e.g. 'update-ca {}'",
+		},
+	}, clientConnectionFlags...),
+}
+
+func subscribeAction(c *cli.Context) (err error) {
+	var (
+		prefix  = strings.Trim(filepath.ToSlash(c.String("prefix")), "/")
+		fromSeq = c.Uint64("from")
+		seqFile = c.String("seq-file")
+		command = strings.Fields(c.String("exec"))
+		types   = map[string]bool{}
+	)
+
+	for _, t := range splitValues(c.StringSlice("type")) {
+		if t != eventCreated && t != eventUpdated && t != eventDeleted {
+			must(fmt.Errorf("invalid event type %s", t))
+		}
+		types[t] = true
+	}
+
+	if c.String("exec") != "" && len(command) == 0 {
+		must(errors.New("exec is empty"))
+	}
+
+	if seqFile != "" && fromSeq == 0 {
+		if b, err := ioutil.ReadFile(seqFile); err == nil {
+			seq, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+			must(err)
+			fromSeq = seq + 1
+		} else if !os.IsNotExist(err) {
+			must(err)
+		}
+	}
+
+	if c.Bool("public") && c.Bool("private") {
+		must(errors.New("public and private are exclusive"))
+	}
+	client := newClientFromFlags(c, !c.Bool("private"))
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	err = client.Subscribe(ctx, prefix, fromSeq, func(event *FileEvent) error {
+		if len(types) == 0 || types[event.GetType()] {
+			fmt.Printf("%d %s %s %s v%d %s\n", event.GetSeq(), event.GetTime(), event.GetType(), event.GetFilename(),
+				event.GetVersion(), event.GetChecksum())
+			if len(command) > 0 {
+				if err := runEventCommand(ctx, command, event); err != nil {
+					fmt.Fprintf(os.Stderr, "❌ %s %s: %v\n", command[0], event.GetFilename(), err)
+				}
+			}
+		}
+		if seqFile != "" {
+			return writeFileAtomic(seqFile, []byte(strconv.FormatUint(event.GetSeq(), 10)+"\n"), 0600)
+		}
+		return nil
+	})
+	if ctx.Err() == nil {
+		must(err)
+	}
+	return nil
+}
+
+// runEventCommand runs command for the event, without a shell: {} is replaced by the filename in each argument, or the
+// filename is appended. The event is also described by GUPLOAD_EVENT_* variables.
+func runEventCommand(ctx context.Context, command []string, event *FileEvent) error {
+	args := make([]string, 0, len(command))
+	substituted := false
+	for _, arg := range command[1:] {
+		if strings.Contains(arg, "{}") {
+			arg = strings.Replace(arg, "{}", event.GetFilename(), -1)
+			substituted = true
+		}
+		args = append(args, arg)
+	}
+	if !substituted {
+		args = append(args, event.GetFilename())
+	}
+
+	cmd := exec.CommandContext(ctx, command[0], args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"GUPLOAD_EVENT_SEQ="+strconv.FormatUint(event.GetSeq(), 10),
+		"GUPLOAD_EVENT_TYPE="+event.GetType(),
+		"GUPLOAD_EVENT_FILE="+event.GetFilename(),
+		"GUPLOAD_EVENT_FILE_TYPE="+event.GetFileType(),
+		"GUPLOAD_EVENT_VERSION="+strconv.FormatUint(event.GetVersion(), 10),
+		"GUPLOAD_EVENT_CHECKSUM="+event.GetChecksum(),
+	)
+	return cmd.Run()
+}
@@ -0,0 +1,176 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	syncUpload       = "upload"
+	syncDownload     = "download"
+	syncDeleteRemote = "delete-remote"
+	syncDeleteLocal  = "delete-local"
+)
+
+// SyncOptions mirror the folder Dir with the remote folder Remote
+type SyncOptions struct {
+	Dir    string
+	Remote string
+	// Pull mirrors the remote folder locally; otherwise the local folder is pushed
+	Pull bool
+	// Delete removes the files missing from the source side
+	Delete bool
+	// Parallel is the number of concurrent transfers
+	Parallel int
+}
+
+// SyncAction is a step of a sync, on the file Name relative to both folders
+type SyncAction struct {
+	Op   string
+	Name string
+	Size int64
+}
+
+func (a SyncAction) String() string {
+	if a.Op == syncDeleteRemote || a.Op == syncDeleteLocal {
+		return fmt.Sprintf("%-13s %s", a.Op, a.Name)
+	}
+	return fmt.Sprintf("%-13s %s (%s)", a.Op, a.Name, humanize.Bytes(uint64(a.Size)))
+}
+
+// syncFile is a file of either side, with its checksum
+type syncFile struct {
+	Size     int64
+	Checksum string
+}
+
+// fileChecksum is the hex encoded sha256 of the file p
+func fileChecksum(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return checksum(f)
+}
+
+// localSyncFiles returns the files of dir, named by their slash separated path relative to dir
+func localSyncFiles(dir string) (files map[string]syncFile, err error) {
+	files = map[string]syncFile{}
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".upload-") || !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		sum, err := fileChecksum(p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = syncFile{Size: info.Size(), Checksum: sum}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", dir)
+	}
+	return
+}
+
+// SyncPlan compares the files of both folders by checksum, and returns the transfers and deletions making the target
+// side a mirror of the source side
+func (c *ClientGRPC) SyncPlan(ctx context.Context, opts SyncOptions) (plan []SyncAction, err error) {
+	local := map[string]syncFile{}
+	fi, err := os.Stat(opts.Dir)
+	switch {
+	case err == nil && fi.IsDir():
+		if local, err = localSyncFiles(opts.Dir); err != nil {
+			return
+		}
+	case os.IsNotExist(err) && opts.Pull:
+		// created by the downloads
+	default:
+		return nil, errors.Errorf("%s is not a folder", opts.Dir)
+	}
+
+	remoteFiles, err := c.List(ctx, opts.Remote)
+	if err != nil {
+		return
+	}
+	remote := map[string]syncFile{}
+	for _, f := range remoteFiles {
+		name, err := cleanArchivePath(strings.TrimPrefix(f.GetFilename(), opts.Remote+"/"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid remote file %s", f.GetFilename())
+		}
+		remote[name] = syncFile{Size: f.GetSize(), Checksum: f.GetChecksum()}
+	}
+
+	source, target := local, remote
+	transfer, remove := syncUpload, syncDeleteRemote
+	if opts.Pull {
+		source, target = remote, local
+		transfer, remove = syncDownload, syncDeleteLocal
+	}
+	for name, f := range source {
+		if t, ok := target[name]; !ok || t.Checksum != f.Checksum {
+			plan = append(plan, SyncAction{Op: transfer, Name: name, Size: f.Size})
+		}
+	}
+	if opts.Delete {
+		for name, f := range target {
+			if _, ok := source[name]; !ok {
+				plan = append(plan, SyncAction{Op: remove, Name: name, Size: f.Size})
+			}
+		}
+	}
+	sort.Slice(plan, func(i, j int) bool { return plan[i].Name < plan[j].Name })
+	return
+}
+
+// Sync runs the actions of plan, with opts.Parallel concurrent transfers
+func (c *ClientGRPC) Sync(ctx context.Context, opts SyncOptions, plan []SyncAction) BatchSummary {
+	// the progress of concurrent downloads would interleave
+	c.quiet = true
+
+	actions := map[string]SyncAction{}
+	names := make([]string, 0, len(plan))
+	for _, action := range plan {
+		name := action.Op + " " + action.Name
+		actions[name] = action
+		names = append(names, name)
+	}
+
+	return runBatch(ctx, names, BatchOptions{Parallel: opts.Parallel}, func(name string) (int64, string, error) {
+		action := actions[name]
+		remoteName := path.Join(opts.Remote, action.Name)
+		localName := filepath.Join(opts.Dir, filepath.FromSlash(action.Name))
+
+		switch action.Op {
+		case syncUpload:
+			stats, err := c.uploadPath(ctx, localName, remoteName)
+			return action.Size, stats.PendingID, err
+		case syncDownload:
+			_, err := c.DownloadFile(remoteName, DownloadOptions{Output: localName, Overwrite: true})
+			return action.Size, "", err
+		case syncDeleteRemote:
+			_, err := c.Delete(ctx, remoteName)
+			return 0, "", err
+		case syncDeleteLocal:
+			return 0, "", os.Remove(localName)
+		}
+		return 0, "", errors.Errorf("unknown sync action %s", action.Op)
+	})
+}
@@ -0,0 +1,89 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/net/context"
+)
+
+var SyncCommand = cli.Command{
+	Name:   "sync",
+	Usage:  "mirror a local folder with a folder of the public files, transferring the changed files only",
+	Action: syncAction,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "dir",
+			Usage: "local folder",
+		},
+		&cli.StringFlag{
+			Name:  "remote",
+			Usage: "remote folder, e.g. org1/",
+		},
+		&cli.BoolFlag{
+			Name:  "pull",
+			Usage: "mirror the remote folder in dir; by default dir is pushed to the remote folder",
+		},
+		&cli.BoolFlag{
+			Name:  "delete",
+			Usage: "delete the files of the target folder missing from the source folder",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "print the plan, without changing any file",
+		},
+		&cli.IntFlag{
+			Name:  "parallel",
+			Value: 4,
+			Usage: "concurrent streams, over one connection",
+		},
+	}, clientConnectionFlags...),
+}
+
+func syncAction(c *cli.Context) (err error) {
+	opts := SyncOptions{
+		Dir:      c.String("dir"),
+		Remote:   strings.Trim(filepath.ToSlash(c.String("remote")), "/"),
+		Pull:     c.Bool("pull"),
+		Delete:   c.Bool("delete"),
+		Parallel: c.Int("parallel"),
+	}
+
+	if opts.Dir == "" {
+		must(errors.New("dir must be set"))
+	}
+
+	if opts.Remote == "" {
+		must(errors.New("remote must be set"))
+	}
+
+	client := newClientFromFlags(c, true)
+	defer client.Close()
+
+	plan, err := client.SyncPlan(context.Background(), opts)
+	must(err)
+
+	if len(plan) == 0 {
+		fmt.Printf("%s and %s/ are in sync\n", opts.Dir, opts.Remote)
+		return
+	}
+
+	if c.Bool("dry-run") {
+		for _, action := range plan {
+			fmt.Println(action)
+		}
+		fmt.Printf("%d changes, not applied (dry run)\n", len(plan))
+		return
+	}
+
+	summary := client.Sync(context.Background(), opts, plan)
+	summary.Print(os.Stdout)
+	if failed := summary.Failed(); failed > 0 {
+		must(fmt.Errorf("%d of %d changes failed", failed, len(plan)))
+	}
+	return
+}
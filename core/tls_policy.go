@@ -0,0 +1,98 @@
+package core
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TLSPolicy holds the tls parameters shared by server and client. Zero values keep the Go defaults.
+type TLSPolicy struct {
+	MinVersion uint16
+	// CipherSuites applies to TLS 1.0 - 1.2 only; TLS 1.3 suites are not configurable
+	CipherSuites     []uint16
+	CurvePreferences []tls.CurveID
+	// NextProtos are offered in addition to "h2", which grpc always requires
+	NextProtos []string
+}
+
+// TLSPair is a certificate and its key file
+type TLSPair struct {
+	Certificate string
+	Key         string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+func parseTLSPolicy(minVersion string, cipherSuites []string, curves []string, nextProtos []string) (p TLSPolicy, err error) {
+	if minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			err = errors.Errorf("invalid tls min version %s: use 1.0, 1.1, 1.2 or 1.3", minVersion)
+			return
+		}
+		p.MinVersion = version
+	}
+
+	if len(cipherSuites) > 0 {
+		known := make(map[string]uint16)
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			known[suite.Name] = suite.ID
+		}
+		for _, name := range cipherSuites {
+			id, ok := known[strings.TrimSpace(name)]
+			if !ok {
+				err = errors.Errorf("unknown tls cipher suite %s", name)
+				return
+			}
+			p.CipherSuites = append(p.CipherSuites, id)
+		}
+	}
+
+	for _, name := range curves {
+		curve, ok := tlsCurves[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			err = errors.Errorf("unknown tls curve %s: use X25519, P256, P384 or P521", name)
+			return
+		}
+		p.CurvePreferences = append(p.CurvePreferences, curve)
+	}
+
+	p.NextProtos = nextProtos
+	return
+}
+
+// parseTLSPairs parses "cert:key" pairs
+func parseTLSPairs(values []string) (pairs []TLSPair, err error) {
+	for _, value := range values {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			err = errors.Errorf("invalid tls pair %s: use path/to/cert:path/to/key", value)
+			return
+		}
+		pairs = append(pairs, TLSPair{Certificate: parts[0], Key: parts[1]})
+	}
+	return
+}
+
+// apply sets the policy on config. h2 is always offered: grpc adds it to the config it is given, but not to the configs
+// cloned from it beforehand, e.g. for GetConfigForClient.
+func (p TLSPolicy) apply(config *tls.Config) {
+	config.MinVersion = p.MinVersion
+	config.CipherSuites = p.CipherSuites
+	config.CurvePreferences = p.CurvePreferences
+	config.NextProtos = append([]string{"h2"}, p.NextProtos...)
+}
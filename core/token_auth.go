@@ -0,0 +1,288 @@
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	authMethodCert  = "cert"
+	authMethodToken = "token"
+	authMethodJWT   = "jwt"
+)
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	Name string
+	// Scopes restrict the operations of token identities; nil means unrestricted (certificate identities)
+	Scopes []string
+	Method string
+	// Orgs are the O and OU of a certificate identity, or the org of a token
+	Orgs []string
+}
+
+func (id Identity) HasScope(op string) bool {
+	if id.Scopes == nil {
+		return true
+	}
+	for _, scope := range id.Scopes {
+		if scope == op {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenEntry is one bearer token of the token file. Only the sha256 of the token is stored.
+type tokenEntry struct {
+	Subject string    `yaml:"subject"`
+	SHA256  string    `yaml:"sha256"`
+	Scopes  []string  `yaml:"scopes"`
+	Org     string    `yaml:"org,omitempty"`
+	Expires time.Time `yaml:"expires,omitempty"`
+}
+
+type tokenFile struct {
+	Tokens []tokenEntry `yaml:"tokens"`
+}
+
+// tokenAuthenticator verifies "authorization: Bearer" metadata, either against the hashed tokens of a token file,
+// or as a JWT signed by the configured public key
+type tokenAuthenticator struct {
+	tokenFile   string
+	jwtKey      crypto.PublicKey
+	jwtMethods  []string
+	jwtIssuer   string
+	jwtAudience string
+
+	mu      sync.Mutex
+	modTime time.Time
+	tokens  []tokenEntry
+}
+
+type TokenAuthConfig struct {
+	// TokenFile is a yaml file of hashed tokens; it is re-read when modified
+	TokenFile string
+	// JWTPublicKey is a PEM public key or certificate (RSA, ECDSA or Ed25519) verifying JWT signatures
+	JWTPublicKey string
+	JWTIssuer    string
+	JWTAudience  string
+}
+
+func newTokenAuthenticator(cfg TokenAuthConfig) (a *tokenAuthenticator, err error) {
+	a = &tokenAuthenticator{
+		tokenFile:   cfg.TokenFile,
+		jwtIssuer:   cfg.JWTIssuer,
+		jwtAudience: cfg.JWTAudience,
+	}
+
+	if cfg.JWTPublicKey != "" {
+		a.jwtKey, err = readPublicKey(cfg.JWTPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		switch a.jwtKey.(type) {
+		case *rsa.PublicKey:
+			a.jwtMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+		case *ecdsa.PublicKey:
+			a.jwtMethods = []string{"ES256", "ES384", "ES512"}
+		case ed25519.PublicKey:
+			a.jwtMethods = []string{"EdDSA"}
+		default:
+			return nil, errors.Errorf("unsupported jwt public key type %T", a.jwtKey)
+		}
+	}
+
+	if a.tokenFile != "" {
+		if _, err = a.loadTokens(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// readPublicKey reads a PEM "PUBLIC KEY" or "CERTIFICATE"
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read public key %s", path)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.Errorf("no PEM data in %s", path)
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse certificate %s", path)
+		}
+		return cert.PublicKey, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse public key %s", path)
+	}
+	return key, nil
+}
+
+// loadTokens re-reads the token file, when it was modified since the last load
+func (a *tokenAuthenticator) loadTokens() ([]tokenEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	fi, err := os.Stat(a.tokenFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read token file %s", a.tokenFile)
+	}
+	if fi.ModTime().Equal(a.modTime) {
+		return a.tokens, nil
+	}
+
+	b, err := ioutil.ReadFile(a.tokenFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read token file %s", a.tokenFile)
+	}
+	var file tokenFile
+	if err = yaml.UnmarshalStrict(b, &file); err != nil {
+		return nil, errors.Wrapf(err, "invalid token file %s", a.tokenFile)
+	}
+	for i, entry := range file.Tokens {
+		if entry.Subject == "" || len(entry.SHA256) != sha256.Size*2 {
+			return nil, errors.Errorf("invalid token file %s: entry %d needs a subject and a hex sha256", a.tokenFile, i+1)
+		}
+	}
+
+	a.tokens = file.Tokens
+	a.modTime = fi.ModTime()
+	return a.tokens, nil
+}
+
+func (a *tokenAuthenticator) Authenticate(token string) (id Identity, err error) {
+	if a.jwtKey != nil && strings.Count(token, ".") == 2 {
+		return a.authenticateJWT(token)
+	}
+	if a.tokenFile == "" {
+		return id, errors.New("bearer tokens are not accepted")
+	}
+
+	tokens, err := a.loadTokens()
+	if err != nil {
+		return
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	hash := hex.EncodeToString(sum[:])
+	for _, entry := range tokens {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(strings.ToLower(entry.SHA256))) != 1 {
+			continue
+		}
+		if !entry.Expires.IsZero() && time.Now().After(entry.Expires) {
+			return id, errors.Errorf("token of %s expired at %s", entry.Subject, entry.Expires.UTC())
+		}
+		id = Identity{Name: entry.Subject, Scopes: nonNilScopes(entry.Scopes), Method: authMethodToken}
+		if entry.Org != "" {
+			id.Orgs = []string{entry.Org}
+		}
+		return id, nil
+	}
+	return id, errors.New("unknown bearer token")
+}
+
+func (a *tokenAuthenticator) authenticateJWT(token string) (id Identity, err error) {
+	parser := &jwt.Parser{ValidMethods: a.jwtMethods}
+	claims := jwt.MapClaims{}
+	_, err = parser.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return a.jwtKey, nil
+	})
+	if err != nil {
+		return id, errors.Wrapf(err, "invalid jwt")
+	}
+
+	// MapClaims.Valid accepts tokens without expiry; we don't
+	if _, ok := claims["exp"]; !ok {
+		return id, errors.New("invalid jwt: exp claim is required")
+	}
+	if a.jwtIssuer != "" && !claims.VerifyIssuer(a.jwtIssuer, true) {
+		return id, errors.New("invalid jwt: unexpected issuer")
+	}
+	if a.jwtAudience != "" && !claims.VerifyAudience(a.jwtAudience, true) {
+		return id, errors.New("invalid jwt: unexpected audience")
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return id, errors.New("invalid jwt: sub claim is required")
+	}
+
+	// "scope" is a space separated string (RFC 8693); "scopes" a list
+	var scopes []string
+	if scope, ok := claims["scope"].(string); ok {
+		scopes = strings.Fields(scope)
+	}
+	if list, ok := claims["scopes"].([]interface{}); ok {
+		for _, scope := range list {
+			if s, ok := scope.(string); ok {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	id = Identity{Name: subject, Scopes: nonNilScopes(scopes), Method: authMethodJWT}
+	if org, ok := claims["org"].(string); ok && org != "" {
+		id.Orgs = []string{org}
+	}
+	return id, nil
+}
+
+// nonNilScopes makes a token without scopes grant nothing, rather than everything
+func nonNilScopes(scopes []string) []string {
+	if scopes == nil {
+		return []string{}
+	}
+	return scopes
+}
+
+// bearerToken returns the token of the "authorization: Bearer" metadata, if any
+func bearerToken(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	for _, value := range md.Get("authorization") {
+		if len(value) > 7 && strings.EqualFold(value[:7], "bearer ") {
+			return strings.TrimSpace(value[7:]), true
+		}
+	}
+	return "", false
+}
+
+// tokenCredentials attaches a bearer token to every rpc of a client
+type tokenCredentials struct {
+	token string
+}
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + t.token}, nil
+}
+
+// RequireTransportSecurity keeps tokens off plaintext connections
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return true
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+var TokenCommand = cli.Command{
+	Name:  "token",
+	Usage: "manage bearer tokens of the server token file",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "generate",
+			Usage:  "create a random token, and print the entry to add to the token file",
+			Action: tokenGenerateAction,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "subject",
+					Usage: "identity of the token holder, as used by the identity lists of serve",
+				},
+				&cli.StringSliceFlag{
+					Name:  "scopes",
+					Usage: "granted operations: upload, download, share, admin",
+					Value: cli.NewStringSlice(authOpDownload),
+				},
+				&cli.StringFlag{
+					Name:  "org",
+					Usage: "org of the token holder, allowed to upload the msp bundle of that org",
+				},
+				&cli.DurationFlag{
+					Name:  "ttl",
+					Usage: "validity of the token; 0 never expires",
+					Value: 90 * 24 * time.Hour,
+				},
+			},
+		},
+	},
+}
+
+func tokenGenerateAction(c *cli.Context) (err error) {
+	var (
+		subject = c.String("subject")
+		scopes  = splitValues(c.StringSlice("scopes"))
+		ttl     = c.Duration("ttl")
+	)
+
+	if subject == "" {
+		must(errors.New("subject must be set"))
+	}
+
+	for _, scope := range scopes {
+		if scope != authOpUpload && scope != authOpDownload && scope != authOpShare && scope != authOpAdmin {
+			must(fmt.Errorf("invalid scope %s: use upload, download, share or admin", scope))
+		}
+	}
+
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	must(err)
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	sum := sha256.Sum256([]byte(token))
+
+	entry := tokenEntry{
+		Subject: subject,
+		SHA256:  hex.EncodeToString(sum[:]),
+		Scopes:  scopes,
+		Org:     c.String("org"),
+	}
+	if ttl > 0 {
+		entry.Expires = time.Now().Add(ttl).UTC().Truncate(time.Second)
+	}
+
+	out, err := yaml.Marshal([]tokenEntry{entry})
+	must(err)
+
+	fmt.Fprintf(os.Stderr, "token (shown once, hand it to %s):\n", subject)
+	fmt.Println(token)
+	fmt.Fprintln(os.Stderr, "\nadd to the tokens list of the server token file:")
+	fmt.Fprint(os.Stderr, string(out))
+	return
+}
@@ -3,23 +3,31 @@ package core
 import (
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
 	"github.com/urfave/cli/v2"
 	"golang.org/x/net/context"
 )
 
 var UploadCommand = cli.Command{
 	Name:   "upload",
-	Usage:  "upload a file (max 4MB per file)",
+	Usage:  "upload a file, up to the max-file-size of the server",
 	Action: uploadAction,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
 			Name:  "address",
 			Value: "localhost:1313",
 			Usage: "address of the server to connect to",
 		},
-		&cli.StringFlag{
+		&cli.StringSliceFlag{
 			Name:  "infile",
-			Usage: "local filename to upload",
+			Usage: "local filename to upload, or - for stdin; several files or a glob, e.g. 'certs/*.pem', are uploaded as the folder outfile",
+		},
+		&cli.StringFlag{
+			Name:  "dir",
+			Usage: "local folder to upload, as the folder outfile (default: the folder name); its files on the server are replaced",
 		},
 		&cli.StringFlag{
 			Name:  "cacert",
@@ -29,26 +37,67 @@ var UploadCommand = cli.Command{
 			Name:  "servername-override",
 			Usage: "use serverNameOverride for tls ca cert",
 		},
+		&cli.StringFlag{
+			Name:  "cert",
+			Usage: "path to client TLS certificate (optional mTLS identity)",
+		},
+		&cli.StringFlag{
+			Name:  "key",
+			Usage: "path to client TLS key",
+		},
+		&cli.StringFlag{
+			Name:  "limit-rate",
+			Usage: "maximum transfer rate, e.g. 2MB/s; unlimited when empty",
+		},
+		&cli.StringSliceFlag{
+			Name:  "encrypt-to",
+			Usage: "encrypt to recipient files (age recipients, or PEM certificates / public keys); the server only stores ciphertext",
+		},
+		&cli.StringFlag{
+			Name:  "sign-with",
+			Usage: "PEM private key signing the file, e.g. the msp/keystore key of the org",
+		},
+		&cli.StringFlag{
+			Name:  "signature",
+			Usage: "detached signature of the file, instead of sign-with, e.g. from openssl dgst -sha256 -sign",
+		},
+		&cli.StringFlag{
+			Name:  "signer-cert",
+			Usage: "PEM certificate of the signer, optionally followed by intermediates, e.g. msp/signcerts",
+		},
 		&cli.StringFlag{
 			Name:  "outfile",
-			Usage: "output filename after upload",
+			Usage: "output filename after upload, or folder of a dir or file set upload",
 		},
 		&cli.BoolFlag{
 			Name:  "public",
 			Usage: "send to public download folder",
 			Value: false,
 		},
-	},
+		&cli.BoolFlag{
+			Name:  "batch",
+			Usage: "upload the infiles one by one, in parallel, as <outfile>/<name> or <name>; instead of as a folder",
+		},
+		&cli.IntFlag{
+			Name:  "parallel",
+			Value: 4,
+			Usage: "concurrent streams of a batch, over one connection",
+		},
+	}, append(clientSecurityFlags, clientRetryFlags...)...),
 }
 
 func uploadAction(c *cli.Context) (err error) {
 	var (
 		address            = c.String("address")
-		infile             = c.String("infile")
+		infiles            = splitValues(c.StringSlice("infile"))
+		dir                = c.String("dir")
 		rootCertificate    = c.String("cacert")
 		serverNameOverride = c.String("servername-override")
+		certificate        = c.String("cert")
+		key                = c.String("key")
 		outfile            = c.String("outfile")
 		public             = c.Bool("public")
+		batch              = c.Bool("batch")
 		client             Client
 	)
 
@@ -56,30 +105,96 @@ func uploadAction(c *cli.Context) (err error) {
 		must(errors.New("address"))
 	}
 
-	if infile == "" {
-		must(errors.New("infile must be set"))
+	if len(infiles) == 0 && dir == "" {
+		must(errors.New("infile or dir must be set"))
+	}
+
+	if len(infiles) > 0 && dir != "" {
+		must(errors.New("infile and dir cannot be both set"))
+	}
+
+	if batch && dir != "" {
+		must(errors.New("batch uploads infiles: use --infile 'dir/*'"))
 	}
 
 	if rootCertificate == "" {
 		must(errors.New("cacert must be set"))
 	}
 
+	tlsPolicy, err := newClientTLSPolicy(c)
+	must(err)
+	limitRate, err := parseRate(c.String("limit-rate"))
+	must(err)
+	token, err := newClientToken(c)
+	must(err)
+	retry, err := newClientRetry(c)
+	must(err)
+
 	grpcClient, err := NewClientGRPC(ClientGRPCConfig{
 		Address:            address,
 		RootCertificate:    rootCertificate,
 		Compress:           true,
 		ServerNameOverride: serverNameOverride,
+		TLSPolicy:          tlsPolicy,
+		Token:              token,
+		Retry:              retry,
+		Timeout:            c.Duration("timeout"),
+		Certificate:        certificate,
+		Key:                key,
+		LimitRate:          limitRate,
+		EncryptTo:          splitValues(c.StringSlice("encrypt-to")),
+		SignWith:           c.String("sign-with"),
+		SignatureFile:      c.String("signature"),
+		SignerCert:         c.String("signer-cert"),
 		Filename:           outfile,
 		UsePublicFolder:    public,
+		Quiet:              batch,
 	})
 	must(err)
 	client = &grpcClient
 
-	stat, err := client.UploadFile(context.Background(), infile)
-	must(err)
 	defer client.Close()
 
+	if batch {
+		paths, err := expandFiles(infiles)
+		must(err)
+		summary := client.UploadFiles(context.Background(), paths, filepath.ToSlash(outfile), BatchOptions{
+			Parallel: c.Int("parallel"),
+		})
+		summary.Print(os.Stdout)
+		if failed := summary.Failed(); failed > 0 {
+			must(fmt.Errorf("%d of %d files failed", failed, len(paths)))
+		}
+		return nil
+	}
+
+	var stat Stats
+	if dir == "" && len(infiles) == 1 && !strings.ContainsAny(infiles[0], "*?[") {
+		stat, err = client.UploadFile(context.Background(), infiles[0])
+		must(err)
+	} else {
+		var files []ArchiveFile
+		if dir != "" {
+			files, err = readTree(dir, nil)
+			if outfile == "" {
+				outfile = filepath.Base(filepath.Clean(dir))
+			}
+		} else {
+			files, err = readFiles(infiles)
+		}
+		must(err)
+		if outfile == "" {
+			must(errors.New("outfile must be set, naming the folder of the files"))
+		}
+		stat, err = client.UploadArchive(context.Background(), files, filepath.ToSlash(outfile))
+		must(err)
+		fmt.Printf("uploaded %d files to %s/\n", len(files), outfile)
+	}
+
 	fmt.Printf("⏱  Time duration (ms): %d\n", stat.FinishedAt.Sub(stat.StartedAt).Milliseconds())
+	if stat.PendingID != "" {
+		fmt.Printf("⏳ pending approval, id: %s\n", stat.PendingID)
+	}
 
 	return
 }
@@ -0,0 +1,248 @@
+package core
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	validatorSize      = "size"
+	validatorExtension = "extension"
+	validatorMime      = "mime"
+	validatorPEM       = "pem"
+)
+
+// pemExtensions are validated by the pem validator, even when they hold no PEM block
+var pemExtensions = []string{".pem", ".crt", ".cer", ".key"}
+
+// UploadedFile is a received upload, before it is committed to the file store
+type UploadedFile struct {
+	Filename string
+	FileType string
+	Data     []byte
+	// Encrypted content is opaque to the content validators
+	Encrypted bool
+	// Archive content is a tar of files, unpacked in the folder Filename
+	Archive bool
+}
+
+// Violation is one reason to reject an upload
+type Violation struct {
+	Validator   string
+	Description string
+}
+
+// Validator inspects an upload before it is committed; no violations accept it
+type Validator interface {
+	Validate(f UploadedFile) []Violation
+}
+
+type ValidationConfig struct {
+	// Validators are the names of the enabled validators: size, extension, mime, pem
+	Validators        []string
+	MinFileSize       int64
+	MaxFileSize       int64
+	AllowedExtensions []string
+	AllowedMimeTypes  []string
+}
+
+// newValidators builds the validators named in cfg, in order
+func newValidators(cfg ValidationConfig) (validators []Validator, err error) {
+	for _, name := range cfg.Validators {
+		switch name {
+		case validatorSize:
+			validators = append(validators, sizeValidator{min: cfg.MinFileSize, max: cfg.MaxFileSize})
+		case validatorExtension:
+			if len(cfg.AllowedExtensions) == 0 {
+				return nil, errors.New("extension validator requires allowed-extensions")
+			}
+			validators = append(validators, extensionValidator{allowed: cfg.AllowedExtensions})
+		case validatorMime:
+			if len(cfg.AllowedMimeTypes) == 0 {
+				return nil, errors.New("mime validator requires allowed-mime-types")
+			}
+			validators = append(validators, mimeValidator{allowed: cfg.AllowedMimeTypes})
+		case validatorPEM:
+			validators = append(validators, pemValidator{})
+		default:
+			return nil, errors.Errorf("unknown validator %s: use size, extension, mime or pem", name)
+		}
+	}
+	return
+}
+
+type sizeValidator struct {
+	min int64
+	max int64
+}
+
+func (v sizeValidator) Validate(f UploadedFile) []Violation {
+	size := int64(len(f.Data))
+	if size < v.min {
+		return []Violation{{validatorSize, fmt.Sprintf("file is too small: %s < %s",
+			humanize.IBytes(uint64(size)), humanize.IBytes(uint64(v.min)))}}
+	}
+	if v.max > 0 && size > v.max {
+		return []Violation{{validatorSize, fmt.Sprintf("file is too large: %s > %s",
+			humanize.IBytes(uint64(size)), humanize.IBytes(uint64(v.max)))}}
+	}
+	return nil
+}
+
+type extensionValidator struct {
+	allowed []string
+}
+
+func (v extensionValidator) Validate(f UploadedFile) []Violation {
+	ext := strings.ToLower(filepath.Ext(f.Filename))
+	for _, allowed := range v.allowed {
+		if ext == strings.ToLower(allowed) || ext == "."+strings.ToLower(allowed) {
+			return nil
+		}
+	}
+	return []Violation{{validatorExtension, fmt.Sprintf("extension '%s' is not allowed: use %s", ext,
+		strings.Join(v.allowed, ", "))}}
+}
+
+// mimeValidator sniffs the content type (see http.DetectContentType); allowed types may end with "/*"
+type mimeValidator struct {
+	allowed []string
+}
+
+func (v mimeValidator) Validate(f UploadedFile) []Violation {
+	if f.Encrypted {
+		return nil
+	}
+	detected := http.DetectContentType(f.Data)
+	mediaType, _, err := mime.ParseMediaType(detected)
+	if err != nil {
+		mediaType = detected
+	}
+	for _, allowed := range v.allowed {
+		if mediaType == allowed ||
+			(strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*"))) {
+			return nil
+		}
+	}
+	return []Violation{{validatorMime, fmt.Sprintf("content type %s is not allowed", mediaType)}}
+}
+
+// pemValidator checks files named like PEM files, or holding PEM blocks anywhere, e.g. after a comment: every
+// CERTIFICATE block must parse and be within its validity period, and private keys must not be uploaded to the public
+// folder
+type pemValidator struct{}
+
+func (pemValidator) Validate(f UploadedFile) (violations []Violation) {
+	if f.Encrypted {
+		return nil
+	}
+	isPEMFile := false
+	ext := strings.ToLower(filepath.Ext(f.Filename))
+	for _, pemExt := range pemExtensions {
+		if ext == pemExt {
+			isPEMFile = true
+		}
+	}
+	if !isPEMFile && !bytes.Contains(f.Data, []byte("-----BEGIN ")) {
+		return nil
+	}
+
+	now := time.Now()
+	rest := f.Data
+	for i := 1; ; i++ {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			if i == 1 && isPEMFile {
+				violations = append(violations, Violation{validatorPEM, "no PEM block found"})
+			}
+			break
+		}
+
+		switch {
+		case block.Type == "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				violations = append(violations, Violation{validatorPEM, fmt.Sprintf("block %d: invalid certificate: %v", i, err)})
+				continue
+			}
+			if now.After(cert.NotAfter) {
+				violations = append(violations, Violation{validatorPEM, fmt.Sprintf("block %d: certificate '%s' expired at %s",
+					i, cert.Subject.CommonName, cert.NotAfter.UTC())})
+			}
+			if now.Before(cert.NotBefore) {
+				violations = append(violations, Violation{validatorPEM, fmt.Sprintf("block %d: certificate '%s' is not valid before %s",
+					i, cert.Subject.CommonName, cert.NotBefore.UTC())})
+			}
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			if f.FileType == "public" {
+				violations = append(violations, Violation{validatorPEM, fmt.Sprintf("block %d: private keys cannot be public", i)})
+			}
+		}
+	}
+	return
+}
+
+// validateFile checks a single file upload: msp bundles, then the validators
+func (s *ServerGRPC) validateFile(f UploadedFile) error {
+	if isMSPBundle(f.Filename, f.FileType) {
+		if err := s.validateMSPBundle(f); err != nil {
+			return err
+		}
+	}
+	return s.validate(f)
+}
+
+// validate runs every validator, and returns codes.InvalidArgument with a BadRequest detail per violation
+func (s *ServerGRPC) validate(f UploadedFile) error {
+	var violations []Violation
+	for _, validator := range s.validators {
+		violations = append(violations, validator.Validate(f)...)
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return rejectedError(f.Filename, violations)
+}
+
+// rejectedError returns codes.InvalidArgument with a BadRequest detail per violation
+func rejectedError(filename string, violations []Violation) error {
+	badRequest := &errdetails.BadRequest{}
+	for _, violation := range violations {
+		badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       violation.Validator,
+			Description: violation.Description,
+		})
+	}
+	st := status.Newf(codes.InvalidArgument, "%s rejected: %s", filename, violations[0].Description)
+	if detailed, err := st.WithDetails(badRequest); err == nil {
+		st = detailed
+	}
+	return logError(st.Err())
+}
+
+// statusDetails formats the BadRequest details of a grpc error, one violation per line
+func statusDetails(err error) string {
+	var lines []string
+	for _, detail := range status.Convert(errors.Cause(err)).Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			for _, violation := range badRequest.GetFieldViolations() {
+				lines = append(lines, fmt.Sprintf("  - %s: %s", violation.GetField(), violation.GetDescription()))
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,292 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WatchOptions upload the files of Dir, as they are written
+type WatchOptions struct {
+	Dir string
+	// Remote is the folder of the uploaded files; they keep their path relative to Dir
+	Remote string
+	// Settle is the quiet time after the last write of a file, before its upload
+	Settle time.Duration
+	// Queue is the file keeping the uploads to do, and the checksums of the uploaded files, across restarts
+	Queue string
+}
+
+// watchItem is an upload to do
+type watchItem struct {
+	Attempts  int       `json:"attempts,omitempty"`
+	NextAt    time.Time `json:"nextAt,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// watchQueue is the persistent state of a watch, by path relative to its folder
+type watchQueue struct {
+	Pending  map[string]*watchItem `json:"pending"`
+	Uploaded map[string]string     `json:"uploaded"`
+}
+
+// watcher uploads the files of a folder through the client, one at a time
+type watcher struct {
+	c     *ClientGRPC
+	opts  WatchOptions
+	queue watchQueue
+	// changed are the files written since their last check, with the time of their last write
+	changed map[string]time.Time
+}
+
+// watchIgnored skips hidden files and folders, e.g. the queue folder, editor swap files or partial downloads
+func watchIgnored(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), ".")
+}
+
+func loadWatchQueue(file string) (q watchQueue, err error) {
+	b, err := ioutil.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(b, &q)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return q, errors.Wrapf(err, "failed to read queue %s", file)
+	}
+	if q.Pending == nil {
+		q.Pending = map[string]*watchItem{}
+	}
+	if q.Uploaded == nil {
+		q.Uploaded = map[string]string{}
+	}
+	return
+}
+
+func (w *watcher) save() error {
+	b, err := json.MarshalIndent(w.queue, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(w.opts.Queue), 0700); err != nil {
+		return err
+	}
+	return errors.Wrapf(writeFileAtomic(w.opts.Queue, b, 0600), "failed to save queue %s", w.opts.Queue)
+}
+
+// add watches dir and its sub folders, and marks their files as changed, as they may be new
+func (w *watcher) add(fsw *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// removed meanwhile
+			return nil
+		}
+		if p != w.opts.Dir && watchIgnored(p) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return errors.Wrapf(fsw.Add(p), "failed to watch %s", p)
+		}
+		if info.Mode().IsRegular() {
+			if rel, err := filepath.Rel(w.opts.Dir, p); err == nil {
+				w.changed[filepath.ToSlash(rel)] = info.ModTime()
+			}
+		}
+		return nil
+	})
+}
+
+// event records a write, creation or removal
+func (w *watcher) event(fsw *fsnotify.Watcher, event fsnotify.Event) error {
+	rel, err := filepath.Rel(w.opts.Dir, event.Name)
+	if err != nil || watchIgnored(event.Name) {
+		return nil
+	}
+	name := filepath.ToSlash(rel)
+
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		delete(w.changed, name)
+		return nil
+	}
+	if event.Op&fsnotify.Create != 0 {
+		if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+			return w.add(fsw, event.Name)
+		}
+	}
+	w.changed[name] = time.Now()
+	return nil
+}
+
+// settle queues the changed files, once neither an event nor their modification time is more recent than the settle
+// time, and their content differs from the last upload
+func (w *watcher) settle() error {
+	now := time.Now()
+	queued := false
+	for name, changedAt := range w.changed {
+		if now.Sub(changedAt) < w.opts.Settle {
+			continue
+		}
+		p := filepath.Join(w.opts.Dir, filepath.FromSlash(name))
+		fi, err := os.Stat(p)
+		if err != nil || !fi.Mode().IsRegular() {
+			delete(w.changed, name)
+			continue
+		}
+		if now.Sub(fi.ModTime()) < w.opts.Settle {
+			w.changed[name] = fi.ModTime()
+			continue
+		}
+		delete(w.changed, name)
+
+		sum, err := fileChecksum(p)
+		if err != nil || sum == w.queue.Uploaded[name] {
+			continue
+		}
+		if _, ok := w.queue.Pending[name]; !ok {
+			w.queue.Pending[name] = &watchItem{}
+			queued = true
+		}
+	}
+	if queued {
+		return w.save()
+	}
+	return nil
+}
+
+// watchRejected tells whether the server refused the file itself, which another attempt would not change
+func watchRejected(err error) bool {
+	switch status.Code(errors.Cause(err)) {
+	case codes.InvalidArgument, codes.AlreadyExists, codes.FailedPrecondition, codes.OutOfRange:
+		return true
+	}
+	return false
+}
+
+// upload uploads the queued files due for an attempt. A failed upload, once the retries of the client are exhausted,
+// is attempted again later, with backoff, unless the server rejected it.
+func (w *watcher) upload(ctx context.Context) error {
+	var due []string
+	for name, item := range w.queue.Pending {
+		if !time.Now().Before(item.NextAt) {
+			due = append(due, name)
+		}
+	}
+	sort.Strings(due)
+
+	for _, name := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		item := w.queue.Pending[name]
+		p := filepath.Join(w.opts.Dir, filepath.FromSlash(name))
+		remoteName := path.Join(w.opts.Remote, name)
+
+		sum, err := fileChecksum(p)
+		var stats Stats
+		if err == nil {
+			stats, err = w.c.uploadPath(ctx, p, remoteName)
+		}
+		switch {
+		case err == nil:
+			delete(w.queue.Pending, name)
+			w.queue.Uploaded[name] = sum
+			if stats.PendingID != "" {
+				fmt.Printf("⏳ %s uploaded, pending approval, id: %s\n", remoteName, stats.PendingID)
+			} else {
+				fmt.Printf("✅ %s uploaded\n", remoteName)
+			}
+		case os.IsNotExist(errors.Cause(err)):
+			delete(w.queue.Pending, name)
+		case ctx.Err() != nil:
+			// interrupted; the upload stays queued for the next run
+		case watchRejected(err):
+			delete(w.queue.Pending, name)
+			fmt.Fprintf(os.Stderr, "❌ %s: %v\n", remoteName, err)
+		default:
+			item.Attempts++
+			item.LastError = err.Error()
+			item.NextAt = time.Now().Add(w.c.retryPolicy.backoff(item.Attempts))
+			fmt.Fprintf(os.Stderr, "❌ %s (attempt %d, next at %s): %v\n", remoteName, item.Attempts,
+				item.NextAt.Format(time.RFC3339), err)
+		}
+		if err := w.save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Watch uploads the files of opts.Dir once their writes settle, and the files changed while it was not running, until
+// ctx is done. Uploads survive a restart in the queue file.
+func (c *ClientGRPC) Watch(ctx context.Context, opts WatchOptions) (err error) {
+	// uploads report their own outcome
+	c.quiet = true
+
+	queue, err := loadWatchQueue(opts.Queue)
+	if err != nil {
+		return
+	}
+	w := &watcher{c: c, opts: opts, queue: queue, changed: map[string]time.Time{}}
+
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrapf(err, "failed to watch %s", opts.Dir)
+	}
+	defer fsw.Close()
+	if err = w.add(fsw, opts.Dir); err != nil {
+		return
+	}
+	fmt.Printf("👀 watching %s, %d uploads queued\n", opts.Dir, len(w.queue.Pending))
+
+	tick := opts.Settle / 4
+	if tick < 100*time.Millisecond {
+		tick = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-fsw.Events:
+			if !ok {
+				return nil
+			}
+			if err = w.event(fsw, event); err != nil {
+				return
+			}
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return nil
+			}
+			// e.g. the inotify queue overflowed: check every file again
+			fmt.Fprintf(os.Stderr, "watch error: %v\n", err)
+			if err = w.add(fsw, opts.Dir); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err = w.settle(); err != nil {
+				return
+			}
+			if err = w.upload(ctx); err != nil {
+				return
+			}
+		}
+	}
+}
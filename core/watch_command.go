@@ -0,0 +1,79 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/net/context"
+)
+
+var WatchCommand = cli.Command{
+	Name:   "watch",
+	Usage:  "upload the files of a folder, as they are created or modified",
+	Action: watchAction,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "dir",
+			Usage: "local folder to watch, with its sub folders; hidden files are skipped",
+		},
+		&cli.StringFlag{
+			Name:  "remote",
+			Usage: "remote folder of the uploads; by default, files keep their path relative to dir",
+		},
+		&cli.BoolFlag{
+			Name:  "public",
+			Usage: "send to public download folder",
+		},
+		&cli.DurationFlag{
+			Name:  "settle",
+			Value: 2 * time.Second,
+			Usage: "wait after the last write of a file, before its upload",
+		},
+		&cli.StringFlag{
+			Name:  "queue",
+			Usage: "file keeping the queued uploads across restarts (default: <dir>/.gupload/watch.json)",
+		},
+	}, clientConnectionFlags...),
+}
+
+func watchAction(c *cli.Context) (err error) {
+	opts := WatchOptions{
+		Dir:    c.String("dir"),
+		Remote: strings.Trim(filepath.ToSlash(c.String("remote")), "/"),
+		Settle: c.Duration("settle"),
+		Queue:  c.String("queue"),
+	}
+
+	if opts.Dir == "" {
+		must(errors.New("dir must be set"))
+	}
+
+	if fi, err := os.Stat(opts.Dir); err != nil || !fi.IsDir() {
+		must(errors.New("dir must be an existing folder"))
+	}
+
+	if opts.Queue == "" {
+		opts.Queue = filepath.Join(opts.Dir, internalDir, "watch.json")
+	}
+
+	client := newClientFromFlags(c, c.Bool("public"))
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	must(client.Watch(ctx, opts))
+	return
+}
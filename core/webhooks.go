@@ -0,0 +1,334 @@
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	webhookCommitted  = "committed"
+	webhookDeleted    = "deleted"
+	webhookDownloaded = "downloaded"
+
+	// webhookSignatureHeader carries the hex hmac-sha256 of the body, keyed with the webhook secret
+	webhookSignatureHeader = "X-Gupload-Signature"
+	webhookEventHeader     = "X-Gupload-Event"
+	webhookDeliveryHeader  = "X-Gupload-Delivery"
+
+	// minWebhookSecretSize is the minimum length of the hmac key signing the deliveries
+	minWebhookSecretSize = 16
+)
+
+type WebhookConfig struct {
+	// URLs receive every event; webhooks are disabled when empty
+	URLs []string
+	// Secret is the file of the hmac key signing the deliveries
+	Secret string
+	// Dir queues the deliveries, so that they survive a restart
+	Dir string
+	// MaxAttempts drops a delivery after as many failures; default 10
+	MaxAttempts int
+	// Timeout bounds each request; default 10s
+	Timeout time.Duration
+}
+
+// WebhookEvent is the json body posted to the webhooks
+type WebhookEvent struct {
+	Id       string `json:"id"`
+	Type     string `json:"type"`
+	Time     string `json:"time"`
+	Filename string `json:"filename"`
+	FileType string `json:"fileType"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum,omitempty"`
+	Identity string `json:"identity,omitempty"`
+	Peer     string `json:"peer,omitempty"`
+}
+
+// webhookDelivery is a queued request to one webhook. The body is kept as sent, so that every attempt carries the
+// same signature.
+type webhookDelivery struct {
+	Id        string          `json:"id"`
+	URL       string          `json:"url"`
+	Type      string          `json:"type"`
+	Body      json.RawMessage `json:"body"`
+	Attempts  int             `json:"attempts"`
+	NextAt    time.Time       `json:"nextAt"`
+	LastError string          `json:"lastError,omitempty"`
+}
+
+// webhookSender posts the queued deliveries, one at a time, in the order of their next attempt
+type webhookSender struct {
+	cfg     WebhookConfig
+	secret  []byte
+	client  *http.Client
+	backoff RetryPolicy
+	wake    chan struct{}
+}
+
+func newWebhookSender(cfg WebhookConfig) (*webhookSender, error) {
+	for _, u := range cfg.URLs {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return nil, errors.Errorf("invalid webhook url %s", u)
+		}
+	}
+	if cfg.Secret == "" {
+		return nil, errors.New("webhook-secret must be set, to sign the deliveries")
+	}
+	secret, err := ioutil.ReadFile(cfg.Secret)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read webhook secret %s", cfg.Secret)
+	}
+	secret = bytes.TrimSpace(secret)
+	if len(secret) < minWebhookSecretSize {
+		return nil, errors.Errorf("webhook secret %s: needs at least %d bytes", cfg.Secret, minWebhookSecretSize)
+	}
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 10
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	for _, dir := range []string{cfg.Dir, filepath.Join(cfg.Dir, "failed")} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, errors.Wrapf(err, "failed to create %s", dir)
+		}
+	}
+	return &webhookSender{
+		cfg:     cfg,
+		secret:  secret,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		backoff: RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Minute, Multiplier: 2, Jitter: 0.2},
+		wake:    make(chan struct{}, 1),
+	}, nil
+}
+
+// sign returns the value of the signature header of body
+func (w *webhookSender) sign(body []byte) string {
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// enqueue writes a delivery of event for each webhook, and wakes the sender
+func (w *webhookSender) enqueue(event WebhookEvent) error {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	event.Id = hex.EncodeToString(id)
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode webhook event")
+	}
+
+	for i, u := range w.cfg.URLs {
+		d := webhookDelivery{Id: fmt.Sprintf("%s-%d", event.Id, i), URL: u, Type: event.Type, Body: body,
+			NextAt: time.Now()}
+		if err = w.save(d); err != nil {
+			break
+		}
+	}
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+func (w *webhookSender) save(d webhookDelivery) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(writeFileAtomic(filepath.Join(w.cfg.Dir, d.Id+".json"), b, 0600),
+		"failed to queue webhook delivery %s", d.Id)
+}
+
+// queued returns the deliveries of the queue, by next attempt
+func (w *webhookSender) queued() (deliveries []webhookDelivery, err error) {
+	entries, err := ioutil.ReadDir(w.cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(w.cfg.Dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var d webhookDelivery
+		if err := json.Unmarshal(b, &d); err != nil {
+			log.Printf("skipping malformed webhook delivery %s: %v", e.Name(), err)
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].NextAt.Before(deliveries[j].NextAt) })
+	return
+}
+
+// post sends the delivery; any status but 2xx is a failure
+func (w *webhookSender) post(ctx context.Context, d webhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gupload-webhook")
+	req.Header.Set(webhookEventHeader, d.Type)
+	req.Header.Set(webhookDeliveryHeader, d.Id)
+	req.Header.Set(webhookSignatureHeader, w.sign(d.Body))
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.Errorf("%s answered %s", d.URL, res.Status)
+	}
+	return nil
+}
+
+// deliver attempts the due deliveries, and returns the time of the next attempt; zero when the queue is empty
+func (w *webhookSender) deliver(ctx context.Context) (next time.Time, err error) {
+	deliveries, err := w.queued()
+	if err != nil {
+		return
+	}
+
+	for _, d := range deliveries {
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Now().Before(d.NextAt) {
+			if next.IsZero() || d.NextAt.Before(next) {
+				next = d.NextAt
+			}
+			continue
+		}
+
+		postErr := w.post(ctx, d)
+		if ctx.Err() != nil {
+			// shutting down; the delivery is attempted again after the restart
+			return
+		}
+		switch {
+		case postErr == nil:
+			err = os.Remove(filepath.Join(w.cfg.Dir, d.Id+".json"))
+		case d.Attempts+1 >= w.cfg.MaxAttempts:
+			d.Attempts++
+			d.LastError = postErr.Error()
+			log.Printf("webhook delivery %s to %s dropped after %d attempts: %v", d.Id, d.URL, d.Attempts, postErr)
+			if err = w.save(d); err == nil {
+				err = os.Rename(filepath.Join(w.cfg.Dir, d.Id+".json"), filepath.Join(w.cfg.Dir, "failed", d.Id+".json"))
+			}
+		default:
+			d.Attempts++
+			d.LastError = postErr.Error()
+			d.NextAt = time.Now().Add(w.backoff.backoff(d.Attempts))
+			log.Printf("webhook delivery %s to %s failed (attempt %d of %d), retrying at %s: %v", d.Id, d.URL,
+				d.Attempts, w.cfg.MaxAttempts, d.NextAt.UTC().Format(time.RFC3339), postErr)
+			err = w.save(d)
+			if next.IsZero() || d.NextAt.Before(next) {
+				next = d.NextAt
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// run delivers the queue, including the deliveries left by a previous run, until stop is closed
+func (w *webhookSender) run(stop chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		next, err := w.deliver(ctx)
+		if err != nil {
+			log.Printf("webhook queue: %v", err)
+			next = time.Now().Add(time.Minute)
+		}
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-w.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// webhookTree queues the commit of each file of the folder prefix
+func (s *ServerGRPC) webhookTree(ctx context.Context, fileType string, prefix string, files []ArchiveFile) {
+	for _, f := range files {
+		sum := sha256.Sum256(f.Data)
+		s.webhook(ctx, webhookCommitted, fileType, path.Join(prefix, f.Name), int64(len(f.Data)),
+			hex.EncodeToString(sum[:]))
+	}
+}
+
+// webhook queues the event of a file operation, with the identity of the client. The operation succeeded by then: a
+// failure is only logged.
+func (s *ServerGRPC) webhook(ctx context.Context, eventType string, fileType string, fileId string, size int64,
+	checksum string) {
+	if s.webhooks == nil {
+		return
+	}
+	event := WebhookEvent{
+		Type:     eventType,
+		Time:     time.Now().UTC().Format(time.RFC3339Nano),
+		Filename: fileId,
+		FileType: fileType,
+		Size:     size,
+		Checksum: checksum,
+	}
+	event.Peer, _ = peerInfo(ctx)
+	if id, err := s.identity(ctx); err == nil {
+		event.Identity = id.Name
+	}
+	if err := s.webhooks.enqueue(event); err != nil {
+		log.Printf("cannot queue webhook event of %s: %v", fileId, err)
+	}
+}
@@ -0,0 +1,147 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// webhookReceiver records the requests of a test webhook, answering each with the next of statuses, then 200
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	code := http.StatusOK
+	if len(r.statuses) > 0 {
+		code, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	w.WriteHeader(code)
+}
+
+func newTestWebhookSender(t *testing.T, url string, maxAttempts int) (*webhookSender, string) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "webhook.secret")
+	if err := ioutil.WriteFile(secret, []byte("0123456789abcdef0123456789abcdef\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	w, err := newWebhookSender(WebhookConfig{
+		URLs:        []string{url},
+		Secret:      secret,
+		Dir:         filepath.Join(dir, "webhooks"),
+		MaxAttempts: maxAttempts,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// retry at once
+	w.backoff = RetryPolicy{}
+	return w, filepath.Join(dir, "webhooks")
+}
+
+func queueLen(t *testing.T, w *webhookSender) int {
+	deliveries, err := w.queued()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(deliveries)
+}
+
+func TestWebhookDeliveryIsSignedAndRetried(t *testing.T) {
+	receiver := &webhookReceiver{statuses: []int{http.StatusServiceUnavailable}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	w, _ := newTestWebhookSender(t, server.URL, 3)
+
+	err := w.enqueue(WebhookEvent{Type: webhookCommitted, Filename: "tlsca/org1.crt", FileType: "public", Size: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.deliver(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := queueLen(t, w); n != 1 {
+		t.Fatalf("after a 503, %d deliveries queued, want 1", n)
+	}
+	if _, err = w.deliver(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := queueLen(t, w); n != 0 {
+		t.Fatalf("after a 200, %d deliveries queued, want 0", n)
+	}
+
+	if len(receiver.requests) != 2 {
+		t.Fatalf("webhook received %d requests, want 2", len(receiver.requests))
+	}
+	for i, req := range receiver.requests {
+		body := receiver.bodies[i]
+		mac := hmac.New(sha256.New, []byte("0123456789abcdef0123456789abcdef"))
+		mac.Write(body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); req.Header.Get(webhookSignatureHeader) != want {
+			t.Errorf("request %d: signature %s, want %s", i, req.Header.Get(webhookSignatureHeader), want)
+		}
+		if req.Header.Get(webhookEventHeader) != webhookCommitted {
+			t.Errorf("request %d: event header %q", i, req.Header.Get(webhookEventHeader))
+		}
+		var event WebhookEvent
+		if err = json.Unmarshal(body, &event); err != nil || event.Filename != "tlsca/org1.crt" || event.Id == "" {
+			t.Errorf("request %d: body %s, %v", i, body, err)
+		}
+	}
+	if receiver.requests[0].Header.Get(webhookDeliveryHeader) != receiver.requests[1].Header.Get(webhookDeliveryHeader) ||
+		string(receiver.bodies[0]) != string(receiver.bodies[1]) {
+		t.Error("a retried delivery must keep its id and body")
+	}
+}
+
+func TestWebhookDeliveryDroppedAfterMaxAttempts(t *testing.T) {
+	receiver := &webhookReceiver{statuses: []int{http.StatusInternalServerError, http.StatusBadGateway}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	w, dir := newTestWebhookSender(t, server.URL, 2)
+
+	if err := w.enqueue(WebhookEvent{Type: webhookDeleted, Filename: "a.txt", FileType: "public"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := w.deliver(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(receiver.requests) != 2 {
+		t.Errorf("webhook received %d requests, want 2", len(receiver.requests))
+	}
+	if n := queueLen(t, w); n != 0 {
+		t.Errorf("%d deliveries queued, want 0", n)
+	}
+	failed, err := filepath.Glob(filepath.Join(dir, "failed", "*.json"))
+	if err != nil || len(failed) != 1 {
+		t.Fatalf("failed deliveries %v, %v; want 1", failed, err)
+	}
+	b, err := ioutil.ReadFile(failed[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d webhookDelivery
+	if err = json.Unmarshal(b, &d); err != nil || d.Attempts != 2 || d.LastError == "" {
+		t.Errorf("failed delivery %s, %v", b, err)
+	}
+}
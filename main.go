@@ -24,7 +24,19 @@ func main() {
 			&core.ServeCommand,
 			&core.UploadCommand,
 			&core.DownloadCommand,
+			&core.UploadMSPCommand,
+			&core.DownloadMSPCommand,
 			&core.HealthCheckCommand,
+			&core.AuditCommand,
+			&core.TokenCommand,
+			&core.ShareCommand,
+			&core.ApproveCommand,
+			&core.RejectCommand,
+			&core.AdminCommand,
+			&core.SyncCommand,
+			&core.WatchCommand,
+			&core.SubscribeCommand,
+			&core.ReplicationCommand,
 		},
 	}
 